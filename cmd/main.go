@@ -1,15 +1,25 @@
 package main
 
 import (
+	"aegis/internal/attack"
+	"aegis/internal/ban"
 	"aegis/internal/captcha"
+	"aegis/internal/cli"
 	"aegis/internal/config"
 	"aegis/internal/fingerprint"
 	"aegis/internal/limiter"
 	"aegis/internal/middleware"
+	"aegis/internal/reload"
 	"aegis/internal/server"
 	"aegis/internal/sha_challenge"
+	"aegis/internal/site"
+	"aegis/internal/store"
+	"aegis/internal/strikes"
+	"aegis/internal/tokens"
 	"aegis/internal/usecase"
+	"aegis/internal/validator"
 	"aegis/internal/version"
+	"cmp"
 	"context"
 	"errors"
 	"flag"
@@ -18,70 +28,255 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"syscall"
 	"time"
 )
 
+// logLevel is the level of the default logger, it is changed by the configuration reload
+var logLevel slog.LevelVar
+
 func prepareLogger(level string) {
-	opts := slog.HandlerOptions{}
-	switch level {
-	case "ERROR":
-		opts.Level = slog.LevelError
-	case "WARNING":
-		opts.Level = slog.LevelWarn
-	case "INFO":
-		opts.Level = slog.LevelInfo
-	case "DEBUG":
-		opts.Level = slog.LevelDebug
+	parsed, err := reload.ParseLevel(level)
+	if err != nil {
+		slog.Error("Failed to prepare logger", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	logLevel.Set(parsed)
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})))
+}
+
+func prepareStore(cfg *config.Config) store.Store {
+	capacities := map[string]int{tokens.BucketTokens: cfg.Tokens.MaxTokens}
+	switch cfg.Storage.Type {
+	case store.TypeMemory:
+		return store.NewMemoryStore(capacities)
+	case store.TypeFile:
+		s, err := store.NewFileStore(cfg.Storage.Path, cfg.Storage.SnapshotInterval.Duration(), capacities)
+		if err != nil {
+			slog.Error("Failed to load storage", slog.String("path", cfg.Storage.Path), slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return s
+	case store.TypeRedis:
+		s, err := store.NewRedisStore(store.RedisOptions{
+			Address:  cfg.Storage.Address,
+			Username: cfg.Storage.Username,
+			Password: cfg.Storage.Password,
+			DB:       cfg.Storage.DB,
+			Prefix:   cfg.Storage.Prefix,
+			PoolSize: cfg.Storage.PoolSize,
+			Timeout:  cfg.Storage.Timeout.Duration(),
+		})
+		if err != nil {
+			slog.Error("Failed to connect storage", slog.String("address", cfg.Storage.Address), slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return s
 	default:
-		slog.Error("Failed to prepare logger", slog.String("error", fmt.Sprintf("unknown level %s", level)))
+		slog.Error("Unknown storage type", "storage", cfg.Storage.Type)
 		os.Exit(1)
 	}
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &opts)))
+	return nil
 }
 
-func startServer(ctx context.Context, cancel context.CancelFunc, cfg *config.Config) *server.ApiServer {
+// prepareIssuer creates the token issuer of the site namespace.
+func prepareIssuer(cfg *config.Config, verification, namespace string, st store.Store) tokens.Issuer {
+	switch cfg.Tokens.Format {
+	case tokens.FormatRandom:
+		return tokens.NewRegistry(tokens.Policy{
+			TTL:       cfg.Tokens.TTL.Duration(),
+			IdleTTL:   cfg.Tokens.IdleTTL.Duration(),
+			Namespace: namespace,
+		}, st)
+	case tokens.FormatHmac:
+		keys := make([]tokens.Key, 0, len(cfg.Tokens.Keys))
+		for _, key := range cfg.Tokens.Keys {
+			keys = append(keys, tokens.Key{Id: key.Id, Secret: []byte(key.Secret)})
+		}
+		signer, err := tokens.NewSigner(keys, cfg.Tokens.SigningKey, verification, namespace, cfg.Tokens.TTL.Duration(), st)
+		if err != nil {
+			slog.Error("Failed to prepare token signer", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return signer
+	default:
+		slog.Error("Unknown token format", "format", cfg.Tokens.Format)
+		os.Exit(1)
+	}
+	return nil
+}
 
-	// Token manager
-	var tokenManager usecase.TokenManager
-	switch cfg.Verification.Type {
+// prepareTokenManager creates the token manager of the site verification.
+func prepareTokenManager(ctx context.Context, siteCfg *config.SiteConfig, issuer tokens.Issuer, st store.Store) usecase.TokenManager {
+	switch siteCfg.Verification.Type {
 	case "js-challenge":
-		m := sha_challenge.NewShaChallengeTokenManager(
-			cfg.PermanentTokens,
-			cfg.Verification.Complexity,
+		return sha_challenge.NewShaChallengeTokenManager(
+			siteCfg.PermanentTokens,
+			siteCfg.Verification.Complexity,
+			issuer,
+			st,
 		)
-		go m.Serve(ctx)
-		tokenManager = m
 	case "captcha":
-		tokenManager = captcha.NewCaptchaTokenManager(
+		return captcha.NewCaptchaTokenManager(
 			ctx,
-			cfg.PermanentTokens,
-			cfg.Verification.Complexity,
+			siteCfg.PermanentTokens,
+			siteCfg.Verification.Complexity,
+			issuer,
+			st,
 		)
 	default:
-		slog.Error("Unknown verification type", "verification", cfg.Verification.Type)
+		slog.Error("Unknown verification type", "site", siteCfg.Name, "verification", siteCfg.Verification.Type)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func startServer(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	cfg *config.Config,
+	configPath string,
+	st store.Store,
+	version string,
+) (*server.ApiServer, *reload.Reloader) {
+
+	// Token issuers and managers of the sites, the tokens of the default site have no namespace
+	siteConfigs := cfg.AllSites()
+	issuers := make([]tokens.Issuer, len(siteConfigs))
+	tokenManagers := make([]usecase.TokenManager, len(siteConfigs))
+	var permanentTokens []string
+	var escalator usecase.ChallengeEscalator
+	for i := range siteConfigs {
+		namespace := siteConfigs[i].Name
+		if i == 0 {
+			namespace = ""
+		}
+		issuers[i] = prepareIssuer(cfg, siteConfigs[i].Verification.Type, namespace, st)
+		tokenManagers[i] = prepareTokenManager(ctx, &siteConfigs[i], issuers[i], st)
+		permanentTokens = append(permanentTokens, siteConfigs[i].PermanentTokens...)
+		if e, ok := tokenManagers[i].(usecase.ChallengeEscalator); ok && escalator == nil {
+			escalator = e
+		}
+	}
+
+	// Bans
+	bans, err := ban.NewList(st)
+	if err != nil {
+		slog.Error("Failed to load bans", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
+	go bans.Serve(ctx)
+
+	// Repeat offenders, the escalations are shared by the JS challenges of all sites
+	var tracker *strikes.Tracker
+	if cfg.Strikes.Enabled() {
+		tracker = strikes.NewTracker(strikes.Thresholds{
+			TTL:         cfg.Strikes.TTL.Duration(),
+			Escalate:    cfg.Strikes.Escalate,
+			Captcha:     cfg.Strikes.Captcha,
+			Ban:         cfg.Strikes.Ban,
+			BanDuration: cfg.Strikes.BanDuration.Duration(),
+		}, st, bans, escalator)
+		for i := range siteConfigs {
+			if cfg.Strikes.Captcha > 0 && siteConfigs[i].Verification.Type == "js-challenge" {
+				captchaManager := captcha.NewCaptchaTokenManager(
+					ctx,
+					siteConfigs[i].PermanentTokens,
+					cmp.Or(siteConfigs[i].Verification.Complexity, "medium"),
+					issuers[i],
+					st,
+				)
+				tokenManagers[i] = strikes.NewTokenManager(tokenManagers[i], captchaManager, tracker)
+			}
+		}
+	}
+
+	// Sites
+	defaultSite := &site.Site{Name: config.DefaultSite, CookieDomain: cfg.CookieDomain, TokenManager: tokenManagers[0]}
+	sites := site.NewSites(defaultSite)
 
-	// Rate limiter
-	rateLimiter := limiter.NewRpsLimiter(ctx, tokenManager)
-	var protections []usecase.Protection
-	for i := range cfg.Protections {
-		protection := usecase.Protection(cfg.Protections[i])
-		protections = append(protections, protection)
-		rateLimiter.AddLimit(protection)
+	// Under attack mode
+	attackPaths := make([]*regexp.Regexp, 0, len(cfg.UnderAttack.Paths))
+	for _, path := range cfg.UnderAttack.Paths {
+		attackPaths = append(attackPaths, regexp.MustCompile(path))
 	}
-	go rateLimiter.Serve()
+	guard := attack.NewGuard(attack.Settings{
+		Threshold:   cfg.UnderAttack.Threshold,
+		Release:     cfg.UnderAttack.Release,
+		Cooldown:    cfg.UnderAttack.Cooldown.Duration(),
+		Paths:       attackPaths,
+		TokenMaxAge: cfg.UnderAttack.TokenMaxAge.Duration(),
+		LimitFactor: cfg.UnderAttack.LimitFactor,
+	}, sites, issuers[0], permanentTokens)
+	go guard.Serve(ctx)
 
 	// Fingerprint calculator
 	fingerprintCalculator := fingerprint.NewRequestFingerprintCalculator()
 
+	// Rate limiters and protections of the sites
+	targets := map[string]reload.Target{}
+	for i := range siteConfigs {
+		siteCfg := &siteConfigs[i]
+		rateLimiter := limiter.NewRpsLimiter(ctx, siteCfg.Name, tokenManagers[i], bans, tracker)
+		for _, budget := range siteCfg.BudgetRules() {
+			rateLimiter.AddBudget(budget)
+		}
+		protections := siteCfg.ProtectionRules()
+		for _, protection := range protections {
+			rateLimiter.AddLimit(protection)
+		}
+		go rateLimiter.Serve()
+		pathProtector := middleware.NewPathProtector(siteCfg.Name, fingerprintCalculator, rateLimiter, tokenManagers[i], tracker, guard, protections)
+		targets[siteCfg.Name] = reload.Target{Protections: pathProtector, Limits: rateLimiter}
+		if i == 0 {
+			defaultSite.Protector, defaultSite.Limiter = pathProtector, rateLimiter
+			continue
+		}
+		err = sites.Add(&site.Site{
+			Name:         siteCfg.Name,
+			CookieDomain: siteCfg.CookieDomain,
+			TokenManager: tokenManagers[i],
+			Protector:    pathProtector,
+			Limiter:      rateLimiter,
+		}, siteCfg.Hosts)
+		if err != nil {
+			slog.Error("Failed to add site", slog.String("site", siteCfg.Name), slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
 	// Chain
 	chain := middleware.NewChain(
 		middleware.NewHttpFingerprintEnricher(fingerprintCalculator),
-		middleware.NewPathProtector(fingerprintCalculator, rateLimiter, tokenManager, protections),
+		middleware.NewBanChecker(bans),
+		sites,
 	)
-	apiServer := server.NewApiServer(cfg.Address, chain, fingerprintCalculator, tokenManager)
+
+	// Configuration reload
+	reloader := reload.NewReloader(configPath, cfg, &logLevel, targets)
+
+	// Admin API
+	var adminApi *server.AdminApi
+	if cfg.Admin.Secret != "" || cfg.Admin.Socket != "" {
+		adminApi = server.NewAdminApi(
+			cfg.Admin.Address,
+			cfg.Admin.Secret,
+			cfg.Admin.Socket,
+			version,
+			issuers[0],
+			bans,
+			sites,
+			sites,
+			reloader,
+			guard,
+		)
+	}
+	if cfg.Admin.Secret == "" && cfg.Admin.Address != "" {
+		slog.Warn("Admin API is disabled on " + cfg.Admin.Address + ", admin.secret is not set")
+	}
+
+	apiServer := server.NewApiServer(cfg.Address, chain, fingerprintCalculator, sites, adminApi)
 	go func() {
 		slog.Info("Serving API " + cfg.Address)
 		err := apiServer.Serve()
@@ -92,7 +287,30 @@ func startServer(ctx context.Context, cancel context.CancelFunc, cfg *config.Con
 		}
 		cancel()
 	}()
-	return apiServer
+	return apiServer, reloader
+}
+
+// runCommand executes the subcommand against the running instance and returns the exit code.
+func runCommand(args []string, configPath, socketPath string) int {
+	if socketPath == "" {
+		var cfg config.Config
+		if err := cfg.Load(configPath); err == nil {
+			socketPath = cfg.Admin.Socket
+		}
+		if socketPath == "" {
+			socketPath = config.DefaultAdminSocket
+		}
+	}
+	command := cli.NewCommand(cli.NewClient(socketPath), configPath, os.Stdout)
+	if err := command.Run(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, cli.ErrUsage) {
+			fmt.Fprint(os.Stderr, cli.Usage)
+			return 2
+		}
+		return 1
+	}
+	return 0
 }
 
 func main() {
@@ -102,24 +320,74 @@ func main() {
 
 	versionFlag := flag.Bool("version", false, "Print Aegis version")
 	configPath := flag.String("config", "/etc/aegis/config.json", "Configuration path")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration with the secrets redacted and exit")
+	socketPath := flag.String("socket", "", "Admin socket of the running instance, admin.socket of the configuration by default")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [subcommand]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), "\n"+cli.Usage)
+	}
 	flag.Parse()
 	if *versionFlag {
 		fmt.Printf("Aegis %s", versionProvider.String())
 		return
 	}
 
+	if *checkConfig {
+		if err = cli.CheckConfig(*configPath, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *printConfig {
+		if err = cli.PrintConfig(*configPath, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args(), *configPath, *socketPath))
+	}
+
 	var cfg config.Config
 	if err = cfg.Load(*configPath); err != nil {
 		slog.Error("Failed to prepare app config", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 	prepareLogger(cfg.Logger.Level)
+	report := validator.Validate(&cfg)
+	for _, warning := range report.Warnings {
+		slog.Warn("Configuration warning", slog.String("warning", warning))
+	}
+	if !report.Valid() {
+		slog.Error("Invalid configuration", slog.String("error", report.Err().Error()))
+		os.Exit(1)
+	}
 
 	appCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
-	apiServer := startServer(appCtx, cancel, &cfg)
+	st := prepareStore(&cfg)
+	go st.Serve(appCtx)
+	apiServer, reloader := startServer(appCtx, cancel, &cfg, *configPath, st, versionProvider.String())
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			slog.Info("SIGHUP received, reloading configuration")
+			reloader.Reload()
+		}
+	}()
 	<-appCtx.Done()
+	signal.Stop(hangup)
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
 	apiServer.Shutdown(shutdownCtx)
+	if err = st.Close(); err != nil {
+		slog.Error("Failed to close storage", slog.String("error", err.Error()))
+	}
 }
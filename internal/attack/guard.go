@@ -0,0 +1,257 @@
+// Package attack detects volumetric spikes of the protected endpoints and switches the under attack mode.
+package attack
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MetricUnderAttack = "under_attack"
+
+	// AllEndpoints is the endpoint of the requests to the unprotected paths
+	AllEndpoints = "*"
+)
+
+// Switch modes
+const (
+	SwitchOn   = "on"   // Mode is on until it is switched off or back to auto
+	SwitchOff  = "off"  // Mode is off until it is switched on or back to auto, spikes are ignored
+	SwitchAuto = "auto" // Mode follows the traffic
+)
+
+var metricUnderAttack = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: MetricUnderAttack,
+	},
+)
+
+func init() {
+	prometheus.MustRegister(metricUnderAttack)
+}
+
+// Settings of the under attack mode.
+type Settings struct {
+	Threshold   uint32           // Requests per second of all clients to an endpoint switching the mode on, 0 disables the detection
+	Release     uint32           // Requests per second of every endpoint below which the mode is switched off
+	Cooldown    time.Duration    // Time the traffic stays below the release before the mode is switched off
+	Paths       []*regexp.Regexp // Paths requiring the fresh token in the mode, all paths if empty
+	TokenMaxAge time.Duration    // Tokens issued earlier are not accepted in the mode
+	LimitFactor float64          // Multiplier of the per-client limits in the mode
+}
+
+// Tightener applies the limit multiplier of the mode.
+type Tightener interface {
+	// Tighten multiplies the per-client limits, 1 restores them.
+	Tighten(factor float64)
+}
+
+// IssueTimes returns the issue time of the tokens.
+type IssueTimes interface {
+	Issued(token string) (time.Time, bool)
+}
+
+// Status describes the mode for the administration API.
+type Status struct {
+	Active    bool              `json:"active"`
+	Switch    string            `json:"switch"`            // on, off or auto
+	Since     time.Time         `json:"since,omitzero"`    // Time the mode was switched on
+	Trigger   string            `json:"trigger,omitempty"` // Endpoint which switched the mode on or "manual"
+	Endpoints map[string]uint64 `json:"endpoints"`         // Requests of the last second by endpoint
+}
+
+// Guard counts requests of all clients by endpoint and switches the mode with the hysteresis: the mode is
+// switched on when an endpoint exceeds the threshold and switched off when all endpoints stay below
+// the release for the cooldown.
+type Guard struct {
+	settings  Settings
+	tightener Tightener
+	tokens    IssueTimes
+	permanent map[string]struct{}
+	active    atomic.Bool
+	counters  map[string]*atomic.Uint64
+	countMu   sync.RWMutex
+
+	mu      sync.Mutex
+	toggle  string
+	since   time.Time
+	trigger string
+	calm    time.Time
+	last    map[string]uint64
+}
+
+// Active returns true if the mode is on.
+func (g *Guard) Active() bool {
+	return g.active.Load()
+}
+
+// Covers returns true if the path requires the fresh token in the mode.
+func (g *Guard) Covers(path string) bool {
+	if len(g.settings.Paths) == 0 {
+		return true
+	}
+	for _, re := range g.settings.Paths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fresh returns true if the token was issued recently enough for the mode. Permanent tokens are always fresh.
+func (g *Guard) Fresh(token string) bool {
+	if _, found := g.permanent[token]; found {
+		return true
+	}
+	issued, found := g.tokens.Issued(token)
+	return found && time.Since(issued) <= g.settings.TokenMaxAge
+}
+
+// Count counts the request to the endpoint.
+func (g *Guard) Count(endpoint string) {
+	g.countMu.RLock()
+	counter, found := g.counters[endpoint]
+	g.countMu.RUnlock()
+	if !found {
+		g.countMu.Lock()
+		if counter, found = g.counters[endpoint]; !found {
+			counter = &atomic.Uint64{}
+			g.counters[endpoint] = counter
+		}
+		g.countMu.Unlock()
+	}
+	counter.Add(1)
+}
+
+// Switch switches the mode on or off manually or returns it to the automatic detection.
+func (g *Guard) Switch(toggle string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch toggle {
+	case SwitchOn:
+		g.set(true, "manual", time.Now())
+	case SwitchOff:
+		g.set(false, "manual", time.Now())
+	case SwitchAuto:
+		g.calm = time.Now()
+	default:
+		return fmt.Errorf("unknown switch %q, expected %s, %s or %s", toggle, SwitchOn, SwitchOff, SwitchAuto)
+	}
+	g.toggle = toggle
+	return nil
+}
+
+// Status returns the state of the mode.
+func (g *Guard) Status() Status {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return Status{
+		Active:    g.active.Load(),
+		Switch:    g.toggle,
+		Since:     g.since,
+		Trigger:   g.trigger,
+		Endpoints: maps.Clone(g.last),
+	}
+}
+
+// set switches the mode, logs the change and applies the limit multiplier. Must be called under the lock.
+func (g *Guard) set(active bool, trigger string, now time.Time) {
+	if g.active.Load() == active {
+		return
+	}
+	g.active.Store(active)
+	factor := 1.0
+	if active {
+		g.since, g.trigger = now, trigger
+		factor = g.settings.LimitFactor
+		metricUnderAttack.Set(1)
+		slog.Warn("Under attack mode is on", slog.String("trigger", trigger))
+	} else {
+		slog.Warn("Under attack mode is off", slog.String("trigger", trigger), slog.Duration("duration", now.Sub(g.since)))
+		g.since, g.trigger = time.Time{}, ""
+		metricUnderAttack.Set(0)
+	}
+	if g.tightener != nil {
+		g.tightener.Tighten(factor)
+	}
+}
+
+// evaluate resets the counters of the last second and switches the mode automatically.
+func (g *Guard) evaluate(now time.Time) {
+	last := map[string]uint64{}
+	g.countMu.RLock()
+	for endpoint, counter := range g.counters {
+		last[endpoint] = counter.Swap(0)
+	}
+	g.countMu.RUnlock()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last = last
+	if g.toggle != SwitchAuto || g.settings.Threshold == 0 {
+		return
+	}
+	peak, busiest := uint64(0), ""
+	for endpoint, requests := range last {
+		if requests > peak {
+			peak, busiest = requests, endpoint
+		}
+	}
+	switch {
+	case peak >= uint64(g.settings.Threshold):
+		g.calm = time.Time{}
+		g.set(true, busiest, now)
+	case peak >= uint64(g.settings.Release):
+		g.calm = time.Time{}
+	case g.calm.IsZero():
+		g.calm = now
+	case now.Sub(g.calm) >= g.settings.Cooldown:
+		g.set(false, "calm", now)
+	}
+}
+
+// Serve evaluates the traffic every second until the context is canceled.
+func (g *Guard) Serve(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			g.evaluate(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewGuard creates the guard in the automatic mode.
+//
+// Parameters:
+//   - settings: Thresholds, paths and tightening of the mode.
+//   - tightener: Rate limiter tightened in the mode, optional.
+//   - tokens: Issue times of the tokens.
+//   - permanentTokens: Tokens accepted regardless of the issue time.
+func NewGuard(settings Settings, tightener Tightener, tokens IssueTimes, permanentTokens []string) *Guard {
+	g := Guard{
+		settings:  settings,
+		tightener: tightener,
+		tokens:    tokens,
+		permanent: map[string]struct{}{},
+		counters:  map[string]*atomic.Uint64{},
+		toggle:    SwitchAuto,
+		last:      map[string]uint64{},
+	}
+	for _, token := range permanentTokens {
+		g.permanent[token] = struct{}{}
+	}
+	metricUnderAttack.Set(0)
+	return &g
+}
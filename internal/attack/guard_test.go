@@ -0,0 +1,94 @@
+package attack
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tightener remembers the last limit multiplier.
+type tightener struct {
+	factor float64
+}
+
+func (t *tightener) Tighten(factor float64) {
+	t.factor = factor
+}
+
+// issueTimes returns the issue times of the known tokens.
+type issueTimes map[string]time.Time
+
+func (i issueTimes) Issued(token string) (time.Time, bool) {
+	issued, found := i[token]
+	return issued, found
+}
+
+// TestEvaluate verifies switching the mode with the hysteresis.
+func TestEvaluate(t *testing.T) {
+	limits := tightener{factor: 1}
+	g := NewGuard(Settings{Threshold: 10, Release: 5, Cooldown: time.Minute, LimitFactor: 0.5}, &limits, issueTimes{}, nil)
+	count := func(endpoint string, requests int) {
+		for range requests {
+			g.Count(endpoint)
+		}
+	}
+	now := time.Now()
+
+	count("GET ^/api/", 9)
+	g.evaluate(now)
+	assert.False(t, g.Active())
+
+	count("GET ^/api/", 10)
+	count(AllEndpoints, 3)
+	g.evaluate(now.Add(time.Second))
+	assert.True(t, g.Active())
+	assert.Equal(t, 0.5, limits.factor)
+	status := g.Status()
+	assert.Equal(t, "GET ^/api/", status.Trigger)
+	assert.Equal(t, map[string]uint64{"GET ^/api/": 10, AllEndpoints: 3}, status.Endpoints)
+
+	// Traffic between the release and the threshold keeps the mode
+	count("GET ^/api/", 7)
+	g.evaluate(now.Add(2 * time.Second))
+	g.evaluate(now.Add(3 * time.Second))
+	g.evaluate(now.Add(time.Minute))
+	assert.True(t, g.Active())
+	g.evaluate(now.Add(3*time.Second + time.Minute))
+	assert.False(t, g.Active())
+	assert.Equal(t, 1.0, limits.factor)
+}
+
+// TestSwitch verifies the manual switching of the mode.
+func TestSwitch(t *testing.T) {
+	g := NewGuard(Settings{Threshold: 10, Release: 5, Cooldown: time.Minute, LimitFactor: 0.5}, nil, issueTimes{}, nil)
+	now := time.Now()
+	assert.NoError(t, g.Switch(SwitchOn))
+	g.evaluate(now.Add(time.Hour))
+	assert.True(t, g.Active())
+	assert.Equal(t, "manual", g.Status().Trigger)
+
+	assert.NoError(t, g.Switch(SwitchOff))
+	for range 100 {
+		g.Count("GET ^/api/")
+	}
+	g.evaluate(now)
+	assert.False(t, g.Active())
+	assert.Error(t, g.Switch("maybe"))
+}
+
+// TestFresh verifies the paths and the tokens accepted in the mode.
+func TestFresh(t *testing.T) {
+	tokens := issueTimes{"old": time.Now().Add(-time.Hour), "new": time.Now()}
+	g := NewGuard(Settings{
+		Paths:       []*regexp.Regexp{regexp.MustCompile(`^/login$`)},
+		TokenMaxAge: time.Minute,
+	}, nil, tokens, []string{"trusted"})
+	assert.True(t, g.Covers("/login"))
+	assert.False(t, g.Covers("/articles"))
+	assert.True(t, g.Fresh("new"))
+	assert.True(t, g.Fresh("trusted"))
+	assert.False(t, g.Fresh("old"))
+	assert.False(t, g.Fresh("unknown"))
+}
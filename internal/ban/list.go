@@ -0,0 +1,380 @@
+// Package ban keeps clients which are refused before any other check.
+package ban
+
+import (
+	"aegis/internal/store"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"iter"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// BucketBans is the store bucket of the bans
+	BucketBans = "bans"
+	// BucketOffences is the store bucket of the offence counters of the escalated bans
+	BucketOffences = "offences"
+
+	// offenceMemory is the time the offences are remembered after the ban expires
+	offenceMemory = 24 * time.Hour
+
+	// reloadInterval is the period of reading bans added by other instances sharing the store
+	reloadInterval = 10 * time.Second
+
+	// fingerprintIndexDigits is the number of the leading hex digits the fingerprint bans are indexed by,
+	// the shorter prefixes are indexed by the whole prefix
+	fingerprintIndexDigits = 8
+
+	MetricBansActive     = "bans_active"
+	MetricBanAdded       = "ban_added"
+	MetricBannedRequests = "banned_requests"
+)
+
+var (
+	metricBansActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: MetricBansActive,
+		},
+		[]string{"kind"},
+	)
+	metricBanAdded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricBanAdded,
+		},
+		[]string{"kind", "source"},
+	)
+	metricBannedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricBannedRequests,
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricBansActive, metricBanAdded, metricBannedRequests)
+}
+
+// Ban refuses all requests of the network, the fingerprint or the token.
+type Ban struct {
+	Target   string    `json:"target"`             // Banned address, CIDR, fingerprint:<hex> or token:<token>
+	Kind     string    `json:"kind"`               // Kind of the target: network, fingerprint or token
+	Reason   string    `json:"reason"`             // Human readable reason
+	Created  time.Time `json:"created"`            // Time the ban was added
+	Expires  time.Time `json:"expires,omitzero"`   // Time the ban is lifted, zero means permanent
+	Offences int       `json:"offences,omitempty"` // Number of the escalated bans of the target
+}
+
+// active returns true if the ban is not expired.
+func (b *Ban) active(now time.Time) bool {
+	return b.Expires.IsZero() || now.Before(b.Expires)
+}
+
+// List keeps bans in the store and caches them in memory for the request checks.
+type List struct {
+	store        store.Store
+	networks     map[int]map[netip.Addr]Ban // Bans by the prefix length and the masked address
+	fingerprints map[string]map[string]Ban  // Bans by the indexed leading digits and the hex prefix
+	tokens       map[string]Ban
+	mu           sync.RWMutex
+}
+
+// fingerprintIndex returns the indexed leading digits of the fingerprint hex prefix.
+func fingerprintIndex(prefix string) string {
+	return prefix[:min(len(prefix), fingerprintIndexDigits)]
+}
+
+// put adds the ban to the index.
+func put[K1, K2 comparable](index map[K1]map[K2]Ban, key1 K1, key2 K2, b Ban) {
+	bans, found := index[key1]
+	if !found {
+		bans = map[K2]Ban{}
+		index[key1] = bans
+	}
+	bans[key2] = b
+}
+
+// remove deletes the ban from the index, the empty maps are deleted as well.
+func remove[K1, K2 comparable](index map[K1]map[K2]Ban, key1 K1, key2 K2) {
+	if bans, found := index[key1]; found {
+		if delete(bans, key2); len(bans) == 0 {
+			delete(index, key1)
+		}
+	}
+}
+
+// all returns the bans of the index.
+func all[K1, K2 comparable](index map[K1]map[K2]Ban) iter.Seq[Ban] {
+	return func(yield func(Ban) bool) {
+		for _, bans := range index {
+			for _, b := range bans {
+				if !yield(b) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// count returns the number of the bans of the index.
+func count[K1, K2 comparable](index map[K1]map[K2]Ban) int {
+	n := 0
+	for _, bans := range index {
+		n += len(bans)
+	}
+	return n
+}
+
+// Add bans the target for the ttl. Zero ttl bans forever. An existing ban of the same target is replaced.
+func (l *List) Add(target string, ttl time.Duration, reason string) (Ban, error) {
+	t, err := ParseTarget(target)
+	if err != nil {
+		return Ban{}, err
+	}
+	b, err := l.add(t, ttl, reason, 0)
+	if err == nil {
+		metricBanAdded.WithLabelValues(t.Kind, "manual").Inc()
+	}
+	return b, err
+}
+
+// Escalate bans the target of a repeat offender. The first ban lasts for the base duration, every next one
+// is twice as long up to the longest duration. Offences are forgotten a day after the ban expires.
+func (l *List) Escalate(target string, base, longest time.Duration, reason string) (Ban, error) {
+	t, err := ParseTarget(target)
+	if err != nil {
+		return Ban{}, err
+	}
+	if base <= 0 || longest < base {
+		return Ban{}, errors.New("ban duration must be positive and not longer than the longest one")
+	}
+	offences := 1
+	if value, found, err := l.store.Get(BucketOffences, t.String()); err == nil && found {
+		if previous, err := strconv.Atoi(string(value)); err == nil {
+			offences += previous
+		}
+	}
+	ttl := base
+	for i := 1; i < offences && ttl < longest; i++ {
+		ttl *= 2
+	}
+	ttl = min(ttl, longest)
+	b, err := l.add(t, ttl, reason, offences)
+	if err != nil {
+		return Ban{}, err
+	}
+	metricBanAdded.WithLabelValues(t.Kind, "escalation").Inc()
+	if err = l.store.Set(BucketOffences, t.String(), []byte(strconv.Itoa(offences)), ttl+offenceMemory); err != nil {
+		slog.Error("Failed to store offences", slog.String("target", b.Target), slog.String("error", err.Error()))
+	}
+	return b, nil
+}
+
+// add stores the ban of the target.
+func (l *List) add(t Target, ttl time.Duration, reason string, offences int) (Ban, error) {
+	if ttl < 0 {
+		return Ban{}, errors.New("ban ttl must not be negative")
+	}
+	now := time.Now()
+	b := Ban{Target: t.String(), Kind: t.Kind, Reason: reason, Created: now, Offences: offences}
+	if ttl > 0 {
+		b.Expires = now.Add(ttl)
+	}
+	value, err := json.Marshal(b)
+	if err != nil {
+		return Ban{}, err
+	}
+	if err = l.store.Set(BucketBans, b.Target, value, ttl); err != nil {
+		return Ban{}, err
+	}
+	l.mu.Lock()
+	l.set(t, b)
+	l.updateMetrics()
+	l.mu.Unlock()
+	return b, nil
+}
+
+// set caches the ban of the target. Must be called under the exclusive lock.
+func (l *List) set(t Target, b Ban) {
+	switch t.Kind {
+	case KindNetwork:
+		put(l.networks, t.Prefix.Bits(), t.Prefix.Addr(), b)
+	case KindFingerprint:
+		put(l.fingerprints, fingerprintIndex(t.Value), t.Value, b)
+	case KindToken:
+		l.tokens[t.Value] = b
+	}
+}
+
+// updateMetrics sets the numbers of the cached bans. Must be called under the lock.
+func (l *List) updateMetrics() {
+	metricBansActive.WithLabelValues(KindNetwork).Set(float64(count(l.networks)))
+	metricBansActive.WithLabelValues(KindFingerprint).Set(float64(count(l.fingerprints)))
+	metricBansActive.WithLabelValues(KindToken).Set(float64(len(l.tokens)))
+}
+
+// Remove lifts the ban of the target. Returns true if the ban existed.
+func (l *List) Remove(target string) (bool, error) {
+	t, err := ParseTarget(target)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	switch t.Kind {
+	case KindNetwork:
+		remove(l.networks, t.Prefix.Bits(), t.Prefix.Addr())
+	case KindFingerprint:
+		remove(l.fingerprints, fingerprintIndex(t.Value), t.Value)
+	case KindToken:
+		delete(l.tokens, t.Value)
+	}
+	l.updateMetrics()
+	l.mu.Unlock()
+	return l.store.Delete(BucketBans, t.String())
+}
+
+// Bans returns active bans sorted by target.
+func (l *List) Bans() []Ban {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	bans := make([]Ban, 0, count(l.networks)+count(l.fingerprints)+len(l.tokens))
+	for _, cache := range []iter.Seq[Ban]{all(l.networks), all(l.fingerprints), maps.Values(l.tokens)} {
+		for b := range cache {
+			if b.active(now) {
+				bans = append(bans, b)
+			}
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.Target, b.Target)
+	})
+	return bans
+}
+
+// Banned returns the ban covering the client address. Malformed addresses are never banned.
+func (l *List) Banned(address string) (Ban, bool) {
+	return l.Match(address, nil, "")
+}
+
+// Match returns the ban covering the client address, fingerprint or token and counts the refused request.
+// Empty fingerprint and token are never banned. The address is looked up once per banned prefix length,
+// the fingerprint once per indexed digit.
+func (l *List) Match(address string, fingerprint []byte, token string) (Ban, bool) {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if addr, err := netip.ParseAddr(address); err == nil {
+		addr = addr.Unmap()
+		for bits, bans := range l.networks {
+			if prefix, err := addr.Prefix(bits); err == nil {
+				if b, found := bans[prefix.Addr()]; found && b.active(now) {
+					return hit(b)
+				}
+			}
+		}
+	}
+	if len(fingerprint) > 0 && len(l.fingerprints) > 0 {
+		var digits [fingerprintIndexDigits]byte
+		n := hex.Encode(digits[:], fingerprint[:min(len(fingerprint), fingerprintIndexDigits/2)])
+		var value string
+		for i := 1; i <= n; i++ {
+			for prefix, b := range l.fingerprints[string(digits[:i])] {
+				// Only the longer prefixes of the fully indexed digits need the whole fingerprint
+				if len(prefix) > fingerprintIndexDigits {
+					if value == "" {
+						value = hex.EncodeToString(fingerprint)
+					}
+					if !strings.HasPrefix(value, prefix) {
+						continue
+					}
+				}
+				if b.active(now) {
+					return hit(b)
+				}
+			}
+		}
+	}
+	if token != "" {
+		if b, found := l.tokens[token]; found && b.active(now) {
+			return hit(b)
+		}
+	}
+	return Ban{}, false
+}
+
+// hit counts the request refused by the ban.
+func hit(b Ban) (Ban, bool) {
+	metricBannedRequests.WithLabelValues(b.Kind).Inc()
+	return b, true
+}
+
+// load replaces the cache with the bans from the store.
+func (l *List) load() error {
+	loaded := List{
+		networks:     map[int]map[netip.Addr]Ban{},
+		fingerprints: map[string]map[string]Ban{},
+		tokens:       map[string]Ban{},
+	}
+	err := l.store.Range(BucketBans, func(key string, value []byte) bool {
+		var b Ban
+		if json.Unmarshal(value, &b) != nil {
+			return true
+		}
+		if t, err := ParseTarget(b.Target); err == nil {
+			b.Kind = t.Kind
+			loaded.set(t, b)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.networks, l.fingerprints, l.tokens = loaded.networks, loaded.fingerprints, loaded.tokens
+	l.updateMetrics()
+	l.mu.Unlock()
+	return nil
+}
+
+// Serve periodically reloads bans, so bans added by other instances sharing the store are applied.
+// It blocks until the context is canceled.
+func (l *List) Serve(ctx context.Context) {
+	t := time.NewTicker(reloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := l.load(); err != nil {
+				slog.Error("Failed to reload bans", slog.String("error", err.Error()))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewList creates a ban list on top of the store and loads the existing bans.
+func NewList(s store.Store) (*List, error) {
+	l := List{
+		store:        s,
+		networks:     map[int]map[netip.Addr]Ban{},
+		fingerprints: map[string]map[string]Ban{},
+		tokens:       map[string]Ban{},
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
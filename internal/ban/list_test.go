@@ -0,0 +1,216 @@
+package ban_test
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/store"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestListBanned verifies matching of addresses and networks, expiration and removal.
+func TestListBanned(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	list, err := ban.NewList(s)
+	assert.NoError(t, err)
+
+	_, err = list.Add("192.0.2.0/24", 0, "scanner")
+	assert.NoError(t, err)
+	_, err = list.Add("2001:db8::1", time.Hour, "manual")
+	assert.NoError(t, err)
+	_, err = list.Add("198.51.100.7", time.Nanosecond, "expired")
+	assert.NoError(t, err)
+	_, err = list.Add("not an address", time.Hour, "")
+	assert.Error(t, err)
+
+	b, banned := list.Banned("192.0.2.10")
+	assert.True(t, banned)
+	assert.Equal(t, "scanner", b.Reason)
+	_, banned = list.Banned("::ffff:192.0.2.11")
+	assert.True(t, banned)
+	_, banned = list.Banned("2001:db8::1")
+	assert.True(t, banned)
+	_, banned = list.Banned("2001:db8::2")
+	assert.False(t, banned)
+	time.Sleep(time.Millisecond)
+	_, banned = list.Banned("198.51.100.7")
+	assert.False(t, banned)
+
+	// Bans are loaded by another instance sharing the store
+	other, err := ban.NewList(s)
+	assert.NoError(t, err)
+	assert.Len(t, other.Bans(), 2)
+
+	removed, err := list.Remove("192.0.2.0/24")
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	_, banned = list.Banned("192.0.2.10")
+	assert.False(t, banned)
+}
+
+// TestListEscalate verifies the exponential backoff of the repeated bans.
+func TestListEscalate(t *testing.T) {
+	list, err := ban.NewList(store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		b, err := list.Escalate("192.0.2.1", time.Minute, 5*time.Minute, "rate limit")
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, b.Offences)
+		assert.Equal(t, expected, b.Expires.Sub(b.Created))
+	}
+	_, err = list.Escalate("192.0.2.1", time.Hour, time.Minute, "rate limit")
+	assert.Error(t, err)
+}
+
+// TestParseTarget verifies parsing of the network, fingerprint and token targets.
+func TestParseTarget(t *testing.T) {
+	target, err := ban.ParseTarget("::ffff:192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, ban.KindNetwork, target.Kind)
+	assert.Equal(t, "192.0.2.1/32", target.String())
+	target, err = ban.ParseTarget("fingerprint:0A1B")
+	assert.NoError(t, err)
+	assert.Equal(t, "fingerprint:0a1b", target.String())
+	target, err = ban.ParseTarget("token:abc:def")
+	assert.NoError(t, err)
+	assert.Equal(t, ban.Target{Kind: ban.KindToken, Value: "abc:def"}, target)
+	for _, malformed := range []string{"fingerprint:xyz", "fingerprint:", "token:", "cookie:abc"} {
+		_, err = ban.ParseTarget(malformed)
+		assert.Error(t, err, malformed)
+	}
+}
+
+// TestListMatch verifies the bans of the fingerprints and tokens.
+func TestListMatch(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	list, err := ban.NewList(s)
+	assert.NoError(t, err)
+	_, err = list.Add("fingerprint:0a1b2c3d", time.Hour, "headless")
+	assert.NoError(t, err)
+	_, err = list.Add("token:stolen", 0, "leaked")
+	assert.NoError(t, err)
+
+	b, banned := list.Match("192.0.2.1", []byte{0x0a, 0x1b, 0x2c, 0x3d, 0x01}, "")
+	assert.True(t, banned)
+	assert.Equal(t, ban.KindFingerprint, b.Kind)
+	_, banned = list.Match("192.0.2.1", []byte{0x0a, 0x1b, 0x2c, 0x3e}, "valid")
+	assert.False(t, banned)
+	b, banned = list.Match("192.0.2.1", nil, "stolen")
+	assert.True(t, banned)
+	assert.Equal(t, "leaked", b.Reason)
+
+	other, err := ban.NewList(s)
+	assert.NoError(t, err)
+	bans := other.Bans()
+	assert.Len(t, bans, 2)
+	assert.Equal(t, "fingerprint:0a1b2c3d", bans[0].Target)
+	assert.Equal(t, ban.KindToken, bans[1].Kind)
+
+	removed, err := list.Remove("token:stolen")
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	_, banned = list.Match("", nil, "stolen")
+	assert.False(t, banned)
+}
+
+// TestListMatchIndex verifies matching of the networks of different lengths and the fingerprint prefixes
+// shorter and longer than the indexed digits.
+func TestListMatchIndex(t *testing.T) {
+	list, err := ban.NewList(store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+	for _, target := range []string{"10.0.0.0/8", "192.0.2.0/24", "2001:db8::/32", "fingerprint:0a1", "fingerprint:ffeeddccbb"} {
+		_, err = list.Add(target, time.Hour, target)
+		assert.NoError(t, err)
+	}
+
+	for address, expected := range map[string]string{
+		"10.1.2.3":         "10.0.0.0/8",
+		"::ffff:10.0.0.1":  "10.0.0.0/8",
+		"192.0.2.255":      "192.0.2.0/24",
+		"2001:db8:1::1":    "2001:db8::/32",
+		"192.0.3.1":        "",
+		"2001:db9::1":      "",
+		"::a00:1":          "",
+		"not an address":   "",
+		"11.0.0.1":         "",
+		"2001:0db8:ffff::": "2001:db8::/32",
+	} {
+		b, banned := list.Match(address, nil, "")
+		assert.Equal(t, expected != "", banned, address)
+		assert.Equal(t, expected, b.Reason, address)
+	}
+	for fingerprint, expected := range map[string]string{
+		"0a1fffff":     "fingerprint:0a1",
+		"0a":           "",
+		"0a20":         "",
+		"ffeeddccbb00": "fingerprint:ffeeddccbb",
+		"ffeeddccbb":   "fingerprint:ffeeddccbb",
+		"ffeeddccba00": "",
+		"ffeeddcc":     "",
+	} {
+		value, _ := hex.DecodeString(fingerprint)
+		b, banned := list.Match("", value, "")
+		assert.Equal(t, expected != "", banned, fingerprint)
+		assert.Equal(t, expected, b.Reason, fingerprint)
+	}
+
+	removed, err := list.Remove("fingerprint:FFEEDDCCBB")
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	_, banned := list.Match("", []byte{0xff, 0xee, 0xdd, 0xcc, 0xbb}, "")
+	assert.False(t, banned)
+	assert.Len(t, list.Bans(), 4)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		list.Match("192.0.3.1", []byte{0x0b, 0x1b, 0x2c, 0x3d, 0x4e}, "")
+	})
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkListMatch(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		list, err := ban.NewList(store.NewMemoryStore(nil))
+		assert.NoError(b, err)
+		var networks []netip.Prefix
+		var fingerprints []string
+		for i := range n {
+			network := netip.MustParsePrefix(fmt.Sprintf("10.%d.%d.0/%d", i/256, i%256, 24-i%3*4)).Masked()
+			fingerprint := fmt.Sprintf("%08x%02x", i*7919, i%256)[:8+i%3]
+			for _, target := range []string{network.String(), "fingerprint:" + fingerprint} {
+				_, err = list.Add(target, 0, "")
+				assert.NoError(b, err)
+			}
+			networks = append(networks, network)
+			fingerprints = append(fingerprints, fingerprint)
+		}
+		address, fingerprint := "192.0.2.1", []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x02}
+		b.Run(fmt.Sprintf("bans=%d/indexed", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				list.Match(address, fingerprint, "")
+			}
+		})
+		b.Run(fmt.Sprintf("bans=%d/linear", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				addr := netip.MustParseAddr(address)
+				for _, network := range networks {
+					if network.Contains(addr) {
+						break
+					}
+				}
+				value := hex.EncodeToString(fingerprint)
+				for _, prefix := range fingerprints {
+					if strings.HasPrefix(value, prefix) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package ban
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Kinds of the ban targets
+const (
+	KindNetwork     = "network"     // Address or CIDR
+	KindFingerprint = "fingerprint" // Hex prefix of the client fingerprint
+	KindToken       = "token"       // Token of the client
+)
+
+// Target is the banned network, fingerprint or token.
+type Target struct {
+	Kind   string
+	Prefix netip.Prefix // Network of the network ban
+	Value  string       // Lowercase hex prefix of the fingerprint or the token
+}
+
+// String returns the address or CIDR of the network, "fingerprint:<hex>" or "token:<token>" otherwise.
+func (t Target) String() string {
+	if t.Kind == KindNetwork {
+		return t.Prefix.String()
+	}
+	return t.Kind + ":" + t.Value
+}
+
+// ParseTarget parses an address, a CIDR, "fingerprint:<hex prefix>" or "token:<token>". A single address becomes
+// the prefix of the full length. A fingerprint prefix of 8 hex digits covers all clients with the same IP part
+// of the fingerprint.
+func ParseTarget(target string) (Target, error) {
+	if kind, value, found := strings.Cut(target, ":"); found && (kind == KindFingerprint || kind == KindToken) {
+		if value == "" {
+			return Target{}, fmt.Errorf("empty %s ban target", kind)
+		}
+		if kind == KindFingerprint {
+			value = strings.ToLower(value)
+			if strings.Trim(value, "0123456789abcdef") != "" {
+				return Target{}, errors.New("fingerprint ban target must be a hex prefix")
+			}
+		}
+		return Target{Kind: kind, Value: value}, nil
+	}
+	if strings.Contains(target, "/") {
+		prefix, err := netip.ParsePrefix(target)
+		if err != nil {
+			return Target{}, err
+		}
+		return Target{Kind: KindNetwork, Prefix: netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()}, nil
+	}
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return Target{}, err
+	}
+	addr = addr.Unmap()
+	return Target{Kind: KindNetwork, Prefix: netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
@@ -14,6 +14,9 @@ import (
 	"time"
 )
 
+// ConfigurationPath is the file of the captcha templates
+const ConfigurationPath = "/etc/aegis/captcha.json"
+
 type ChallengeTemplate struct {
 	Description string   `json:"description,omitempty"`
 	Images      []string `json:"images"`
@@ -25,7 +28,6 @@ type Challenge struct {
 	Complexity   int    `json:"complexity,omitempty"`
 	Solution     []int
 	Base64Images [][]byte
-	ts           time.Time
 }
 
 type Solution struct {
@@ -40,47 +42,36 @@ type Configuration struct {
 type CaptchaManager struct {
 	ctx          context.Context
 	templates    []ChallengeTemplate
-	tasks        map[uint32]*Challenge
 	complexity   int
 	base64Images map[string]string
-	mu           sync.Mutex
-}
-
-func (c *CaptchaManager) cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	for id, task := range c.tasks {
-		if time.Since(task.ts) > time.Minute {
-			delete(c.tasks, id)
-		}
-	}
+	mu           sync.RWMutex
 }
 
 func (c *CaptchaManager) Serve() (err error) {
-	// Cleanup and update procedures
-	cleanuupTicker := time.NewTicker(time.Second)
+	// Update procedure
 	loadTicker := time.NewTicker(time.Minute)
 	for {
 		select {
 		case <-c.ctx.Done():
-			cleanuupTicker.Stop()
+			loadTicker.Stop()
 			return
-		case <-cleanuupTicker.C:
-			c.cleanup()
 		case <-loadTicker.C:
 			c.load()
 		}
 	}
 }
 
+// GetChallenge generates a new challenge. Issued challenges are not tracked, the caller
+// keeps the solution until it is verified.
 func (c *CaptchaManager) GetChallenge() *Challenge {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	challengeIdx := rand.Intn(len(c.templates))
 	challengeTemplate := c.templates[challengeIdx]
 	challenge := Challenge{
 		Description:  challengeTemplate.Description,
 		Base64Images: make([][]byte, c.complexity),
 		Complexity:   c.complexity,
-		ts:           time.Now(),
 	}
 	shuffledIndex := rand.Perm(c.complexity)
 	challenge.Solution = slices.Clone(shuffledIndex[:c.complexity/2])
@@ -102,33 +93,13 @@ func (c *CaptchaManager) GetChallenge() *Challenge {
 		}
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	for {
-		challenge.Id = rand.Uint32()
-		if _, exists := c.tasks[challenge.Id]; !exists {
-			c.tasks[challenge.Id] = &challenge
-			break
-		}
-	}
+	challenge.Id = rand.Uint32()
 	return &challenge
 }
 
-func (c *CaptchaManager) Verify(solution *Solution) bool {
-	task, exists := c.tasks[solution.Id]
-	if !exists {
-		return false
-	}
-	isValid := slices.Equal(task.Solution, solution.Solution)
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.tasks, solution.Id)
-	return isValid
-}
-
 func (c *CaptchaManager) load() (err error) {
 	// Load configuration from file
-	content, err := os.ReadFile("/etc/aegis/captcha.json")
+	content, err := os.ReadFile(ConfigurationPath)
 	if err != nil {
 		return
 	}
@@ -167,11 +138,28 @@ func (c *CaptchaManager) load() (err error) {
 	return
 }
 
+// Assets returns the files required by the captcha of the complexity: the page template,
+// the templates configuration and the images listed there.
+func Assets(complexity string) ([]string, error) {
+	assets := []string{fmt.Sprintf(indexPath, complexity), ConfigurationPath}
+	content, err := os.ReadFile(ConfigurationPath)
+	if err != nil {
+		return assets, err
+	}
+	var configuration Configuration
+	if err = json.Unmarshal(content, &configuration); err != nil {
+		return assets, fmt.Errorf("%s: %w", ConfigurationPath, err)
+	}
+	for _, template := range configuration.Templates {
+		assets = append(assets, template.Images...)
+	}
+	return assets, nil
+}
+
 func NewClassificationCaptchaManager(ctx context.Context, complexity int) *CaptchaManager {
 	manager := CaptchaManager{
 		ctx:          ctx,
 		complexity:   complexity,
-		tasks:        make(map[uint32]*Challenge),
 		base64Images: make(map[string]string),
 	}
 	manager.load()
@@ -1,23 +1,26 @@
 package captcha
 
 import (
+	"aegis/internal/store"
+	"aegis/internal/tokens"
 	"aegis/internal/usecase"
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 )
 
 const (
 	tokenCookie = "AEGIS_TOKEN"
-	indexPath   = "/usr/share/aegis/captcha/static/index.html"
+	indexPath   = "/usr/share/aegis/captcha/static/index_%s.html"
+
+	// BucketChallenges is the store bucket of the issued challenges
+	BucketChallenges = "captcha_challenges"
+	challengeTTL     = time.Minute
 )
 
 // TokenGenerationError represents errors during token generation operations
@@ -29,33 +32,18 @@ func (e TokenGenerationError) Error() string {
 	return e.message
 }
 
-// token represents a generated antibot token with metadata
-type token struct {
-	bytes     []byte
-	time      time.Time
-	challenge *challenge
-}
-
-// String returns the base64-encoded string representation of the token
-func (t token) String() string {
-	return string(t.bytes)
-}
-
-// challenge represents a CAPTCHA challenge associated with a client fingerprint
+// challenge is the stored issued challenge. The store key is the client fingerprint.
 type challenge struct {
-	clientFp  *usecase.Fingerprint
-	time      time.Time
-	challenge []byte
+	Id       uint32 `json:"id"`
+	Solution []int  `json:"solution"`
 }
 
 // CaptchaTokenManager manages CAPTCHA challenges and antibot tokens
 type CaptchaTokenManager struct {
 	complexity      int
-	tokens          map[string]*token
+	tokens          tokens.Issuer
 	permanentTokens map[string]struct{}
-	challenges      map[string]*Challenge
-	cmu             sync.RWMutex
-	tmu             sync.RWMutex
+	challenges      store.Store
 	parts           [][]byte
 
 	CaptchaManager *CaptchaManager
@@ -79,9 +67,13 @@ func (m *CaptchaTokenManager) ExtractToken(request *usecase.Request) (token stri
 //   - error:  Non-nil if image reading fails
 func (m *CaptchaTokenManager) GetChallenge(fp *usecase.Fingerprint) (payload []byte, err error) {
 	task := m.CaptchaManager.GetChallenge()
-	m.cmu.Lock()
-	m.challenges[fp.String] = task
-	m.cmu.Unlock()
+	record, err := json.Marshal(challenge{Id: task.Id, Solution: task.Solution})
+	if err != nil {
+		return
+	}
+	if err = m.challenges.Set(BucketChallenges, fp.String, record, challengeTTL); err != nil {
+		return
+	}
 
 	id := []byte(fmt.Sprintf("%d", task.Id))
 	size := 0
@@ -122,24 +114,29 @@ func (m *CaptchaTokenManager) GetToken(fp *usecase.Fingerprint, body []byte) (t
 		return
 	}
 
-	if task, exists := m.challenges[fp.String]; !exists || task.Id != solution.Id {
+	record, exists, err := m.challenges.Get(BucketChallenges, fp.String)
+	if err != nil {
+		return
+	}
+	var task challenge
+	if !exists || json.Unmarshal(record, &task) != nil || task.Id != solution.Id {
 		err = TokenGenerationError{message: "wrong client"}
 		return
 	}
 
-	if !m.CaptchaManager.Verify(&solution) {
+	// Every challenge has the only attempt
+	if deleted, _ := m.challenges.Delete(BucketChallenges, fp.String); !deleted {
+		err = TokenGenerationError{message: "wrong client"}
+		return
+	}
+	if !slices.Equal(task.Solution, solution.Solution) {
 		err = TokenGenerationError{message: "wrong solution"}
 		return
 	}
-	m.cmu.Lock()
-	defer m.cmu.Unlock()
-	r := make([]byte, 32)
-	rand.Read(r)
-	t = base64.StdEncoding.EncodeToString(r)
-	m.tmu.Lock()
-	defer m.tmu.Unlock()
-	m.tokens[t] = &token{bytes: []byte(t), time: time.Now(), challenge: &challenge{clientFp: fp, time: time.Now(), challenge: []byte{}}}
-	delete(m.challenges, fp.String)
+	t, err = m.tokens.Issue(fp)
+	if err != nil {
+		return
+	}
 	slog.Info("Token is issued", "fingerprint", fp.String, "token", t, "id", solution.Id)
 	return
 }
@@ -150,21 +147,13 @@ func (m *CaptchaTokenManager) GetToken(fp *usecase.Fingerprint, body []byte) (t
 //   - token:    Token string to verify
 //
 // Returns:
-//   - bool: True if token is permanent or valid and matches the fingerprint
-func (m *CaptchaTokenManager) Validate(clientFp *usecase.Fingerprint, token string) bool {
+//   - error: Nil if token is permanent or valid and matches the fingerprint,
+//     usecase.TokenValidationError with the rejection reason otherwise
+func (m *CaptchaTokenManager) Validate(clientFp *usecase.Fingerprint, token string) error {
 	if _, exists := m.permanentTokens[token]; exists {
-		return true
-	}
-	m.tmu.RLock()
-	defer m.tmu.RUnlock()
-	storedToken, exists := m.tokens[token]
-	if !exists {
-		return false
-	}
-	if !bytes.Equal(storedToken.challenge.clientFp.Value, clientFp.Value) {
-		return false
+		return nil
 	}
-	return true
+	return m.tokens.Validate(clientFp, token)
 }
 
 // Revoke removes a token from storage if it exists
@@ -174,11 +163,7 @@ func (m *CaptchaTokenManager) Validate(clientFp *usecase.Fingerprint, token stri
 // Returns:
 //   - bool: True if token existed and was successfully removed
 func (m *CaptchaTokenManager) Revoke(token string) bool {
-	m.tmu.Lock()
-	defer m.tmu.Unlock()
-	_, revoked := m.tokens[token]
-	delete(m.tokens, token)
-	return revoked
+	return m.tokens.Revoke(token)
 }
 
 // GetComplexity returns the configured CAPTCHA difficulty level
@@ -189,12 +174,15 @@ func (m *CaptchaTokenManager) GetComplexity() int {
 
 // NewCaptchaTokenManager creates a new CAPTCHA token manager instance
 // Parameters:
-//   - complexity: Difficulty level for CAPTCHAs (1-3)
-//   - config:     Path to configuration file
+//   - ctx:             Context for lifecycle management
+//   - permanentTokens: Tokens which are always valid
+//   - complexity:      Difficulty level for CAPTCHAs (easy, medium, hard)
+//   - issuer:          Issuer of the antibot tokens
+//   - challenges:      Store of the issued challenges
 //
 // Returns:
 //   - *CaptchaTokenManager: Initialized manager with preloaded template
-func NewCaptchaTokenManager(ctx context.Context, permanentTokens []string, complexity string) *CaptchaTokenManager {
+func NewCaptchaTokenManager(ctx context.Context, permanentTokens []string, complexity string, issuer tokens.Issuer, challenges store.Store) *CaptchaTokenManager {
 	var complexityLevel int
 	switch complexity {
 	case "easy":
@@ -208,17 +196,17 @@ func NewCaptchaTokenManager(ctx context.Context, permanentTokens []string, compl
 	}
 	tm := CaptchaTokenManager{
 		CaptchaManager:  NewClassificationCaptchaManager(ctx, complexityLevel),
-		tokens:          make(map[string]*token),
+		tokens:          issuer,
 		permanentTokens: make(map[string]struct{}),
-		challenges:      make(map[string]*Challenge),
+		challenges:      challenges,
 		complexity:      complexityLevel,
 		parts:           [][]byte{},
 	}
 
-	var index = fmt.Sprintf("/usr/share/aegis/captcha/static/index_%s.html", complexity)
+	var index = fmt.Sprintf(indexPath, complexity)
 	content, err := os.ReadFile(index)
 	if err != nil {
-		slog.Error("Unable to read template: " + indexPath)
+		slog.Error("Unable to read template: " + index)
 		os.Exit(1)
 	}
 
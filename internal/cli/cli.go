@@ -0,0 +1,377 @@
+// Package cli implements subcommands operating a running Aegis instance.
+package cli
+
+import (
+	"aegis/internal/attack"
+	"aegis/internal/ban"
+	"aegis/internal/config"
+	"aegis/internal/reload"
+	"aegis/internal/server"
+	"aegis/internal/usecase"
+	"aegis/internal/validator"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Usage describes the subcommands.
+const Usage = `Subcommands:
+  tokens list [--fingerprint <hex>] [--ip <address>] [--limit <n>]
+  tokens revoke <token>
+  tokens revoke --fingerprint <hex>
+  ban list
+  ban add <ip|cidr|fingerprint:<hex>|token:<token>> [--ttl <duration>] [--reason <text>]
+  ban remove <ip|cidr|fingerprint:<hex>|token:<token>>
+  attack status
+  attack on|off|auto
+  config check
+  config print
+  config schema
+  config reload
+  stats
+`
+
+// ErrUsage is returned when the subcommand is unknown or its arguments are wrong.
+var ErrUsage = errors.New("invalid subcommand")
+
+// Command runs subcommands against the instance behind the client.
+type Command struct {
+	client     *Client
+	configPath string
+	out        io.Writer
+}
+
+// parse parses the flags which may follow the positional arguments and returns the positional arguments.
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUsage, err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// Run executes the subcommand.
+//
+// Parameters:
+//   - args: Subcommand and its arguments, e.g. ["ban", "add", "192.0.2.0/24", "--ttl", "1h"].
+//
+// Returns:
+//   - error: ErrUsage if the subcommand is unknown, the error of the instance otherwise.
+func (c *Command) Run(args []string) error {
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	command := args[0]
+	if len(args) > 1 && command != "stats" {
+		command += " " + args[1]
+		args = args[2:]
+	} else {
+		args = args[1:]
+	}
+	switch command {
+	case "tokens list":
+		return c.listTokens(args)
+	case "tokens revoke":
+		return c.revokeTokens(args)
+	case "ban list":
+		return c.listBans(args)
+	case "ban add":
+		return c.addBan(args)
+	case "ban remove":
+		return c.removeBan(args)
+	case "attack status":
+		return c.attackStatus(args)
+	case "attack on", "attack off", "attack auto":
+		return c.switchAttackMode(command[len("attack "):], args)
+	case "config check":
+		return c.checkConfig(args)
+	case "config print":
+		return c.printConfig(args)
+	case "config schema":
+		return c.printSchema(args)
+	case "config reload":
+		return c.reloadConfig(args)
+	case "stats":
+		return c.stats(args)
+	default:
+		return ErrUsage
+	}
+}
+
+func (c *Command) listTokens(args []string) error {
+	fs := flag.NewFlagSet("tokens list", flag.ContinueOnError)
+	fingerprint := fs.String("fingerprint", "", "Fingerprint prefix, hex")
+	ip := fs.String("ip", "", "Client address")
+	limit := fs.Int("limit", 100, "Maximum number of tokens")
+	if positional, err := parse(fs, args); err != nil || len(positional) != 0 {
+		return ErrUsage
+	}
+	query := url.Values{}
+	if *fingerprint != "" {
+		query.Set("fingerprint", *fingerprint)
+	}
+	if *ip != "" {
+		query.Set("ip", *ip)
+	}
+	query.Set("limit", strconv.Itoa(*limit))
+	var found []usecase.TokenInfo
+	if err := c.client.do(http.MethodGet, "/admin/tokens?"+query.Encode(), nil, &found); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN\tFINGERPRINT\tISSUED\tLAST SEEN")
+	for _, t := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Token, t.Fingerprint, t.Issued.Format(time.RFC3339), t.LastSeen.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (c *Command) revokeTokens(args []string) error {
+	fs := flag.NewFlagSet("tokens revoke", flag.ContinueOnError)
+	fingerprint := fs.String("fingerprint", "", "Fingerprint, hex")
+	positional, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	body := map[string]string{}
+	switch {
+	case len(positional) == 1 && *fingerprint == "":
+		body["token"] = positional[0]
+	case len(positional) == 0 && *fingerprint != "":
+		body["fingerprint"] = *fingerprint
+	default:
+		return ErrUsage
+	}
+	var result struct {
+		Revoked int `json:"revoked"`
+	}
+	if err = c.client.do(http.MethodPost, "/admin/tokens/revoke", body, &result); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Revoked: %d\n", result.Revoked)
+	return nil
+}
+
+func (c *Command) listBans(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	var bans []ban.Ban
+	if err := c.client.do(http.MethodGet, "/admin/bans", nil, &bans); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tKIND\tEXPIRES\tREASON")
+	for _, b := range bans {
+		expires := "never"
+		if !b.Expires.IsZero() {
+			expires = b.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.Target, b.Kind, expires, b.Reason)
+	}
+	return w.Flush()
+}
+
+func (c *Command) addBan(args []string) error {
+	fs := flag.NewFlagSet("ban add", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "Ban duration, permanent if not set")
+	reason := fs.String("reason", "manual", "Reason of the ban")
+	positional, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return ErrUsage
+	}
+	body := map[string]string{"target": positional[0], "reason": *reason}
+	if *ttl > 0 {
+		body["ttl"] = ttl.String()
+	}
+	var b ban.Ban
+	if err = c.client.do(http.MethodPost, "/admin/bans", body, &b); err != nil {
+		return err
+	}
+	if b.Expires.IsZero() {
+		fmt.Fprintf(c.out, "Banned %s permanently\n", b.Target)
+	} else {
+		fmt.Fprintf(c.out, "Banned %s until %s\n", b.Target, b.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (c *Command) removeBan(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	if err := c.client.do(http.MethodDelete, "/admin/bans?target="+url.QueryEscape(args[0]), nil, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Unbanned %s\n", args[0])
+	return nil
+}
+
+// attackStatus prints the under attack mode and the requests of the last second by endpoint.
+func (c *Command) attackStatus(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	var status attack.Status
+	if err := c.client.do(http.MethodGet, "/admin/attack", nil, &status); err != nil {
+		return err
+	}
+	c.printAttackStatus(&status)
+	return nil
+}
+
+// switchAttackMode switches the under attack mode on, off or back to the automatic detection.
+func (c *Command) switchAttackMode(toggle string, args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	var status attack.Status
+	if err := c.client.do(http.MethodPost, "/admin/attack", map[string]string{"switch": toggle}, &status); err != nil {
+		return err
+	}
+	c.printAttackStatus(&status)
+	return nil
+}
+
+func (c *Command) printAttackStatus(status *attack.Status) {
+	mode := "off"
+	if status.Active {
+		mode = "on since " + status.Since.Format(time.RFC3339) + " by " + status.Trigger
+	}
+	fmt.Fprintf(c.out, "Under attack: %s\nSwitch: %s\n", mode, status.Switch)
+	endpoints := slices.Sorted(maps.Keys(status.Endpoints))
+	if len(endpoints) == 0 {
+		return
+	}
+	fmt.Fprintln(c.out)
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tRPS")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "%s\t%d\n", endpoint, status.Endpoints[endpoint])
+	}
+	w.Flush()
+}
+
+// checkConfig validates the configuration file without the running instance.
+func (c *Command) checkConfig(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	return CheckConfig(c.configPath, c.out)
+}
+
+// printConfig writes the effective configuration without the running instance.
+func (c *Command) printConfig(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	return PrintConfig(c.configPath, c.out)
+}
+
+// printSchema writes the JSON Schema of the configuration.
+func (c *Command) printSchema(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	schema, err := config.Schema()
+	if err != nil {
+		return err
+	}
+	_, err = c.out.Write(schema)
+	return err
+}
+
+// reloadConfig makes the running instance apply its configuration file.
+func (c *Command) reloadConfig(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	var result reload.Result
+	if err := c.client.do(http.MethodPost, "/admin/reload", nil, &result); err != nil {
+		return err
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintln(c.out, "warning: "+warning)
+	}
+	fmt.Fprintln(c.out, "Configuration is reloaded")
+	return nil
+}
+
+func (c *Command) stats(args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	var stats server.Stats
+	if err := c.client.do(http.MethodGet, "/admin/stats", nil, &stats); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Version: %s\nUptime: %s\n", stats.Version, stats.Uptime)
+	if stats.Tokens != nil {
+		fmt.Fprintf(c.out, "Tokens: %d\n", *stats.Tokens)
+	}
+	fmt.Fprintf(c.out, "Bans: %d\n\n", stats.Bans)
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tMETHOD\tPATH\tRATE\tCLIENTS\tREQUESTS")
+	for _, e := range stats.Endpoints {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", e.Site, e.Method, e.Path, e.Rate, e.Clients, e.Requests)
+	}
+	return w.Flush()
+}
+
+// CheckConfig loads and validates the configuration file and writes the found problems.
+// Returns an error if the configuration cannot be applied.
+func CheckConfig(configPath string, out io.Writer) error {
+	var cfg config.Config
+	if err := cfg.Load(configPath); err != nil {
+		return err
+	}
+	report := validator.Validate(&cfg)
+	report.Print(out)
+	if !report.Valid() {
+		return fmt.Errorf("configuration %s is invalid: %d errors", configPath, len(report.Errors))
+	}
+	fmt.Fprintf(out, "Configuration %s is valid, %d warnings\n", configPath, len(report.Warnings))
+	return nil
+}
+
+// PrintConfig writes the effective configuration merged from the file, the conf.d fragments, the environment
+// variables and the secret files with the defaults applied. The secrets are redacted.
+func PrintConfig(configPath string, out io.Writer) error {
+	var cfg config.Config
+	if err := cfg.Load(configPath); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(cfg.Redacted())
+}
+
+// NewCommand creates the subcommand runner.
+//
+// Parameters:
+//   - client: Admin API client of the running instance.
+//   - configPath: Configuration file checked by "config check" and printed by "config print".
+//   - out: Output of the subcommands.
+func NewCommand(client *Client, configPath string, out io.Writer) *Command {
+	return &Command{client: client, configPath: configPath, out: out}
+}
@@ -0,0 +1,67 @@
+package cli_test
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/cli"
+	"aegis/internal/server"
+	"aegis/internal/store"
+	"aegis/internal/tokens"
+	"aegis/internal/usecase"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type noCounters struct{}
+
+func (noCounters) Counters() []usecase.EndpointCounters { return nil }
+
+type noProtections struct{}
+
+func (noProtections) SiteProtections(string) ([]usecase.Protection, bool) { return nil, true }
+
+// TestCommands verifies the subcommands against the admin API on the Unix socket.
+func TestCommands(t *testing.T) {
+	dir, err := os.MkdirTemp("", "aegis")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "aegis.sock")
+
+	st := store.NewMemoryStore(nil)
+	registry := tokens.NewRegistry(tokens.Policy{TTL: time.Hour}, st)
+	token, _ := registry.Issue(&usecase.Fingerprint{Value: []byte{1, 2, 3}})
+	bans, _ := ban.NewList(st)
+	admin := server.NewAdminApi("", "", socket, "test", registry, bans, noCounters{}, noProtections{}, nil, nil)
+	assert.NoError(t, admin.Serve())
+	defer admin.Shutdown(context.Background())
+
+	var out bytes.Buffer
+	command := cli.NewCommand(cli.NewClient(socket), "", &out)
+
+	assert.NoError(t, command.Run([]string{"tokens", "list", "--fingerprint", "01"}))
+	assert.Contains(t, out.String(), token)
+
+	out.Reset()
+	assert.NoError(t, command.Run([]string{"ban", "add", "192.0.2.0/24", "--ttl", "1h", "--reason", "scanner"}))
+	assert.Contains(t, out.String(), "Banned 192.0.2.0/24 until")
+	_, banned := bans.Banned("192.0.2.1")
+	assert.True(t, banned)
+
+	out.Reset()
+	assert.NoError(t, command.Run([]string{"stats"}))
+	assert.Contains(t, out.String(), "Tokens: 1")
+	assert.Contains(t, out.String(), "Bans: 1")
+
+	out.Reset()
+	assert.NoError(t, command.Run([]string{"tokens", "revoke", token}))
+	assert.Equal(t, "Revoked: 1\n", out.String())
+
+	assert.Error(t, command.Run([]string{"ban", "remove", "198.51.100.0/24"}))
+	assert.ErrorIs(t, command.Run([]string{"tokens", "drop"}), cli.ErrUsage)
+	assert.ErrorIs(t, command.Run([]string{"ban", "add"}), cli.ErrUsage)
+}
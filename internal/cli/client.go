@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Client calls the admin API of the running instance over the Unix socket.
+type Client struct {
+	http *http.Client
+}
+
+// do sends the request with the JSON body and decodes the JSON response into the result.
+// Error responses are returned as errors with the message of the server.
+func (c *Client) do(method, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+	// The host is ignored, the connection is always made to the socket
+	request, err := http.NewRequest(method, "http://aegis"+path, reader)
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("aegis is not reachable: %w", err)
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(content, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("%s: %s", response.Status, failure.Error)
+		}
+		return fmt.Errorf("%s", response.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(content, result)
+}
+
+// NewClient creates a client of the admin API listening the Unix socket.
+func NewClient(socket string) *Client {
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+	return &Client{
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
@@ -1,17 +1,104 @@
 package config
 
 import (
+	"aegis/internal/usecase"
+	"bytes"
 	"encoding/json"
 	"math"
-	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
+)
+
+const (
+	DefaultTokenTTL     = 24 * time.Hour
+	DefaultTokenIdleTTL = 2 * time.Hour
+	DefaultMaxTokens    = 100000
+
+	DefaultStoragePath             = "/var/lib/aegis"
+	DefaultStorageSnapshotInterval = 5 * time.Minute
+	DefaultStoragePrefix           = "aegis:"
+
+	DefaultAdminSocket = "/run/aegis/aegis.sock"
+
+	DefaultStrikesTTL         = 24 * time.Hour
+	DefaultStrikesBanDuration = time.Hour
+
+	DefaultUnderAttackCooldown    = 5 * time.Minute
+	DefaultUnderAttackTokenMaxAge = 10 * time.Minute
+	DefaultUnderAttackLimitFactor = 0.5
+
+	// DefaultSite is the name of the site of the top level protections serving the hosts of no other site
+	DefaultSite = "default"
 )
 
 // ProtectionConfig defines rate-limiting rules for specific HTTP endpoints.
 type ProtectionConfig struct {
-	Path   string `json:"path"`   // URL path to protect (e.g., "/api/v1/login")
-	Method string `json:"method"` // HTTP method to protect (e.g., "POST")
-	Limit  uint32 `json:"rps"`    // Maximum requests per second allowed
+	Path      string `json:"path"`      // URL path to protect (e.g., "/api/v1/login")
+	Method    string `json:"method"`    // HTTP methods to protect (e.g., "POST", "GET,HEAD" or "*")
+	Limit     uint32 `json:"rps"`       // Maximum requests per second allowed, also a rate like "100/min"
+	Key       string `json:"key"`       // Attributes the requests are counted by, e.g. "token", "ip" or "subnet+fingerprint"
+	Algorithm string `json:"algorithm"` // Rate limiting algorithm: "fixed_window", "sliding_window" or "token_bucket"
+	Burst     uint32 `json:"burst"`     // Capacity of the token bucket of the RPS limit, the limit if not set
+
+	Limits []usecase.Limit `json:"limits"` // Additional limits, e.g. "200/min" or {"rate": "5000/day", "action": "deny"}
+	Mode   string          `json:"mode"`   // "enforce" or "monitor" logging and counting the refusals without enforcing them
+	Cost   uint32          `json:"cost"`   // Weight of a request in the limits and the budget, 1 by default
+	Budget string          `json:"budget"` // Name of the shared budget charged by the cost
+
+	Priority int    `json:"priority"` // Protections of the higher priority are evaluated first, the same priority keeps the order
+	Action   string `json:"action"`   // "allow" excludes the matching requests from the protections evaluated after it
+	Final    bool   `json:"final"`    // Protections evaluated after this one do not apply to the matching requests
+
+	Query    map[string]usecase.Pattern `json:"query"`    // Patterns of the query parameters the requests must have, e.g. {"action": "^export$"}
+	Host     *usecase.Pattern           `json:"host"`     // Pattern of the host without the port, e.g. {"glob": "*.example.com"}
+	Headers  map[string]usecase.Pattern `json:"headers"`  // Patterns of the headers, e.g. {"X-Requested-With": {"exact": "XMLHttpRequest"}}
+	Cookies  map[string]usecase.Pattern `json:"cookies"`  // Patterns of the cookies, e.g. {"session": {}} requires the cookie
+	Networks []string                   `json:"networks"` // Client networks or addresses, e.g. "10.0.0.0/8"
+}
+
+// UnmarshalJSON parses the protection rejecting the unknown fields. The rps is a number of requests per second
+// or a rate: a rate per second sets the RPS limit, a rate of another period is the first of the other limits
+// and takes the burst.
+func (p *ProtectionConfig) UnmarshalJSON(data []byte) error {
+	type protection ProtectionConfig
+	object := struct {
+		*protection
+		Limit json.RawMessage `json:"rps"`
+	}{protection: (*protection)(p)}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&object); err != nil {
+		return err
+	}
+	p.Limit = 0
+	if len(object.Limit) == 0 {
+		return nil
+	}
+	if object.Limit[0] != '"' {
+		return json.Unmarshal(object.Limit, &p.Limit)
+	}
+	var rate usecase.Rate
+	if err := rate.UnmarshalJSON(object.Limit); err != nil {
+		return err
+	}
+	if rate.Period == time.Second {
+		p.Limit = rate.Limit
+		return nil
+	}
+	p.Limits = append([]usecase.Limit{{Rate: rate, Burst: p.Burst}}, p.Limits...)
+	p.Burst = 0
+	return nil
+}
+
+// BudgetConfig defines the limits shared by the protections charging the budget.
+type BudgetConfig struct {
+	Name      string          `json:"name"`      // Name the protections refer to
+	Key       string          `json:"key"`       // Attributes the costs are counted by, e.g. "ip"
+	Algorithm string          `json:"algorithm"` // Rate limiting algorithm: "fixed_window", "sliding_window" or "token_bucket"
+	Limits    []usecase.Limit `json:"limits"`    // Limits of the total cost, e.g. "1000/min" or {"rate": "20000/day", "action": "ban"}
+	Mode      string          `json:"mode"`      // "enforce" or "monitor"
 }
 
 // VerificationConfig specifies client verification requirements.
@@ -20,7 +107,90 @@ type VerificationConfig struct {
 	Complexity string `json:"complexity"` // Computational difficulty for verification
 }
 
-// Config contains global application configuration loaded from JSON.
+// KeyConfig is a shared secret used to sign stateless tokens.
+type KeyConfig struct {
+	Id     string `json:"id"`     // Key identifier embedded into the token
+	Secret string `json:"secret"` // Secret, at least 32 bytes
+}
+
+// TokensConfig limits lifetime and amount of the issued tokens.
+type TokensConfig struct {
+	Format     string      `json:"format"`      // Token format: "random" (stored) or "hmac" (stateless signed)
+	TTL        Duration    `json:"ttl"`         // Absolute token lifetime since issuing, negative disables the expiration
+	IdleTTL    Duration    `json:"idle_ttl"`    // Token lifetime since the last successful validation, negative disables it
+	MaxTokens  int         `json:"max_tokens"`  // Maximum number of stored tokens, least recently used are evicted, negative is unlimited
+	Keys       []KeyConfig `json:"keys"`        // Signing keys of the "hmac" format
+	SigningKey string      `json:"signing_key"` // Identifier of the key which signs new tokens
+
+	HmacKeyFile string `json:"hmac_key_file"` // File of the additional signing keys, a key per line as id:secret
+}
+
+// StorageConfig selects where tokens and challenges are kept.
+type StorageConfig struct {
+	Type             string   `json:"type"`              // Storage type: "memory", "file" or "redis"
+	Path             string   `json:"path"`              // Directory of the "file" storage
+	SnapshotInterval Duration `json:"snapshot_interval"` // Period of the "file" storage journal compaction
+	Address          string   `json:"address"`           // Address of the "redis" storage server, host:port
+	Username         string   `json:"username"`          // ACL user of the "redis" storage
+	Password         string   `json:"password"`          // Password of the "redis" storage
+	PasswordFile     string   `json:"password_file"`     // File of the password of the "redis" storage
+	DB               int      `json:"db"`                // Database number of the "redis" storage
+	Prefix           string   `json:"prefix"`            // Key prefix of the "redis" storage
+	PoolSize         int      `json:"pool_size"`         // Idle connections of the "redis" storage
+	Timeout          Duration `json:"timeout"`           // Dial and command timeout of the "redis" storage
+}
+
+// AdminConfig enables the administration API.
+type AdminConfig struct {
+	Address string `json:"address"` // Separate listen address, the main address is used if empty
+	Secret  string `json:"secret"`  // Bearer secret, the TCP API is disabled if empty
+	Socket  string `json:"socket"`  // Unix socket of the CLI, "-" disables the socket
+
+	SecretFile string `json:"secret_file"` // File of the bearer secret
+}
+
+// StrikesConfig punishes the repeat offenders. Strikes are counted per fingerprint and per network
+// on every token revocation and suspicious token rejection. Zero threshold disables the punishment.
+type StrikesConfig struct {
+	TTL         Duration `json:"ttl"`          // Strikes are forgotten after the last one
+	Escalate    int      `json:"escalate"`     // Strikes after which every strike makes the JS challenge harder
+	Captcha     int      `json:"captcha"`      // Strikes after which the captcha is shown instead of the JS challenge
+	Ban         int      `json:"ban"`          // Strikes after which the client is banned
+	BanDuration Duration `json:"ban_duration"` // Duration of the ban
+}
+
+// Enabled returns true if any punishment is configured.
+func (c *StrikesConfig) Enabled() bool {
+	return c.Escalate > 0 || c.Captcha > 0 || c.Ban > 0
+}
+
+// UnderAttackConfig switches the under attack mode on the volumetric spikes of the endpoints.
+type UnderAttackConfig struct {
+	Threshold   uint32   `json:"threshold"`     // Requests per second of all clients to an endpoint switching the mode on, 0 disables the detection
+	Release     uint32   `json:"release"`       // Requests per second of every endpoint below which the mode is switched off
+	Cooldown    Duration `json:"cooldown"`      // Time the traffic stays below the release before the mode is switched off
+	Paths       []string `json:"paths"`         // Path patterns requiring the fresh token in the mode, all paths if empty
+	TokenMaxAge Duration `json:"token_max_age"` // Tokens issued earlier are not accepted in the mode
+	LimitFactor float64  `json:"limit_factor"`  // Multiplier of the per-client limits in the mode
+}
+
+// SiteConfig is the protection profile of the hosts selected by the original Host header. The match mode,
+// the verification and the permanent tokens are inherited from the top level if they are not set.
+type SiteConfig struct {
+	Name            string             `json:"name"`             // Site label of the metrics and the namespace of its tokens
+	Hosts           []string           `json:"hosts"`            // Hosts or globs without the port, e.g. "shop.example.com" or "*.example.org"
+	Protections     []ProtectionConfig `json:"protections"`      // Endpoint protection rules of the site
+	Match           string             `json:"match"`            // "all" applies every matching protection, "first" only the first one
+	Shadow          []ProtectionConfig `json:"shadow"`           // Protection rules of the site evaluated in the monitor mode
+	Budgets         []BudgetConfig     `json:"budgets"`          // Limits shared by the protections of the site
+	Verification    VerificationConfig `json:"verification"`     // Client verification of the site
+	PermanentTokens []string           `json:"permanent_tokens"` // Permanent tokens of the site, an empty list disables the inherited ones
+	CookieDomain    string             `json:"cookie_domain"`    // Domain of the token cookie, the cookie is bound to the requested host if empty
+
+	PermanentTokensFile string `json:"permanent_tokens_file"` // File of the permanent tokens of the site, a token per line
+}
+
+// Config contains global application configuration loaded from JSON or YAML.
 type Config struct {
 	Address string `json:"address"` // Server listen address (e.g., ":8080")
 
@@ -29,34 +199,81 @@ type Config struct {
 	} `json:"logger"`
 
 	Protections  []ProtectionConfig `json:"protections"`  // List of endpoint protection rules
+	Match        string             `json:"match"`        // "all" applies every matching protection, "first" only the first one
+	Shadow       []ProtectionConfig `json:"shadow"`       // Protection rules evaluated in the monitor mode next to the live ones
+	Budgets      []BudgetConfig     `json:"budgets"`      // Limits shared by the protections
 	Verification VerificationConfig `json:"verification"` // Client verification settings
+	Tokens       TokensConfig       `json:"tokens"`       // Token lifetime and storage settings
+	Storage      StorageConfig      `json:"storage"`      // Token and challenge storage
+	Admin        AdminConfig        `json:"admin"`        // Administration API
+	Strikes      StrikesConfig      `json:"strikes"`      // Repeat offender punishment
+	UnderAttack  UnderAttackConfig  `json:"under_attack"` // Under attack mode
+
+	PermanentTokens     []string `json:"permanent_tokens"`      // List of permanent tokens
+	PermanentTokensFile string   `json:"permanent_tokens_file"` // File of the additional permanent tokens, a token per line
+	CookieDomain        string   `json:"cookie_domain"`         // Domain of the token cookie of the default site
 
-	PermanentTokens []string `json:"permanent_tokens"` // List of permanent tokens
+	Sites []SiteConfig `json:"sites"` // Profiles of the hosts, other hosts are protected by the top level settings
 }
 
-// Load reads and parses a JSON configuration file into the receiver.
+// Load reads and parses a JSON or YAML configuration file into the receiver. Files with the .yaml and .yml
+// extensions are YAML.
 //
 // Parameters:
-//   - file: Path to the JSON configuration file.
+//   - file: Path to the configuration file.
 //
 // Returns:
 //   - error: Non-nil if file reading/parsing fails.
 //
 // Processing steps:
-// 1. Reads the entire file content.
-// 2. Unmarshals JSON into the Config structure.
-// 3. Sets default values:
+// 1. Reads the file and merges the conf.d/*.{json,yaml,yml} fragments next to it in the lexical order of their names:
+//   - Objects are merged key by key, so a fragment may set a single setting of a section.
+//   - Lists are appended, so a fragment may add protections, budgets or sites.
+//   - Other values of the fragment replace the previous ones.
+//
+// 2. Overrides the scalar settings with the AEGIS_* environment variables, e.g. AEGIS_LOGGER_LEVEL.
+// 3. Unmarshals the result into the Config structure, unknown fields are rejected. The "$schema" key
+// referring to the JSON Schema of the configuration is ignored.
+// 4. Reads the secrets of the *_file settings, relative paths are resolved against the directory of the file.
+// 5. Sets default values:
 //   - Sets Verification.Type to "js-challenge" if empty.
+//   - Sets token format, TTL, idle TTL and storage capacity if they are not set. A negative TTL, idle TTL or
+//     capacity disables the limit and is replaced with 0.
+//   - Sets the memory storage if the storage is not set.
+//   - Sets the default admin socket, "-" disables the socket.
+//   - Sets the strikes TTL and ban duration if they are not set.
+//   - Sets the under attack release to the half of the threshold, the cooldown, the token age and the limit factor.
 //
-// 4. Normalizes protection rules:
+// 6. Normalizes protection rules:
 //   - Sets Limit=MaxUint32 if zero (unlimited).
 //   - Converts Method to uppercase (case-insensitive HTTP methods).
+//   - Sets Key="token" if empty.
+//   - Sets Algorithm="fixed_window" if empty.
+//   - Sets Mode="enforce" if empty, shadow rules are always in the "monitor" mode.
+//   - Sets Cost=1 if zero.
+//
+// 7. Sets the key, the algorithm and the mode of the budgets.
+//
+// 8. Normalizes the sites the same way, lowercases their hosts and inherits the match mode, the verification
+// and the permanent tokens which are not set.
 func (c *Config) Load(file string) (err error) {
-	content, err := os.ReadFile(file)
+	object, err := readMerged(file)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(content, c)
+	delete(object, SchemaKey)
+	applyEnv(object)
+	content, err := json.Marshal(object)
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(c)
+	if err != nil {
+		return
+	}
+	err = c.readSecrets(filepath.Dir(file))
 	if err != nil {
 		return
 	}
@@ -75,11 +292,186 @@ func (c *Config) Load(file string) (err error) {
 		c.Verification.Type = "js-challenge"
 	}
 
-	for i := range c.Protections {
-		if c.Protections[i].Limit == 0 {
-			c.Protections[i].Limit = math.MaxUint32
+	if c.Tokens.Format == "" {
+		c.Tokens.Format = "random"
+	}
+	c.Tokens.TTL = Duration(orDefault(c.Tokens.TTL.Duration(), DefaultTokenTTL))
+	c.Tokens.IdleTTL = Duration(orDefault(c.Tokens.IdleTTL.Duration(), DefaultTokenIdleTTL))
+	c.Tokens.MaxTokens = orDefault(c.Tokens.MaxTokens, DefaultMaxTokens)
+
+	if c.Storage.Type == "" {
+		c.Storage.Type = "memory"
+	}
+	if c.Storage.Path == "" {
+		c.Storage.Path = DefaultStoragePath
+	}
+	if c.Storage.SnapshotInterval == 0 {
+		c.Storage.SnapshotInterval = Duration(DefaultStorageSnapshotInterval)
+	}
+	if c.Storage.Prefix == "" {
+		c.Storage.Prefix = DefaultStoragePrefix
+	}
+
+	switch c.Admin.Socket {
+	case "":
+		c.Admin.Socket = DefaultAdminSocket
+	case "-":
+		c.Admin.Socket = ""
+	}
+
+	if c.Strikes.TTL == 0 {
+		c.Strikes.TTL = Duration(DefaultStrikesTTL)
+	}
+	if c.Strikes.BanDuration == 0 {
+		c.Strikes.BanDuration = Duration(DefaultStrikesBanDuration)
+	}
+
+	if c.UnderAttack.Release == 0 {
+		c.UnderAttack.Release = c.UnderAttack.Threshold / 2
+	}
+	if c.UnderAttack.Cooldown == 0 {
+		c.UnderAttack.Cooldown = Duration(DefaultUnderAttackCooldown)
+	}
+	if c.UnderAttack.TokenMaxAge == 0 {
+		c.UnderAttack.TokenMaxAge = Duration(DefaultUnderAttackTokenMaxAge)
+	}
+	if c.UnderAttack.LimitFactor == 0 {
+		c.UnderAttack.LimitFactor = DefaultUnderAttackLimitFactor
+	}
+
+	if c.Match == "" {
+		c.Match = usecase.MatchAll
+	}
+	c.Match = strings.ToLower(c.Match)
+	normalizeRules(c.Protections, c.Shadow, c.Budgets)
+	for i := range c.Sites {
+		site := &c.Sites[i]
+		if site.Match == "" {
+			site.Match = c.Match
+		}
+		site.Match = strings.ToLower(site.Match)
+		if site.Verification.Type == "" {
+			site.Verification = c.Verification
+		}
+		if site.PermanentTokens == nil {
+			site.PermanentTokens = c.PermanentTokens
+		}
+		for j := range site.Hosts {
+			site.Hosts[j] = strings.TrimSuffix(strings.ToLower(site.Hosts[j]), ".")
 		}
-		c.Protections[i].Method = strings.ToUpper(c.Protections[i].Method)
+		normalizeRules(site.Protections, site.Shadow, site.Budgets)
 	}
 	return
 }
+
+// orDefault returns the default if the value is not set and 0, which disables the limit, if it is negative.
+func orDefault[T int | time.Duration](value, defaultValue T) T {
+	switch {
+	case value == 0:
+		return defaultValue
+	case value < 0:
+		return 0
+	}
+	return value
+}
+
+// normalizeRules sets the defaults of the protections, the shadow rules and the budgets.
+func normalizeRules(protections, shadow []ProtectionConfig, budgets []BudgetConfig) {
+	for i := range protections {
+		protections[i].normalize()
+	}
+	for i := range shadow {
+		shadow[i].normalize()
+		shadow[i].Mode = usecase.ModeMonitor
+	}
+	for i := range budgets {
+		budget := &budgets[i]
+		if budget.Key == "" {
+			budget.Key = "token"
+		}
+		if budget.Algorithm == "" {
+			budget.Algorithm = "fixed_window"
+		}
+		budget.Mode = normalizeMode(budget.Mode)
+	}
+}
+
+// normalizeMode returns the lowercase mode, "enforce" if it is not set.
+func normalizeMode(mode string) string {
+	if mode == "" {
+		return usecase.ModeEnforce
+	}
+	return strings.ToLower(mode)
+}
+
+// normalize sets the defaults of the protection rule.
+func (p *ProtectionConfig) normalize() {
+	if p.Limit == 0 {
+		p.Limit = math.MaxUint32
+	}
+	p.Method = strings.ToUpper(p.Method)
+	if p.Key == "" {
+		p.Key = "token"
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = "fixed_window"
+	}
+	p.Mode = normalizeMode(p.Mode)
+	p.Action = strings.ToLower(p.Action)
+	if p.Cost == 0 {
+		p.Cost = 1
+	}
+}
+
+// BudgetRules returns the budgets shared by the protections of the default site.
+func (c *Config) BudgetRules() []usecase.Budget {
+	site := c.DefaultSite()
+	return site.BudgetRules()
+}
+
+// ProtectionRules returns the protections of the default site in the evaluation order.
+func (c *Config) ProtectionRules() []usecase.Protection {
+	site := c.DefaultSite()
+	return site.ProtectionRules()
+}
+
+// DefaultSite returns the site of the top level settings. It has no hosts, it serves every host of no other site.
+func (c *Config) DefaultSite() SiteConfig {
+	return SiteConfig{
+		Name:            DefaultSite,
+		Protections:     c.Protections,
+		Match:           c.Match,
+		Shadow:          c.Shadow,
+		Budgets:         c.Budgets,
+		Verification:    c.Verification,
+		PermanentTokens: c.PermanentTokens,
+		CookieDomain:    c.CookieDomain,
+	}
+}
+
+// AllSites returns the default site followed by the configured sites.
+func (c *Config) AllSites() []SiteConfig {
+	return append([]SiteConfig{c.DefaultSite()}, c.Sites...)
+}
+
+// BudgetRules returns the budgets shared by the protections of the site.
+func (s *SiteConfig) BudgetRules() []usecase.Budget {
+	budgets := make([]usecase.Budget, 0, len(s.Budgets))
+	for _, budget := range s.Budgets {
+		budgets = append(budgets, usecase.Budget(budget))
+	}
+	return budgets
+}
+
+// ProtectionRules returns the live protections of the site followed by the shadow ones in the evaluation order.
+// Every protection is final in the "first" match mode.
+func (s *SiteConfig) ProtectionRules() []usecase.Protection {
+	rules := make([]usecase.Protection, 0, len(s.Protections)+len(s.Shadow))
+	for _, protection := range slices.Concat(s.Protections, s.Shadow) {
+		rule := usecase.Protection(protection)
+		rule.Final = rule.Final || s.Match == usecase.MatchFirst
+		rules = append(rules, rule)
+	}
+	usecase.SortProtections(rules)
+	return rules
+}
@@ -0,0 +1,211 @@
+package config_test
+
+import (
+	"aegis/internal/config"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+// TestLoadSources verifies the precedence of the main file, the conf.d fragments and the environment variables
+// and the secret files.
+func TestLoadSources(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+	writeFile(t, file, `{
+		"address": ":8080",
+		"logger": {"level": "debug"},
+		"protections": [{"path": "^/login$", "rps": 5}],
+		"tokens": {"format": "hmac", "signing_key": "k2", "keys": [{"id": "k1", "secret": "inline"}], "hmac_key_file": "secrets/keys"},
+		"storage": {"type": "redis", "address": "localhost:6379", "password_file": "/nonexistent"},
+		"admin": {"secret_file": "secrets/admin"},
+		"permanent_tokens": ["inline"],
+		"permanent_tokens_file": "secrets/tokens"
+	}`)
+	writeFile(t, filepath.Join(dir, config.ConfDir, "10-shop.json"), `{
+		"protections": [{"path": "^/cart$", "rps": 10}],
+		"sites": [{"name": "shop", "hosts": ["shop.example.com"], "permanent_tokens_file": "secrets/shop"}]
+	}`)
+	writeFile(t, filepath.Join(dir, config.ConfDir, "20-storage.json"), `{"storage": {"password_file": "secrets/redis"}}`)
+	writeFile(t, filepath.Join(dir, config.ConfDir, "ignored.txt"), `{"address": ":9090"}`)
+	writeFile(t, filepath.Join(dir, "secrets", "keys"), "# rotated monthly\nk2:signing-secret\n")
+	writeFile(t, filepath.Join(dir, "secrets", "admin"), "admin-secret\n")
+	writeFile(t, filepath.Join(dir, "secrets", "redis"), "redis-password\n")
+	writeFile(t, filepath.Join(dir, "secrets", "tokens"), "permanent-1\n\npermanent-2\n")
+	writeFile(t, filepath.Join(dir, "secrets", "shop"), "shop-token\n")
+	t.Setenv("AEGIS_LOGGER_LEVEL", "warn")
+	t.Setenv("AEGIS_UNDER_ATTACK_THRESHOLD", "1000")
+	t.Setenv("AEGIS_TOKENS_TTL", "12h")
+	t.Setenv("AEGIS_STORAGE_DB", "2")
+	t.Setenv("AEGIS_STORAGE_ADDRESS", "redis:6379")
+
+	var cfg config.Config
+	assert.NoError(t, cfg.Load(file))
+	assert.Equal(t, ":8080", cfg.Address)
+	assert.Equal(t, "WARN", cfg.Logger.Level)
+	assert.Equal(t, uint32(1000), cfg.UnderAttack.Threshold)
+	assert.Equal(t, uint32(500), cfg.UnderAttack.Release)
+	assert.Equal(t, 12*time.Hour, cfg.Tokens.TTL.Duration())
+	assert.Equal(t, 2, cfg.Storage.DB)
+	assert.Equal(t, "redis:6379", cfg.Storage.Address)
+	assert.Equal(t, "redis", cfg.Storage.Type)
+	assert.Equal(t, "redis-password", cfg.Storage.Password)
+	assert.Equal(t, "admin-secret", cfg.Admin.Secret)
+	assert.Equal(t, []config.KeyConfig{{Id: "k1", Secret: "inline"}, {Id: "k2", Secret: "signing-secret"}}, cfg.Tokens.Keys)
+	assert.Equal(t, []string{"inline", "permanent-1", "permanent-2"}, cfg.PermanentTokens)
+	if assert.Len(t, cfg.Protections, 2) {
+		assert.Equal(t, "^/login$", cfg.Protections[0].Path)
+		assert.Equal(t, "^/cart$", cfg.Protections[1].Path)
+	}
+	if assert.Len(t, cfg.Sites, 1) {
+		assert.Equal(t, []string{"shop-token"}, cfg.Sites[0].PermanentTokens)
+		assert.Equal(t, "js-challenge", cfg.Sites[0].Verification.Type)
+	}
+
+	redacted := cfg.Redacted()
+	assert.Equal(t, config.RedactedSecret, redacted.Storage.Password)
+	assert.Equal(t, config.RedactedSecret, redacted.Admin.Secret)
+	assert.Equal(t, config.RedactedSecret, redacted.Tokens.Keys[1].Secret)
+	assert.Equal(t, []string{config.RedactedSecret}, redacted.Sites[0].PermanentTokens)
+	assert.Equal(t, "signing-secret", cfg.Tokens.Keys[1].Secret, "the loaded configuration is not changed")
+	assert.Equal(t, "shop-token", cfg.Sites[0].PermanentTokens[0])
+}
+
+// TestLoadTokenLimits verifies that the unset token limits get the defaults and the negative ones are disabled.
+func TestLoadTokenLimits(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, file, `{"tokens": {"idle_ttl": -1, "max_tokens": -1}}`)
+	var cfg config.Config
+	assert.NoError(t, cfg.Load(file))
+	assert.Equal(t, config.DefaultTokenTTL, cfg.Tokens.TTL.Duration())
+	assert.Zero(t, cfg.Tokens.IdleTTL)
+	assert.Zero(t, cfg.Tokens.MaxTokens)
+}
+
+// TestLoadErrors verifies the errors of the malformed sources.
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.json")
+
+	writeFile(t, file, `{"storage": {"password": "inline", "password_file": "redis"}}`)
+	writeFile(t, filepath.Join(dir, "redis"), "secret")
+	var cfg config.Config
+	assert.ErrorContains(t, cfg.Load(file), "storage.password and storage.password_file are both set")
+
+	writeFile(t, file, `{"tokens": {"hmac_key_file": "keys"}}`)
+	writeFile(t, filepath.Join(dir, "keys"), "secret-without-id")
+	cfg = config.Config{}
+	assert.ErrorContains(t, cfg.Load(file), "key 1 is not id:secret")
+
+	writeFile(t, file, `{}`)
+	writeFile(t, filepath.Join(dir, config.ConfDir, "broken.json"), `{"address": `)
+	cfg = config.Config{}
+	assert.ErrorContains(t, cfg.Load(file), "broken.json")
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, config.ConfDir, "broken.json")))
+	writeFile(t, file, `{"protections": [{"path": "^/login$", "rps": "5/fortnight"}]}`)
+	cfg = config.Config{}
+	assert.ErrorContains(t, cfg.Load(file), "unknown period")
+	writeFile(t, file, `{"protections": [{"path": "^/login$", "rps": -1}]}`)
+	cfg = config.Config{}
+	assert.Error(t, cfg.Load(file))
+
+	writeFile(t, file, `{}`)
+	t.Setenv("AEGIS_UNDER_ATTACK_THRESHOLD", "many")
+	cfg = config.Config{}
+	assert.Error(t, cfg.Load(file))
+}
+
+// TestLoadYaml verifies the YAML configuration with the unit-aware values merged with the JSON fragments.
+func TestLoadYaml(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	writeFile(t, file, `
+# Main configuration
+$schema: ./config.schema.json
+address: ":8080"
+tokens:
+  ttl: 12h
+storage:
+  type: file
+  snapshot_interval: 30m
+protections:
+  - path: ^/login$
+    method: post
+    rps: 5/s
+    limits: [10/min, {rate: 100/day, action: ban, duration: 1h}]
+    headers:
+      X-Requested-With: {exact: XMLHttpRequest}
+  - path: ^/search$
+    rps: 100/min
+    burst: 20
+    limits: [1000/h]
+`)
+	writeFile(t, filepath.Join(dir, config.ConfDir, "10-api.yml"), "protections:\n  - path: ^/api/\n    rps: 20\n")
+	writeFile(t, filepath.Join(dir, config.ConfDir, "20-logger.json"), `{"logger": {"level": "debug"}}`)
+
+	var cfg config.Config
+	assert.NoError(t, cfg.Load(file))
+	assert.Equal(t, ":8080", cfg.Address)
+	assert.Equal(t, "DEBUG", cfg.Logger.Level)
+	assert.Equal(t, 12*time.Hour, cfg.Tokens.TTL.Duration())
+	assert.Equal(t, 30*time.Minute, cfg.Storage.SnapshotInterval.Duration())
+	if assert.Len(t, cfg.Protections, 3) {
+		login := cfg.Protections[0]
+		assert.Equal(t, "POST", login.Method)
+		assert.Equal(t, uint32(5), login.Limit)
+		assert.Equal(t, "10/min", login.Limits[0].Rate.String())
+		assert.Equal(t, "ban", login.Limits[1].Action)
+		assert.Equal(t, time.Hour, login.Limits[1].Duration.Duration())
+		assert.Equal(t, "XMLHttpRequest", login.Headers["X-Requested-With"].Exact)
+
+		search := cfg.Protections[1]
+		assert.Equal(t, uint32(math.MaxUint32), search.Limit, "the rate of another period is not the RPS limit")
+		assert.Zero(t, search.Burst)
+		if assert.Len(t, search.Limits, 2) {
+			assert.Equal(t, "100/min", search.Limits[0].Rate.String())
+			assert.Equal(t, uint32(20), search.Limits[0].Burst)
+			assert.Equal(t, "1000/h", search.Limits[1].Rate.String())
+		}
+		assert.Equal(t, uint32(20), cfg.Protections[2].Limit)
+	}
+}
+
+// TestLoadUnknownFields verifies that the misspelled settings are rejected.
+func TestLoadUnknownFields(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config.json":     `{"protections": [{"path": "^/login$", "rsp": 5}]}`,
+		"config.yaml":     "tokens:\n  tll: 1h\n",
+		"limit.json":      `{"protections": [{"path": "^/login$", "limits": [{"rate": "5/s", "acton": "ban"}]}]}`,
+		"pattern.json":    `{"protections": [{"path": "^/login$", "host": {"exactly": "example.com"}}]}`,
+		"duplicates.yaml": "address: :8080\naddress: :9090\n",
+	} {
+		file := filepath.Join(dir, name)
+		writeFile(t, file, content)
+		var cfg config.Config
+		assert.Error(t, cfg.Load(file), name)
+	}
+}
+
+// TestSchema verifies that the shipped JSON Schema is generated from the current configuration types.
+func TestSchema(t *testing.T) {
+	schema, err := config.Schema()
+	assert.NoError(t, err)
+	shipped, err := os.ReadFile("../../deployment/assets/etc/aegis/config.schema.json")
+	assert.NoError(t, err)
+	assert.Equal(t, string(schema), string(shipped), "run go generate ./internal/config")
+	assert.Contains(t, string(schema), `"snapshot_interval": {`)
+	assert.Contains(t, string(schema), `"$ref": "#/$defs/ProtectionConfig"`)
+	assert.Contains(t, string(schema), `"rps": {
+          "oneOf": [`)
+}
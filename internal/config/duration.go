@@ -0,0 +1,6 @@
+package config
+
+import "aegis/internal/usecase"
+
+// Duration is usecase.Duration.
+type Duration = usecase.Duration
@@ -0,0 +1,135 @@
+package config
+
+//go:generate sh -c "go run ../../cmd config schema > ../../deployment/assets/etc/aegis/config.schema.json"
+
+import (
+	"aegis/internal/usecase"
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// SchemaKey is the key of the configuration object referring to its JSON Schema, it is ignored by Load.
+const SchemaKey = "$schema"
+
+var (
+	durationType = reflect.TypeFor[Duration]()
+	rateType     = reflect.TypeFor[usecase.Rate]()
+	limitType    = reflect.TypeFor[usecase.Limit]()
+	patternType  = reflect.TypeFor[usecase.Pattern]()
+
+	protectionType = reflect.TypeFor[ProtectionConfig]()
+)
+
+// schemaGenerator builds the JSON Schema of the configuration types. Named structures and the types
+// with the custom JSON representation are placed into the definitions.
+type schemaGenerator struct {
+	defs map[string]any
+}
+
+// ref returns the reference to the definition, the definition is built on the first reference.
+func (g *schemaGenerator) ref(name string, build func() map[string]any) map[string]any {
+	if _, found := g.defs[name]; !found {
+		g.defs[name] = nil
+		g.defs[name] = build()
+	}
+	return map[string]any{"$ref": "#/$defs/" + name}
+}
+
+// object returns the schema of the structure. Fields without the JSON name are skipped, unknown fields are rejected.
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = g.schema(field.Type)
+		if t == protectionType && name == "rps" {
+			// The rps is also a rate, see ProtectionConfig.UnmarshalJSON
+			properties[name] = map[string]any{"oneOf": []any{properties[name], g.schema(rateType)}}
+		}
+	}
+	return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+// schema returns the schema of the type.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch t {
+	case durationType:
+		return g.ref("Duration", func() map[string]any {
+			return map[string]any{
+				"description": `Duration like "10m" or "1h30m", a number is seconds`,
+				"type":        []string{"string", "number"},
+				"pattern":     `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`,
+			}
+		})
+	case rateType:
+		return g.ref("Rate", func() map[string]any {
+			return map[string]any{
+				"description": `Requests per period like "5/s", "200/min", "5000/day" or "100/10m"`,
+				"type":        "string",
+				"pattern":     `^ *[0-9]+ */ *[^ ]+ *$`,
+			}
+		})
+	case limitType:
+		return g.ref("Limit", func() map[string]any {
+			return map[string]any{"oneOf": []any{g.schema(rateType), g.object(limitType)}}
+		})
+	case patternType:
+		return g.ref("Pattern", func() map[string]any {
+			return map[string]any{"oneOf": []any{
+				map[string]any{"description": "Regular expression", "type": "string"},
+				g.object(patternType),
+			}}
+		})
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "minimum": 0, "maximum": uint64(1)<<t.Bits() - 1}
+	case reflect.Uint, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0, "maximum": uint64(math.MaxUint64)}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.ref(t.Name(), func() map[string]any { return g.object(t) })
+	}
+	return map[string]any{}
+}
+
+// Schema returns the JSON Schema of the configuration generated from the Config type. Editors use it to validate
+// the JSON and YAML configuration files.
+func Schema() ([]byte, error) {
+	g := schemaGenerator{defs: map[string]any{}}
+	schema := g.object(reflect.TypeFor[Config]())
+	schema["properties"].(map[string]any)[SchemaKey] = map[string]any{"type": "string"}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "Aegis configuration"
+	schema["$defs"] = g.defs
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(schema); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfDir is the directory of the configuration fragments next to the main configuration file
+	ConfDir = "conf.d"
+
+	// EnvPrefix is the prefix of the environment variables overriding the scalar settings
+	EnvPrefix = "AEGIS_"
+
+	// RedactedSecret replaces the secrets of the printed configuration
+	RedactedSecret = "<redacted>"
+)
+
+// envSetting is the scalar setting overridden by an environment variable.
+type envSetting struct {
+	path []string // JSON keys of the setting, e.g. ["under_attack", "threshold"]
+	kind reflect.Kind
+}
+
+// envSettings are the scalar settings by the names of their environment variables.
+var envSettings = collectEnvSettings(reflect.TypeFor[Config](), nil, map[string]envSetting{})
+
+// collectEnvSettings adds the scalar settings of the structure. The variable name is the prefix followed by
+// the uppercase JSON keys joined with "_", e.g. AEGIS_UNDER_ATTACK_THRESHOLD. Lists and maps are not overridden.
+func collectEnvSettings(t reflect.Type, path []string, settings map[string]envSetting) map[string]envSetting {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fieldPath := append(slices.Clip(path), name)
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			collectEnvSettings(field.Type, fieldPath, settings)
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32,
+			reflect.Uint64, reflect.Float32, reflect.Float64:
+			settings[EnvPrefix+strings.ToUpper(strings.Join(fieldPath, "_"))] = envSetting{path: fieldPath, kind: field.Type.Kind()}
+		}
+	}
+	return settings
+}
+
+// isYaml returns true if the configuration file is YAML by its extension.
+func isYaml(file string) bool {
+	extension := strings.ToLower(filepath.Ext(file))
+	return extension == ".yaml" || extension == ".yml"
+}
+
+// readObject reads the object of the JSON or YAML configuration file.
+func readObject(file string) (map[string]any, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]any
+	if isYaml(file) {
+		err = yaml.Unmarshal(content, &object)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&object)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if object == nil {
+		object = map[string]any{}
+	}
+	return object, nil
+}
+
+// readMerged reads the main configuration file and merges the JSON and YAML fragments of the conf.d directory
+// next to it in the lexical order of their names.
+func readMerged(file string) (map[string]any, error) {
+	merged, err := readObject(file)
+	if err != nil {
+		return nil, err
+	}
+	var fragments []string
+	for _, extension := range []string{"json", "yaml", "yml"} {
+		found, err := filepath.Glob(filepath.Join(filepath.Dir(file), ConfDir, "*."+extension))
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, found...)
+	}
+	slices.Sort(fragments)
+	for _, fragment := range fragments {
+		object, err := readObject(fragment)
+		if err != nil {
+			return nil, err
+		}
+		merge(merged, object)
+	}
+	return merged, nil
+}
+
+// merge merges the fragment into the configuration: the objects are merged key by key, the lists are appended,
+// other values are replaced.
+func merge(dst, src map[string]any) {
+	for key, value := range src {
+		switch v := value.(type) {
+		case map[string]any:
+			if object, ok := dst[key].(map[string]any); ok {
+				merge(object, v)
+				continue
+			}
+		case []any:
+			if list, ok := dst[key].([]any); ok {
+				dst[key] = append(list, v...)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// applyEnv replaces the settings of the configuration with the values of the set environment variables.
+// Values of the non-string settings are taken as JSON if they are valid JSON, e.g. 100 or true, and as strings
+// otherwise, e.g. durations like 10m.
+func applyEnv(object map[string]any) {
+	for name, setting := range envSettings {
+		value, found := os.LookupEnv(name)
+		if !found {
+			continue
+		}
+		parent := object
+		for _, key := range setting.path[:len(setting.path)-1] {
+			child, ok := parent[key].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				parent[key] = child
+			}
+			parent = child
+		}
+		key := setting.path[len(setting.path)-1]
+		if setting.kind != reflect.String && json.Valid([]byte(value)) {
+			parent[key] = json.RawMessage(value)
+		} else {
+			parent[key] = value
+		}
+	}
+}
+
+// secretPath resolves the path of the secret file against the configuration directory.
+func secretPath(dir, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+// readSecret returns the content of the secret file without the trailing line break.
+func readSecret(dir, file string) (string, error) {
+	content, err := os.ReadFile(secretPath(dir, file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// readLines returns the non-empty lines of the secret file which are not "#" comments.
+func readLines(dir, file string) ([]string, error) {
+	content, err := os.ReadFile(secretPath(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for line := range strings.Lines(string(content)) {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// readSecretFile sets the secret from the file if the file is set. The secret must not be set inline then.
+func readSecretFile(dir, file, setting string, secret *string) (err error) {
+	if file == "" {
+		return nil
+	}
+	if *secret != "" {
+		return fmt.Errorf("%s and %s_file are both set", setting, setting)
+	}
+	*secret, err = readSecret(dir, file)
+	return
+}
+
+// readSecrets reads the secrets of the *_file settings. The permanent tokens and the keys of the files are appended
+// to the inline ones.
+func (c *Config) readSecrets(dir string) error {
+	if c.PermanentTokensFile != "" {
+		tokens, err := readLines(dir, c.PermanentTokensFile)
+		if err != nil {
+			return err
+		}
+		c.PermanentTokens = append(c.PermanentTokens, tokens...)
+	}
+	for i := range c.Sites {
+		site := &c.Sites[i]
+		if site.PermanentTokensFile == "" {
+			continue
+		}
+		tokens, err := readLines(dir, site.PermanentTokensFile)
+		if err != nil {
+			return err
+		}
+		site.PermanentTokens = append(append([]string{}, site.PermanentTokens...), tokens...)
+	}
+	if c.Tokens.HmacKeyFile != "" {
+		lines, err := readLines(dir, c.Tokens.HmacKeyFile)
+		if err != nil {
+			return err
+		}
+		for n, line := range lines {
+			id, secret, found := strings.Cut(line, ":")
+			if !found {
+				return fmt.Errorf("%s: key %d is not id:secret", c.Tokens.HmacKeyFile, n+1)
+			}
+			c.Tokens.Keys = append(c.Tokens.Keys, KeyConfig{Id: id, Secret: secret})
+		}
+	}
+	if err := readSecretFile(dir, c.Storage.PasswordFile, "storage.password", &c.Storage.Password); err != nil {
+		return err
+	}
+	return readSecretFile(dir, c.Admin.SecretFile, "admin.secret", &c.Admin.Secret)
+}
+
+// redact returns the placeholder of the set secret.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return RedactedSecret
+}
+
+// redactAll returns the placeholders of the secrets.
+func redactAll(secrets []string) []string {
+	if secrets == nil {
+		return nil
+	}
+	redacted := make([]string, len(secrets))
+	for i, secret := range secrets {
+		redacted[i] = redact(secret)
+	}
+	return redacted
+}
+
+// Redacted returns the copy of the configuration with the secrets replaced by the placeholder.
+func (c *Config) Redacted() Config {
+	redacted := *c
+	redacted.Storage.Password = redact(c.Storage.Password)
+	redacted.Admin.Secret = redact(c.Admin.Secret)
+	redacted.Tokens.Keys = slices.Clone(c.Tokens.Keys)
+	for i := range redacted.Tokens.Keys {
+		redacted.Tokens.Keys[i].Secret = redact(redacted.Tokens.Keys[i].Secret)
+	}
+	redacted.PermanentTokens = redactAll(c.PermanentTokens)
+	redacted.Sites = slices.Clone(c.Sites)
+	for i := range redacted.Sites {
+		redacted.Sites[i].PermanentTokens = redactAll(redacted.Sites[i].PermanentTokens)
+	}
+	return redacted
+}
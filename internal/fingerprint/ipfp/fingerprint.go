@@ -16,3 +16,9 @@ func Calculate(address string) *IpFingerprint {
 	f.Hash = utils.Uint64ToByte(crc32.ChecksumIEEE([]byte(address)))
 	return &f
 }
+
+// Prefix returns the part of the request fingerprint derived from the address. It allows to find
+// fingerprints of all clients sharing the address.
+func Prefix(address string) []byte {
+	return Calculate(address).Hash
+}
@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Actions applied to the clients exceeding a limit
+const (
+	ActionRevoke    = "revoke"    // Token is revoked, the client has to pass the challenge again
+	ActionChallenge = "challenge" // Token is revoked and the next challenges of the client are harder
+	ActionDeny      = "deny"      // Requests are denied while the limit is exceeded
+	ActionReject    = "reject"    // Requests are rejected with 429 and Retry-After while the limit is exceeded
+	ActionThrottle  = "throttle"  // All requests of the client are rejected with 429 for the duration
+	ActionBan       = "ban"       // Client is banned by the key, repeated bans are twice as long
+)
+
+// Default durations of the actions
+const (
+	DefaultThrottleDuration  = time.Minute
+	DefaultChallengeDuration = time.Hour
+	DefaultBanDuration       = 10 * time.Minute
+	DefaultBanMaxDuration    = 24 * time.Hour
+)
+
+var actions = []string{ActionRevoke, ActionChallenge, ActionDeny, ActionReject, ActionThrottle, ActionBan}
+
+// severity orders the actions, the most severe verdict is returned. Revoke and challenge do not reject
+// the request, they are ordered for the monitored verdicts.
+var severity = map[string]int{ActionRevoke: 1, ActionChallenge: 2, ActionDeny: 3, ActionReject: 4, ActionThrottle: 5, ActionBan: 6}
+
+// ParseAction validates the action of the limit with the key. Empty string means revoking the token
+// for the keys including the token and denying the requests for other keys.
+func ParseAction(s string, key Key) (string, error) {
+	if s == "" {
+		if key.HasToken() {
+			return ActionRevoke, nil
+		}
+		return ActionDeny, nil
+	}
+	s = strings.ToLower(s)
+	if !slices.Contains(actions, s) {
+		return "", fmt.Errorf("unknown action %q, expected one of %s", s, strings.Join(actions, ", "))
+	}
+	if (s == ActionRevoke || s == ActionChallenge) && !key.HasToken() {
+		return "", fmt.Errorf("action %s requires the key including %s", s, KeyToken)
+	}
+	if s == ActionBan && !key.HasClient() {
+		return "", fmt.Errorf("action %s requires the key including a client part", s)
+	}
+	return s, nil
+}
+
+// Verdict is the decision of the limiter on the request.
+type Verdict struct {
+	Action     string        // Action of the exceeded limit rejecting the request, empty if the request is allowed
+	RetryAfter time.Duration // Time until the client is allowed again
+	Monitored  string        // Action of the exceeded limit of the monitored protections, it is not enforced
+}
+
+// Allowed returns true if no limit rejects the request.
+func (v Verdict) Allowed() bool {
+	return v.Action == ""
+}
+
+// worse returns the more severe verdict, the longer one of the same action, with the more severe monitored action.
+func (v Verdict) worse(other Verdict) Verdict {
+	monitored := v.Monitored
+	if severity[other.Monitored] > severity[monitored] {
+		monitored = other.Monitored
+	}
+	if severity[other.Action] > severity[v.Action] ||
+		severity[other.Action] == severity[v.Action] && other.RetryAfter > v.RetryAfter {
+		v = other
+	}
+	v.Monitored = monitored
+	return v
+}
@@ -0,0 +1,87 @@
+package limiter
+
+import (
+	"aegis/internal/usecase"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseAction verifies the default actions and the keys required by the actions.
+func TestParseAction(t *testing.T) {
+	token, _ := ParseKey("token")
+	ip, _ := ParseKey("ip+fingerprint")
+	for _, c := range []struct {
+		action   string
+		key      Key
+		expected string
+	}{
+		{"", token, ActionRevoke},
+		{"", ip, ActionDeny},
+		{"Challenge", token, ActionChallenge},
+		{"ban", ip, ActionBan},
+		{"ban", token, ActionBan},
+		{"throttle", token, ActionThrottle},
+	} {
+		action, err := ParseAction(c.action, c.key)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, action)
+	}
+	for _, c := range []struct {
+		action string
+		key    Key
+	}{{"revoke", ip}, {"challenge", ip}, {"captcha", token}} {
+		_, err := ParseAction(c.action, c.key)
+		assert.Error(t, err, c.action)
+	}
+}
+
+// TestRotateOffenders verifies that the revoke and challenge actions are applied on the rotation.
+func TestRotateOffenders(t *testing.T) {
+	key, _ := ParseKey("token")
+	revoke := newPolicy(AlgorithmFixedWindow, ActionRevoke, 1, 0, time.Second)
+	challenge := newPolicy(AlgorithmFixedWindow, ActionChallenge, 2, 0, time.Minute)
+	challenge.duration = time.Hour
+	c := newLimitedCounter("", &usecase.Protection{Path: "^/"}, &compiledLimit{key: key, policies: []policy{revoke, challenge}}, nil)
+
+	first := Request{Token: "first", Fingerprint: []byte{1}}
+	second := Request{Token: "second", Fingerprint: []byte{2}}
+	for range 2 {
+		c.Increment("first", &first, 0, 1, 1)
+	}
+	for range 3 {
+		c.Increment("second", &second, 0, 1, 1)
+	}
+	offenders := c.rotate(int64(time.Second))
+	assert.ElementsMatch(t, []offender{
+		{token: "first", fingerprint: []byte{1}, action: ActionRevoke},
+		{token: "second", fingerprint: []byte{2}, action: ActionChallenge, duration: time.Hour},
+	}, offenders)
+	// The minute window of the clients is kept
+	assert.Len(t, c.counter, 2)
+	assert.Empty(t, c.rotate(int64(time.Minute)))
+	assert.Empty(t, c.counter)
+}
+
+// TestMonitoredLimits verifies that the actions of the monitored limits are reported but not applied.
+func TestMonitoredLimits(t *testing.T) {
+	key, _ := ParseKey("ip+token")
+	revoke := newPolicy(AlgorithmFixedWindow, ActionRevoke, 1, 0, time.Second)
+	throttle := newPolicy(AlgorithmFixedWindow, ActionThrottle, 2, 0, time.Second)
+	throttle.duration = time.Minute
+	c := newLimitedCounter("", &usecase.Protection{Path: "^/", Mode: usecase.ModeMonitor}, &compiledLimit{key: key, policies: []policy{revoke, throttle}}, nil)
+
+	request := Request{Token: "token", Address: "192.0.2.1"}
+	verdict, toBan := c.Increment("client", &request, 0, 1, 1)
+	assert.Equal(t, Verdict{}, verdict)
+	verdict, _ = c.Increment("client", &request, 0, 1, 1)
+	assert.Equal(t, Verdict{Monitored: ActionRevoke}, verdict)
+	verdict, toBan = c.Increment("client", &request, 0, 1, 1)
+	assert.Equal(t, Verdict{Monitored: ActionThrottle}, verdict)
+	assert.Nil(t, toBan)
+	assert.Empty(t, c.rotate(int64(time.Second)))
+	verdict, _ = c.Increment("client", &request, int64(time.Second), 1, 1)
+	assert.True(t, verdict.Allowed())
+	assert.Empty(t, verdict.Monitored)
+}
@@ -0,0 +1,230 @@
+package limiter
+
+import (
+	"aegis/internal/usecase"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Algorithms
+const (
+	AlgorithmFixedWindow   = "fixed_window"   // Counters are reset every window
+	AlgorithmSlidingWindow = "sliding_window" // Count of the previous window is weighted by its overlap with the sliding window
+	AlgorithmTokenBucket   = "token_bucket"   // Bucket of burst tokens is refilled with the limit rate
+
+	// DefaultAlgorithm resets the counters every window
+	DefaultAlgorithm = AlgorithmFixedWindow
+)
+
+var algorithms = []string{AlgorithmFixedWindow, AlgorithmSlidingWindow, AlgorithmTokenBucket}
+
+// ParseAlgorithm validates the algorithm name. Empty string means the default algorithm.
+func ParseAlgorithm(s string) (string, error) {
+	if s == "" {
+		return DefaultAlgorithm, nil
+	}
+	s = strings.ToLower(s)
+	if !slices.Contains(algorithms, s) {
+		return "", fmt.Errorf("unknown algorithm %q, expected one of %s", s, strings.Join(algorithms, ", "))
+	}
+	return s, nil
+}
+
+// policy is the rate limit shared by the clients of an endpoint.
+type policy struct {
+	algorithm   string
+	action      string
+	limit       uint32        // Requests per period
+	burst       uint32        // Capacity of the token bucket
+	period      int64         // Window length, nanoseconds
+	duration    time.Duration // Throttling, the first ban or the harder challenge duration
+	maxDuration time.Duration // Longest ban
+}
+
+// newPolicy creates the policy of the limit. Zero burst means the limit.
+func newPolicy(algorithm string, action string, limit, burst uint32, period time.Duration) policy {
+	if burst == 0 {
+		burst = limit
+	}
+	return policy{algorithm: algorithm, action: action, limit: limit, burst: burst, period: int64(period)}
+}
+
+// tightened returns the copy of the policy with the limit and the burst multiplied by the factor, at least one.
+func (p *policy) tightened(factor float64) *policy {
+	tight := *p
+	tight.limit = max(uint32(float64(p.limit)*factor), 1)
+	tight.burst = max(uint32(float64(p.burst)*factor), 1)
+	return &tight
+}
+
+// rate returns the configured rate of the policy.
+func (p *policy) rate() usecase.Rate {
+	return usecase.Rate{Limit: p.limit, Period: time.Duration(p.period)}
+}
+
+// newRate creates the empty state of a client.
+func (p *policy) newRate(now int64) rate {
+	switch p.algorithm {
+	case AlgorithmSlidingWindow:
+		return &slidingWindow{window: now / p.period}
+	case AlgorithmTokenBucket:
+		return &tokenBucket{}
+	default:
+		w := fixedWindow{}
+		w.window.Store(now / p.period)
+		return &w
+	}
+}
+
+// rate is the request rate state of a single client. Requests are added concurrently under the read lock
+// of the limiter, the state is rotated under its exclusive lock.
+type rate interface {
+	// add counts the request of the cost made at now and returns true if the limit is exceeded.
+	add(now int64, cost uint32, p *policy) bool
+	// count returns the number of requests the limit is compared with.
+	count(now int64, p *policy) uint32
+	// retryAfter returns the time until the next request is allowed.
+	retryAfter(now int64, p *policy) int64
+	// rotate is called once per second. Returns false if the state is empty and the client can be forgotten.
+	// The fixed window is reset when the period of its window is over.
+	rotate(now int64, p *policy) bool
+}
+
+// fixedWindow counts the requests since the window start.
+type fixedWindow struct {
+	window   atomic.Int64 // Number of the window since the epoch
+	requests atomic.Uint32
+}
+
+func (w *fixedWindow) add(_ int64, cost uint32, p *policy) bool {
+	return w.requests.Add(cost) > p.limit
+}
+
+func (w *fixedWindow) count(int64, *policy) uint32 {
+	return w.requests.Load()
+}
+
+func (w *fixedWindow) retryAfter(now int64, p *policy) int64 {
+	return max((w.window.Load()+1)*p.period-now, 0)
+}
+
+func (w *fixedWindow) rotate(now int64, p *policy) bool {
+	if window := now / p.period; window != w.window.Load() {
+		w.window.Store(window)
+		w.requests.Store(0)
+	}
+	return w.requests.Load() != 0
+}
+
+// slidingWindow approximates the sliding window with the counts of the current and the previous
+// fixed windows: the previous count is weighted by the part of the previous window inside the sliding one.
+type slidingWindow struct {
+	mu       sync.Mutex
+	window   int64 // Number of the current window since the epoch
+	previous uint32
+	current  uint32
+}
+
+// advance moves the state to the window of now.
+func (w *slidingWindow) advance(now int64, p *policy) (elapsed int64) {
+	window := now / p.period
+	switch window {
+	case w.window:
+	case w.window + 1:
+		w.previous, w.current = w.current, 0
+	default:
+		w.previous, w.current = 0, 0
+	}
+	w.window = window
+	return now - window*p.period
+}
+
+// estimate returns the weighted number of requests in the sliding window.
+func (w *slidingWindow) estimate(elapsed int64, p *policy) uint64 {
+	return uint64(w.previous)*uint64(p.period-elapsed)/uint64(p.period) + uint64(w.current)
+}
+
+func (w *slidingWindow) add(now int64, cost uint32, p *policy) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	elapsed := w.advance(now, p)
+	w.current += cost
+	return w.estimate(elapsed, p) > uint64(p.limit)
+}
+
+func (w *slidingWindow) count(now int64, p *policy) uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return uint32(min(w.estimate(w.advance(now, p), p), uint64(^uint32(0))))
+}
+
+// retryAfter solves the estimate of the moment for the limit minus one request.
+func (w *slidingWindow) retryAfter(now int64, p *policy) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	elapsed := w.advance(now, p)
+	limit := int64(p.limit)
+	previous, current := int64(w.previous), int64(w.current)
+	if current >= limit {
+		// The current window is over the limit, it becomes the previous one
+		return p.period - elapsed + p.period*(current-limit+1)/current
+	}
+	if previous == 0 {
+		return 0
+	}
+	needed := p.period * (previous - limit + current + 1) / previous
+	return max(needed-elapsed, 0)
+}
+
+func (w *slidingWindow) rotate(now int64, p *policy) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(now, p)
+	return w.previous != 0 || w.current != 0
+}
+
+// tokenBucket implements the bucket as the generic cell rate algorithm: instead of the number of tokens
+// it keeps the time the bucket becomes full again, so a request is a single compare-and-swap. A request
+// takes as many tokens as its cost, the cost above the burst always exceeds the limit.
+type tokenBucket struct {
+	full atomic.Int64 // Time the bucket is full, nanoseconds
+}
+
+// interval returns the time of refilling a single token.
+func (p *policy) interval() int64 {
+	return max(p.period/int64(max(p.limit, 1)), 1)
+}
+
+func (b *tokenBucket) add(now int64, cost uint32, p *policy) bool {
+	interval := p.interval()
+	capacity := interval * int64(p.burst)
+	for {
+		full := b.full.Load()
+		next := max(full, now) + interval*int64(cost)
+		if next-now > capacity {
+			return true
+		}
+		if b.full.CompareAndSwap(full, next) {
+			return false
+		}
+	}
+}
+
+func (b *tokenBucket) count(now int64, p *policy) uint32 {
+	interval := p.interval()
+	used := max(b.full.Load()-now, 0)
+	return uint32((used + interval - 1) / interval)
+}
+
+func (b *tokenBucket) retryAfter(now int64, p *policy) int64 {
+	interval := p.interval()
+	return max(b.full.Load()-now-interval*int64(p.burst)+interval, 0)
+}
+
+func (b *tokenBucket) rotate(now int64, _ *policy) bool {
+	return b.full.Load() > now
+}
@@ -0,0 +1,96 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addAll adds n requests at now and returns the number of exceeding requests.
+func addAll(r rate, p *policy, now int64, n int) (exceeded int) {
+	for range n {
+		if r.add(now, 1, p) {
+			exceeded++
+		}
+	}
+	return
+}
+
+// TestFixedWindow verifies that the counters are reset on the rotation after the end of the window.
+func TestFixedWindow(t *testing.T) {
+	second := int64(time.Second)
+	p := newPolicy(AlgorithmFixedWindow, ActionDeny, 3, 0, time.Second)
+	r := p.newRate(0)
+	assert.Equal(t, 2, addAll(r, &p, 0, 5))
+	assert.Equal(t, uint32(5), r.count(0, &p))
+	assert.True(t, r.rotate(second/2, &p))
+	assert.False(t, r.rotate(second, &p))
+
+	p = newPolicy(AlgorithmFixedWindow, ActionDeny, 100, 0, time.Minute)
+	r = p.newRate(0)
+	assert.Equal(t, 0, addAll(r, &p, 0, 60))
+	assert.True(t, r.rotate(30*second, &p))
+	assert.Equal(t, 20, addAll(r, &p, 30*second, 60))
+	assert.False(t, r.rotate(60*second, &p))
+}
+
+// TestSlidingWindow verifies that the requests of the previous window are counted by the overlap.
+func TestSlidingWindow(t *testing.T) {
+	second := int64(time.Second)
+	p := newPolicy(AlgorithmSlidingWindow, ActionDeny, 10, 0, time.Second)
+	r := p.newRate(0)
+	// 10 requests at the end of the window are allowed
+	assert.Equal(t, 0, addAll(r, &p, second-1, 10))
+	// A quarter of the next window later the previous requests weigh 7.5
+	assert.Equal(t, uint32(7), r.count(second+second/4, &p))
+	assert.Equal(t, 1, addAll(r, &p, second+second/4, 4))
+	assert.True(t, r.rotate(2*second, &p))
+	// The window boundary does not double the limit
+	assert.Equal(t, uint32(4), r.count(2*second, &p))
+	// Idle clients are forgotten
+	assert.False(t, r.rotate(4*second, &p))
+	assert.Equal(t, uint32(0), r.count(4*second, &p))
+}
+
+// TestTokenBucket verifies the burst and the refill rate.
+func TestTokenBucket(t *testing.T) {
+	second := int64(time.Second)
+	p := newPolicy(AlgorithmTokenBucket, ActionDeny, 10, 20, time.Second)
+	r := p.newRate(0)
+	assert.Equal(t, 5, addAll(r, &p, second, 25))
+	assert.Equal(t, uint32(20), r.count(second, &p))
+	// The token is refilled every 100ms
+	assert.Equal(t, 2, addAll(r, &p, second+second/10, 3))
+	assert.Equal(t, 0, addAll(r, &p, 3*second+second/10, 10))
+	assert.True(t, r.rotate(3*second+second/10, &p))
+	assert.False(t, r.rotate(10*second, &p))
+
+	p = newPolicy(AlgorithmTokenBucket, ActionDeny, 10, 0, time.Second)
+	assert.Equal(t, 1, addAll(p.newRate(0), &p, second, 11))
+}
+
+// TestCost verifies that the cost of a request is counted by every algorithm. The token bucket does not take
+// the tokens of the exceeding request.
+func TestCost(t *testing.T) {
+	counted := map[string]uint32{AlgorithmFixedWindow: 12, AlgorithmSlidingWindow: 12, AlgorithmTokenBucket: 6}
+	for _, algorithm := range algorithms {
+		p := newPolicy(algorithm, ActionDeny, 10, 0, time.Second)
+		r := p.newRate(0)
+		assert.False(t, r.add(0, 6, &p), algorithm)
+		assert.True(t, r.add(0, 6, &p), algorithm)
+		assert.Equal(t, counted[algorithm], r.count(0, &p), algorithm)
+	}
+}
+
+// TestParseAlgorithm verifies the default and unknown algorithms.
+func TestParseAlgorithm(t *testing.T) {
+	algorithm, err := ParseAlgorithm("")
+	assert.NoError(t, err)
+	assert.Equal(t, AlgorithmFixedWindow, algorithm)
+	algorithm, err = ParseAlgorithm("Token_Bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, AlgorithmTokenBucket, algorithm)
+	_, err = ParseAlgorithm("leaky_bucket")
+	assert.Error(t, err)
+}
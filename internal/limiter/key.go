@@ -0,0 +1,139 @@
+package limiter
+
+import (
+	"aegis/internal/matcher"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Key parts
+const (
+	KeyToken       = "token"       // Antibot token
+	KeyIp          = "ip"          // Client address
+	KeySubnet      = "subnet"      // IPv4 /24 or IPv6 /64 network of the client address
+	KeyFingerprint = "fingerprint" // Request fingerprint
+	KeyGlobal      = "global"      // All clients share the counter
+
+	// DefaultKey counts requests by token
+	DefaultKey = KeyToken
+
+	keySeparator = "+"
+)
+
+var keyParts = []string{KeyToken, KeyIp, KeySubnet, KeyFingerprint, KeyGlobal}
+
+// Request describes the counted request.
+type Request struct {
+	Method      string
+	Path        string
+	Attributes  *matcher.Request // Attributes matched with the conditions of the protections, the address is taken from the request
+	Token       string
+	Address     string
+	Fingerprint []byte
+}
+
+// Key selects the request attributes the requests are counted by. Several parts are combined,
+// so "ip+fingerprint" counts requests of every client behind the address separately. Named capture groups
+// of the path pattern are the parts in braces, e.g. "token+{article}" counts requests of every client
+// to every article separately.
+type Key []string
+
+// ParseKey parses the parts joined with "+". Empty string means the default key. The global part
+// cannot be combined with the client parts.
+func ParseKey(s string) (Key, error) {
+	if s == "" {
+		s = DefaultKey
+	}
+	var key Key
+	for _, part := range strings.Split(s, keySeparator) {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if !slices.Contains(keyParts, part) {
+			return nil, fmt.Errorf("unknown key part %q, expected one of %s", part, strings.Join(keyParts, ", "))
+		}
+		if slices.Contains(key, part) {
+			return nil, fmt.Errorf("duplicate key part %q", part)
+		}
+		key = append(key, part)
+	}
+	if len(key) > 1 && slices.Contains(key, KeyGlobal) {
+		return nil, fmt.Errorf("key part %q cannot be combined with other parts", KeyGlobal)
+	}
+	return key, nil
+}
+
+// WithGroups returns the key extended with the named capture groups of the path pattern.
+func (k Key) WithGroups(re *regexp.Regexp) Key {
+	extended := k
+	for _, name := range re.SubexpNames() {
+		if part := "{" + name + "}"; name != "" && !slices.Contains(extended, part) {
+			extended = append(slices.Clip(extended), part)
+		}
+	}
+	return extended
+}
+
+// HasClient returns true if the key includes a client part, so the action may target the client.
+func (k Key) HasClient() bool {
+	return !slices.Equal(k, Key{KeyGlobal})
+}
+
+// String returns the parts joined with "+".
+func (k Key) String() string {
+	return strings.Join(k, keySeparator)
+}
+
+// HasToken returns true if the key includes the token, such keys are counted only for valid tokens.
+func (k Key) HasToken() bool {
+	return slices.Contains(k, KeyToken)
+}
+
+// Value returns the counter key of the request with the values of the named capture groups of the path.
+// Returns false if the request has no token and the key includes the token.
+func (k Key) Value(r *Request, groups map[string]string) (string, bool) {
+	if len(k) == 1 && k[0] == KeyToken {
+		return r.Token, r.Token != ""
+	}
+	var b strings.Builder
+	for i, part := range k {
+		if i > 0 {
+			b.WriteString(keySeparator)
+		}
+		switch part {
+		case KeyToken:
+			if r.Token == "" {
+				return "", false
+			}
+			b.WriteString(r.Token)
+		case KeyIp:
+			b.WriteString(r.Address)
+		case KeySubnet:
+			b.WriteString(Subnet(r.Address))
+		case KeyFingerprint:
+			b.WriteString(hex.EncodeToString(r.Fingerprint))
+		case KeyGlobal:
+			b.WriteString("*")
+		default:
+			b.WriteString(groups[part[1:len(part)-1]])
+		}
+	}
+	return b.String(), true
+}
+
+// Subnet returns the IPv4 /24 or IPv6 /64 network of the address. Malformed addresses are returned as is.
+func Subnet(address string) string {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return address
+	}
+	addr = addr.Unmap()
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
@@ -1,11 +1,20 @@
 package limiter
 
 import (
+	"aegis/internal/ban"
+	"aegis/internal/matcher"
 	"aegis/internal/remap"
+	"aegis/internal/strikes"
 	"aegis/internal/usecase"
+	"cmp"
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,159 +24,734 @@ import (
 )
 
 const (
-	MetricRevokeToken = "revoke_token"
+	MetricRevokeToken   = "revoke_token"
+	MetricLimitExceeded = "limit_exceeded"
 )
 
-// limitedCounter tracks request counts for clients with a configured rate limit.
+var (
+	metricRevokeToken = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricRevokeToken,
+		},
+		[]string{"reason", "path", "site"},
+	)
+	metricLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricLimitExceeded,
+		},
+		[]string{"action", "path", "site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricRevokeToken, metricLimitExceeded)
+}
+
+// window is the state of a client for a single limit.
+type window struct {
+	rate     rate
+	exceeded atomic.Bool // The limit is exceeded since the last rotation
+}
+
+// clientCounter counts requests of a single client key for every limit of the endpoint. The token,
+// the address and the fingerprint are taken from the first request of the client, they are the targets
+// of the actions.
+type clientCounter struct {
+	windows     []window
+	token       string
+	address     string
+	fingerprint []byte
+	throttled   atomic.Int64 // Time the throttling ends, nanoseconds
+}
+
+// offender is a client which exceeded a limit with the revoke or challenge action.
+type offender struct {
+	token       string
+	fingerprint []byte
+	address     string
+	action      string
+	duration    time.Duration // Duration of the harder challenge
+}
+
+// banRequest is a client which exceeded a limit with the ban action.
+type banRequest struct {
+	target string
+	path   string
+	policy *policy
+}
+
+// limitedCounter tracks request counts for clients with the configured rate limits.
 type limitedCounter struct {
-	limit   uint32
-	counter map[string]*atomic.Uint32
-	mu      sync.RWMutex
+	method     string // Methods of the protection, e.g. "GET,HEAD" or "*"
+	path       string
+	site       string // Site label of the metrics
+	policies   []policy
+	key        Key
+	monitor    bool                // Actions are reported in the verdict instead of being applied
+	cost       uint32              // Weight of a request of the protection
+	budget     *limitedCounter     // Budget charged with the cost, optional
+	protection *usecase.Protection // Protection of the limits, nil for the budget
+	conditions *matcher.Conditions // Conditions of the protection besides the method and the path
+	counter    map[string]*clientCounter
+	mu         sync.RWMutex
 }
 
-// Increment atomically increases the request count for the specified token.
-func (c *limitedCounter) Increment(token string) {
+// client returns the counter of the client key, the counter is created on the first request.
+func (c *limitedCounter) client(key string, request *Request, now int64) *clientCounter {
 	c.mu.RLock()
-	ctr, exists := c.counter[token]
+	ctr, exists := c.counter[key]
+	c.mu.RUnlock()
 	if exists {
-		c.mu.RUnlock()
-		ctr.Add(1)
-		return
+		return ctr
 	}
-	c.mu.RUnlock()
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if ctr, exists = c.counter[token]; exists {
-		ctr.Add(1)
-		return
+	if ctr, exists = c.counter[key]; exists {
+		return ctr
+	}
+	ctr = &clientCounter{
+		windows:     make([]window, len(c.policies)),
+		token:       request.Token,
+		address:     request.Address,
+		fingerprint: request.Fingerprint,
+	}
+	for i := range c.policies {
+		ctr.windows[i].rate = c.policies[i].newRate(now)
+	}
+	c.counter[key] = ctr
+	return ctr
+}
+
+// banTarget returns the ban target of the client. The network is preferred to the fingerprint
+// and the fingerprint to the token.
+func (c *limitedCounter) banTarget(ctr *clientCounter) string {
+	switch {
+	case slices.Contains(c.key, KeySubnet):
+		return Subnet(ctr.address)
+	case slices.Contains(c.key, KeyIp):
+		return ctr.address
+	case slices.Contains(c.key, KeyFingerprint):
+		return ban.KindFingerprint + ":" + hex.EncodeToString(ctr.fingerprint)
+	}
+	return ban.KindToken + ":" + ctr.token
+}
+
+// Increment counts the request of the cost of the client key at now for every limit and returns the most severe
+// verdict of the exceeded limits. The limits are multiplied by the factor below 1 while they are tightened.
+// Throttled clients are rejected without counting. Logs the first exceeding request of every limit since
+// the last rotation and returns the client to ban on it. Monitored limits only report their actions in the verdict.
+func (c *limitedCounter) Increment(key string, request *Request, now int64, cost uint32, factor float64) (verdict Verdict, toBan *banRequest) {
+	ctr := c.client(key, request, now)
+	if until := ctr.throttled.Load(); until > now {
+		return Verdict{Action: ActionThrottle, RetryAfter: time.Duration(until - now)}, nil
+	}
+	for i := range c.policies {
+		p, w := &c.policies[i], &ctr.windows[i]
+		if factor < 1 {
+			p = p.tightened(factor)
+		}
+		if !w.rate.add(now, cost, p) {
+			continue
+		}
+		first := w.exceeded.CompareAndSwap(false, true)
+		if c.monitor {
+			if first {
+				slog.Info("Monitored limit is exceeded",
+					slog.String("key", c.key.String()),
+					slog.String("client", key),
+					slog.String("algorithm", p.algorithm),
+					slog.String("limit", p.rate().String()),
+					slog.String("action", p.action),
+				)
+			}
+			verdict = verdict.worse(Verdict{Monitored: p.action})
+			continue
+		}
+		if first {
+			slog.Info("Limit is exceeded",
+				slog.String("key", c.key.String()),
+				slog.String("client", key),
+				slog.String("algorithm", p.algorithm),
+				slog.String("limit", p.rate().String()),
+				slog.String("action", p.action),
+			)
+			metricLimitExceeded.WithLabelValues(p.action, c.path, c.site).Inc()
+		}
+		switch p.action {
+		case ActionDeny:
+			verdict = verdict.worse(Verdict{Action: ActionDeny})
+		case ActionReject:
+			verdict = verdict.worse(Verdict{Action: ActionReject, RetryAfter: time.Duration(w.rate.retryAfter(now, p))})
+		case ActionThrottle:
+			ctr.throttled.Store(now + int64(p.duration))
+			verdict = verdict.worse(Verdict{Action: ActionThrottle, RetryAfter: p.duration})
+		case ActionBan:
+			if first {
+				toBan = &banRequest{target: c.banTarget(ctr), path: c.path, policy: p}
+			}
+			verdict = verdict.worse(Verdict{Action: ActionBan, RetryAfter: p.duration})
+		}
+	}
+	return
+}
+
+// rotate resets the exceeded flags and forgets the idle clients. Returns the clients which exceeded
+// a limit with the revoke or challenge action, none for the monitored limits. Must be called under
+// the exclusive lock of the limiter.
+func (c *limitedCounter) rotate(now int64) (offenders []offender) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, ctr := range c.counter {
+		var o *offender
+		active := ctr.throttled.Load() > now
+		for i := range c.policies {
+			p, w := &c.policies[i], &ctr.windows[i]
+			if w.exceeded.Swap(false) && !c.monitor && (p.action == ActionRevoke || p.action == ActionChallenge) {
+				if o == nil {
+					o = &offender{token: ctr.token, fingerprint: ctr.fingerprint, address: ctr.address, action: ActionRevoke}
+				}
+				if p.action == ActionChallenge {
+					o.action, o.duration = ActionChallenge, max(o.duration, p.duration)
+				}
+			}
+			if w.rate.rotate(now, p) {
+				active = true
+			}
+		}
+		if o != nil {
+			offenders = append(offenders, *o)
+		}
+		if !active {
+			delete(c.counter, key)
+		}
+	}
+	return
+}
+
+// sameWindows returns true if the client states of the counter are valid for the policies.
+func (c *limitedCounter) sameWindows(key Key, policies []policy) bool {
+	return c.key.String() == key.String() && slices.EqualFunc(c.policies, policies, func(a, b policy) bool {
+		return a.algorithm == b.algorithm && a.period == b.period
+	})
+}
+
+// snapshot returns the counters of every limit of the clients.
+func (c *limitedCounter) snapshot(now int64) []usecase.EndpointCounters {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var snapshot []usecase.EndpointCounters
+	for i := range c.policies {
+		p := &c.policies[i]
+		counters := usecase.EndpointCounters{
+			Method:    c.method,
+			Path:      c.path,
+			Key:       c.key.String(),
+			Algorithm: p.algorithm,
+			Rate:      p.rate(),
+			Action:    p.action,
+			Site:      c.site,
+			Clients:   map[string]uint32{},
+		}
+		for key, counter := range c.counter {
+			counters.Clients[key] = counter.windows[i].rate.count(now, p)
+		}
+		snapshot = append(snapshot, counters)
 	}
-	ctr = &atomic.Uint32{}
-	c.counter[token] = ctr
-	ctr.Add(1)
+	return snapshot
 }
 
-// RpsLimiter enforces request rate limits per endpoint and revokes tokens for clients exceeding thresholds.
+// newLimitedCounter creates an empty counter of the compiled limits of the site protection charging the budget.
+func newLimitedCounter(site string, protection *usecase.Protection, limit *compiledLimit, budget *limitedCounter) *limitedCounter {
+	return &limitedCounter{
+		method:     strings.ToUpper(protection.Method),
+		path:       protection.Path,
+		site:       site,
+		policies:   limit.policies,
+		key:        limit.key,
+		monitor:    protection.Monitored(),
+		cost:       max(protection.Cost, 1),
+		budget:     budget,
+		protection: protection,
+		conditions: limit.conditions,
+		counter:    make(map[string]*clientCounter),
+	}
+}
+
+// newBudgetCounter creates an empty counter of the limits of the site budget.
+func newBudgetCounter(site string, budget *usecase.Budget, policies []policy, key Key) *limitedCounter {
+	return &limitedCounter{
+		method:   remap.AnyMethod,
+		path:     budget.Name,
+		site:     site,
+		policies: policies,
+		key:      key,
+		monitor:  budget.Monitored(),
+		cost:     1,
+		counter:  make(map[string]*clientCounter),
+	}
+}
+
+// affects returns true if the protection counts the requests or changes the limits applied to them.
+func affects(protection *usecase.Protection, policies []policy, budget *limitedCounter) bool {
+	return len(policies) > 0 || budget != nil || protection.Final || protection.Allows()
+}
+
+// charge is the cost of the request charged to the budget.
+type charge struct {
+	budget *limitedCounter
+	cost   uint32
+}
+
+// RpsLimiter enforces request rate limits per endpoint with the fixed window, sliding window or token bucket
+// algorithm. An endpoint may have several limits with different periods, e.g. per second and per day,
+// and may charge a budget shared with other endpoints by the cost of its requests.
+// Exceeding a limit revokes the token of the client, rejects its requests or bans it depending on the action.
 type RpsLimiter struct {
-	ctx               context.Context
-	endpointCounters  map[string]*remap.ReMap[*limitedCounter]
-	mu                sync.RWMutex
-	tokenManager      usecase.TokenManager
-	metricRevokeToken *prometheus.CounterVec
+	ctx              context.Context
+	site             string
+	endpointCounters *remap.MethodMap[*limitedCounter]
+	limits           []*limitedCounter // Counters of the endpoints in the evaluation order
+	budgets          map[string]*limitedCounter
+	mu               sync.RWMutex
+	tokenManager     usecase.TokenManager
+	bans             *ban.List
+	strikes          *strikes.Tracker
+	factor           atomic.Uint64 // Bits of the float64 multiplier of the limits
+}
+
+// compiledLimit is the compiled path pattern, key, limits and conditions of the protection.
+type compiledLimit struct {
+	endpointRe *regexp.Regexp
+	key        Key
+	policies   []policy
+	conditions *matcher.Conditions
+}
+
+// compileLimit compiles the endpoint path and the conditions, parses the key, the algorithm and the limits
+// of the protection. The named capture groups of the path are added to the key. Limits of the allow rule
+// are ignored.
+func compileLimit(protection usecase.Protection) (limit compiledLimit, err error) {
+	if limit.endpointRe, err = regexp.Compile(protection.Path); err != nil {
+		return
+	}
+	if limit.conditions, err = matcher.Compile(&protection); err != nil {
+		return
+	}
+	limits := protection.RateLimits()
+	if protection.Allows() {
+		limits = nil
+	}
+	if limit.key, limit.policies, err = compilePolicies(protection.Key, protection.Algorithm, limits); err != nil {
+		return
+	}
+	limit.key = limit.key.WithGroups(limit.endpointRe)
+	return
+}
+
+// compileBudget parses the key, the algorithm and the limits of the budget.
+func compileBudget(budget usecase.Budget) (Key, []policy, error) {
+	if len(budget.Limits) == 0 {
+		return nil, nil, errors.New("at least one limit is required")
+	}
+	return compilePolicies(budget.Key, budget.Algorithm, budget.Limits)
 }
 
-// AddLimit configures a rate limit for the specified HTTP endpoint.
+// compilePolicies parses the key, the algorithm and the limits.
+func compilePolicies(keyParts, algorithmName string, limits []usecase.Limit) (Key, []policy, error) {
+	key, err := ParseKey(keyParts)
+	if err != nil {
+		return nil, nil, err
+	}
+	algorithm, err := ParseAlgorithm(algorithmName)
+	if err != nil {
+		return nil, nil, err
+	}
+	var policies []policy
+	for _, limit := range limits {
+		action, err := ParseAction(limit.Action, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("limit %s: %w", limit.Rate, err)
+		}
+		if limit.Rate.Limit == 0 || limit.Rate.Period < time.Second {
+			return nil, nil, fmt.Errorf("limit %s: at least one request per second period is required", limit.Rate)
+		}
+		p := newPolicy(algorithm, action, limit.Rate.Limit, limit.Burst, limit.Rate.Period)
+		p.duration, p.maxDuration = limit.Duration.Duration(), limit.MaxDuration.Duration()
+		switch action {
+		case ActionThrottle:
+			p.duration = cmp.Or(p.duration, DefaultThrottleDuration)
+		case ActionChallenge:
+			p.duration = cmp.Or(p.duration, DefaultChallengeDuration)
+		case ActionBan:
+			p.duration = cmp.Or(p.duration, DefaultBanDuration)
+			p.maxDuration = max(cmp.Or(p.maxDuration, DefaultBanMaxDuration), p.duration)
+		}
+		policies = append(policies, p)
+	}
+	return key, policies, nil
+}
+
+// AddBudget configures the budget shared by the protections. Budgets are added before the protections
+// charging them.
+func (rl *RpsLimiter) AddBudget(budget usecase.Budget) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	key, policies, err := compileBudget(budget)
+	if err != nil {
+		slog.Error("Failed to add budget", slog.String("budget", budget.Name), slog.String("error", err.Error()))
+		return
+	}
+	rl.budgets[budget.Name] = newBudgetCounter(rl.site, &budget, policies, key)
+}
+
+// AddLimit configures the rate limits of the specified HTTP endpoint. Limits are evaluated in the order
+// they are added.
 //
 // Parameters:
-//   - limit: Protection rule containing path, method, and RPS limit.
+//   - limit: Protection rule containing path, method, RPS limit, other limits, key and algorithm.
 //
 // Behavior:
-// 1. Compiles the endpoint path into a regex pattern.
-// 2. Associates the regex with a limitedCounter for the HTTP method.
-// 3. Logs errors if regex compilation fails.
+// 1. Compiles the endpoint path into a regex pattern, parses the key, the algorithm and the limits.
+// 2. Associates the regex with a limitedCounter for the HTTP method charging the budget of the protection.
+// 3. Logs errors if the limit is invalid or the budget is unknown.
 func (rl *RpsLimiter) AddLimit(limit usecase.Protection) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 	method := strings.ToUpper(limit.Method)
-	endpointRe, err := regexp.Compile(limit.Path)
+	limit.Method = method
+	compiled, err := compileLimit(limit)
 	if err != nil {
-		slog.Error("Failed to compile regexp",
+		slog.Error("Failed to add limit",
 			slog.String("method", method),
 			slog.String("path", limit.Path),
 			slog.String("error", err.Error()),
 		)
 		return
 	}
-	counters, found := rl.endpointCounters[method]
-	if !found {
-		counters = remap.NewReMap[*limitedCounter]()
-		rl.endpointCounters[limit.Method] = counters
+	var budget *limitedCounter
+	if limit.Budget != "" {
+		if budget = rl.budgets[limit.Budget]; budget == nil {
+			slog.Error("Failed to add limit",
+				slog.String("method", method),
+				slog.String("path", limit.Path),
+				slog.String("error", "unknown budget "+limit.Budget),
+			)
+			return
+		}
+	}
+	if !affects(&limit, compiled.policies, budget) {
+		return
 	}
-	counters.Put(endpointRe, &limitedCounter{limit: limit.Limit, counter: make(map[string]*atomic.Uint32)})
+	counter := newLimitedCounter(rl.site, &limit, &compiled, budget)
+	rl.endpointCounters.Put(limit.Methods(), compiled.endpointRe, counter)
+	rl.limits = append(rl.limits, counter)
 }
 
-// Count increments the request counter for the specified client token and endpoint.
+// SetLimits atomically replaces all rate limits and budgets, the limits are evaluated in the given order.
+// Counters of the endpoints which keep their pattern, key, algorithm and limit periods are preserved, also when
+// the mode is changed, so are the counters of the budgets keeping their name, key, algorithm and limit periods.
+// The limits are not changed if any limit is invalid.
 //
 // Parameters:
-//   - token: Unique identifier for the client.
-//   - path: Requested URL path.
-//   - method: HTTP method (e.g., "GET", "POST").
+//   - limits: Protection rules containing path, method, RPS limit, other limits, key, algorithm and budget.
+//   - budgets: Budgets charged by the protections.
 //
-// Thread-safety: Uses read locks to minimize contention while accessing shared counters.
-func (rl *RpsLimiter) Count(
-	token string,
-	path string,
-	method string,
+// Returns:
+//   - error: Non-nil if a path pattern fails to compile, a key, an algorithm or an action is invalid,
+//     a budget is unknown.
+func (rl *RpsLimiter) SetLimits(limits []usecase.Protection, budgets []usecase.Budget) error {
+	publish, err := rl.PrepareLimits(limits, budgets)
+	if err != nil {
+		return err
+	}
+	publish()
+	return nil
+}
+
+// PrepareLimits compiles the rate limits and the budgets without applying them. The returned function replaces
+// the running limits like SetLimits, it does not fail so the limits can be published together with other changes.
+//
+// Parameters:
+//   - limits: Protection rules containing path, method, RPS limit, other limits, key, algorithm and budget.
+//   - budgets: Budgets charged by the protections.
+//
+// Returns:
+//   - func(): Function replacing the running limits with the compiled ones.
+//   - error: Non-nil if a path pattern fails to compile, a key, an algorithm or an action is invalid,
+//     a budget is unknown.
+func (rl *RpsLimiter) PrepareLimits(limits []usecase.Protection, budgets []usecase.Budget) (func(), error) {
+	budgetKeys := map[string]Key{}
+	budgetPolicies := map[string][]policy{}
+	compiled := make([]compiledLimit, len(limits))
+	var errs []error
+	for _, budget := range budgets {
+		key, budgetPolicy, err := compileBudget(budget)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("budget %s: %w", budget.Name, err))
+			continue
+		}
+		budgetKeys[budget.Name], budgetPolicies[budget.Name] = key, budgetPolicy
+	}
+	for i, limit := range limits {
+		var err error
+		if compiled[i], err = compileLimit(limit); err != nil {
+			errs = append(errs, fmt.Errorf("limit %s %s: %w", limit.Method, limit.Path, err))
+		} else if _, found := budgetPolicies[limit.Budget]; limit.Budget != "" && !found {
+			errs = append(errs, fmt.Errorf("limit %s %s: unknown budget %s", limit.Method, limit.Path, limit.Budget))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return func() { rl.publish(limits, budgets, compiled, budgetKeys, budgetPolicies) }, nil
+}
+
+// publish replaces the running limits and budgets with the compiled ones preserving the counters.
+func (rl *RpsLimiter) publish(
+	limits []usecase.Protection,
+	budgets []usecase.Budget,
+	compiled []compiledLimit,
+	budgetKeys map[string]Key,
+	budgetPolicies map[string][]policy,
 ) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	budgetCounters := map[string]*limitedCounter{}
+	for _, budget := range budgets {
+		counter := newBudgetCounter(rl.site, &budget, budgetPolicies[budget.Name], budgetKeys[budget.Name])
+		if previous, found := rl.budgets[budget.Name]; found && previous.sameWindows(counter.key, counter.policies) {
+			counter.counter = previous.counter
+		}
+		budgetCounters[budget.Name] = counter
+	}
+	endpointCounters := remap.NewMethodMap[*limitedCounter]()
+	var counters []*limitedCounter
+	preserved := map[*limitedCounter]struct{}{}
+	for i, limit := range limits {
+		budget := budgetCounters[limit.Budget]
+		if !affects(&limit, compiled[i].policies, budget) {
+			continue
+		}
+		limit.Method = strings.ToUpper(limit.Method)
+		counter := newLimitedCounter(rl.site, &limit, &compiled[i], budget)
+		for _, previous := range rl.limits {
+			_, exists := preserved[previous]
+			if !exists && previous.method == counter.method && previous.path == limit.Path &&
+				previous.sameWindows(counter.key, counter.policies) {
+				counter.counter = previous.counter
+				preserved[previous] = struct{}{}
+				break
+			}
+		}
+		endpointCounters.Put(limit.Methods(), compiled[i].endpointRe, counter)
+		counters = append(counters, counter)
+	}
+	rl.endpointCounters = endpointCounters
+	rl.limits = counters
+	rl.budgets = budgetCounters
+}
+
+// increment increments the counters of the applied endpoint limits and the budgets keyed with or without the token.
+// Every budget is charged once with the highest cost of the matching protections, enforced budgets are not
+// charged by the monitored protections. Returns the most severe verdict and the clients to ban.
+func (rl *RpsLimiter) increment(request *Request, withToken bool) (verdict Verdict, bans []*banRequest) {
 	rl.mu.RLock()
 	defer rl.mu.RUnlock()
-	method = strings.ToUpper(method)
-	endpointCounters, found := rl.endpointCounters[method]
+	endpointCounters, found := rl.endpointCounters.Get(strings.ToUpper(request.Method))
 	if !found {
 		return
 	}
-	if counters, found := endpointCounters.Find(path); found {
-		for _, counter := range counters {
-			counter.Increment(token)
+	var matchesBuf [8]remap.Match[*limitedCounter]
+	var attributes matcher.Request
+	if request.Attributes != nil {
+		attributes = *request.Attributes
+	}
+	attributes.Address = request.Address
+	matches := slices.DeleteFunc(endpointCounters.AppendMatches(matchesBuf[:0], request.Path),
+		func(match remap.Match[*limitedCounter]) bool { return !match.Value.conditions.Match(&attributes) },
+	)
+	matches, _ = usecase.Applied(matches,
+		func(match remap.Match[*limitedCounter]) *usecase.Protection { return match.Value.protection },
+	)
+	now := time.Now().UnixNano()
+	factor := math.Float64frombits(rl.factor.Load())
+	apply := func(counter *limitedCounter, cost uint32, groups map[string]string) {
+		if len(counter.policies) == 0 || counter.key.HasToken() != withToken {
+			return
+		}
+		key, ok := counter.key.Value(request, groups)
+		if !ok {
+			return
+		}
+		v, toBan := counter.Increment(key, request, now, cost, factor)
+		verdict = verdict.worse(v)
+		if toBan != nil {
+			bans = append(bans, toBan)
 		}
 	}
+	var chargesBuf [4]charge
+	charges := chargesBuf[:0]
+	for _, match := range matches {
+		counter := match.Value
+		apply(counter, counter.cost, match.Groups)
+		if b := counter.budget; b != nil && (b.monitor || !counter.monitor) {
+			i := slices.IndexFunc(charges, func(c charge) bool { return c.budget == b })
+			if i < 0 {
+				charges = append(charges, charge{budget: b, cost: counter.cost})
+			} else {
+				charges[i].cost = max(charges[i].cost, counter.cost)
+			}
+		}
+	}
+	for _, c := range charges {
+		apply(c.budget, c.cost, nil)
+	}
+	return
+}
+
+// count increments the counters and bans the clients exceeding the limits with the ban action.
+func (rl *RpsLimiter) count(request *Request, withToken bool) Verdict {
+	verdict, bans := rl.increment(request, withToken)
+	for _, request := range bans {
+		if rl.bans == nil {
+			slog.Error("Ban list is not available", slog.String("target", request.target))
+			continue
+		}
+		reason := "limit " + request.policy.rate().String() + " is exceeded on " + request.path
+		b, err := rl.bans.Escalate(request.target, request.policy.duration, request.policy.maxDuration, reason)
+		if err != nil {
+			slog.Error("Failed to ban", slog.String("target", request.target), slog.String("error", err.Error()))
+			continue
+		}
+		slog.Info("Banned",
+			slog.String("target", b.Target),
+			slog.Int("offences", b.Offences),
+			slog.Time("expires", b.Expires),
+		)
+		verdict.RetryAfter = max(verdict.RetryAfter, time.Until(b.Expires))
+	}
+	return verdict
 }
 
-// revokeByLimits revokes tokens for clients exceeding configured request rate limits.
-// This method is typically executed periodically in a background goroutine.
+// Check increments the request counters of the limits keyed without the token, e.g. by the client address.
+// It is called before the token validation, so requests without a valid token are counted too.
 //
 // Parameters:
-//   - tokenCounters: A pointer to a limitedCounter containing client token usage statistics.
+//   - request: Counted request.
 //
 // Returns:
-//   - uint64: Number of tokens successfully revoked during this invocation.
-//
-// Functionality:
-// 1. Iterates through all tracked tokens in tokenCounters.
-// 2. For each token, compares current request count against the configured limit.
-// 3. Revokes tokens where usage exceeds the threshold via tokenManager.Revoke().
-// 4. Logs debug information for each revoked token including:
-//   - Token identifier
-//   - Current request rate (rps)
-//   - Configured rate limit
-func (rl *RpsLimiter) revokeByLimits(tokenCounters *limitedCounter) (revoked uint64) {
-	for token, counter := range tokenCounters.counter {
-		c := counter.Load()
-		if c > tokenCounters.limit {
-			slog.Info("Revoke",
-				slog.String("token", token),
-				slog.Uint64("rps", uint64(counter.Load())),
-				slog.Uint64("limit", uint64(tokenCounters.limit)),
-			)
-			rl.tokenManager.Revoke(token)
-			revoked++
+//   - Verdict: Action of the exceeded limit rejecting the request, e.g. deny or reject with Retry-After.
+//
+// Thread-safety: Uses read locks to minimize contention while accessing shared counters.
+func (rl *RpsLimiter) Check(request *Request) Verdict {
+	return rl.count(request, false)
+}
+
+// Count increments the request counters of the limits keyed with the token. It is called after
+// the token validation, tokens of the clients exceeding the limits with the revoke and challenge actions
+// are revoked on the counters rotation.
+//
+// Parameters:
+//   - request: Counted request with the valid token.
+//
+// Returns:
+//   - Verdict: Action of the exceeded limit rejecting the request, e.g. deny or reject with Retry-After.
+//
+// Thread-safety: Uses read locks to minimize contention while accessing shared counters.
+func (rl *RpsLimiter) Count(request *Request) Verdict {
+	return rl.count(request, true)
+}
+
+// Counters returns a snapshot of the request counters of every limit: requests of the current window
+// of the fixed window, weighted requests of the sliding window and used tokens of the token bucket.
+// Budgets are listed with the method "*" and their name as the path, they count the costs.
+//
+// Returns:
+//   - []usecase.EndpointCounters: Counters of every limit, sorted by method, path and period.
+func (rl *RpsLimiter) Counters() []usecase.EndpointCounters {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	snapshot := []usecase.EndpointCounters{}
+	now := time.Now().UnixNano()
+	for _, tokensCounters := range rl.limits {
+		snapshot = append(snapshot, tokensCounters.snapshot(now)...)
+	}
+	for name, budget := range rl.budgets {
+		counters := budget.snapshot(now)
+		for i := range counters {
+			counters[i].Budget = name
+		}
+		snapshot = append(snapshot, counters...)
+	}
+	slices.SortFunc(snapshot, func(a, b usecase.EndpointCounters) int {
+		return cmp.Or(
+			cmp.Compare(a.Method, b.Method),
+			cmp.Compare(a.Path, b.Path),
+			cmp.Compare(a.Rate.Period, b.Rate.Period),
+			cmp.Compare(a.Rate.Limit, b.Rate.Limit),
+		)
+	})
+	return snapshot
+}
+
+// revokeByLimits revokes tokens of the clients exceeding configured request rate limits and makes
+// the challenges harder for the clients exceeding the limits with the challenge action.
+// This method is typically executed in a background goroutine after the rotation.
+//
+// Parameters:
+//   - offenders: Clients which exceeded the limits.
+//   - path: Path pattern of the exceeded limits.
+func (rl *RpsLimiter) revokeByLimits(offenders []offender, path string) {
+	for _, o := range offenders {
+		slog.Info("Revoke",
+			slog.String("token", o.token),
+			slog.String("path", path),
+			slog.String("action", o.action),
+		)
+		rl.tokenManager.Revoke(o.token)
+		reason := "rps"
+		if o.action == ActionChallenge {
+			reason = ActionChallenge
+			if escalator, ok := rl.tokenManager.(usecase.ChallengeEscalator); ok {
+				if err := escalator.Escalate(o.fingerprint, o.duration); err != nil {
+					slog.Error("Failed to escalate challenge", slog.String("error", err.Error()))
+				}
+			}
+		}
+		metricRevokeToken.WithLabelValues(reason, path, rl.site).Inc()
+		if rl.strikes != nil {
+			rl.strikes.Strike(o.fingerprint, o.address, strikes.ReasonLimit)
 		}
 	}
-	return
 }
 
 // update rotates endpoint counters and revokes tokens for clients exceeding limits.
 //
 // Behavior:
-// 1. Replaces old counters with new empty instances to reset tracking.
-// 2. Launches a goroutine to revoke tokens for the previous counters.
+// 1. Rotates the counters: fixed windows are reset, idle clients are forgotten.
+// 2. Launches a goroutine to revoke tokens of the clients which exceeded the limits.
 // 3. Updates Prometheus metrics with the number of revoked tokens.
 func (rl *RpsLimiter) update() {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
-	for method, methodCounters := range rl.endpointCounters {
-		replacementMethodCounters := remap.NewReMap[*limitedCounter]()
-		rl.endpointCounters[method] = replacementMethodCounters
-		endpointCounters := methodCounters.Entries()
-		for endpointRe, tokensCounters := range endpointCounters {
-			go func() {
-				revoked := rl.revokeByLimits(tokensCounters)
-				rl.metricRevokeToken.WithLabelValues("rps", endpointRe.String()).Add(float64(revoked))
-			}()
-			replacementMethodCounters.Put(endpointRe, &limitedCounter{limit: tokensCounters.limit, counter: make(map[string]*atomic.Uint32)})
+	now := time.Now().UnixNano()
+	for _, tokensCounters := range rl.limits {
+		if offenders := tokensCounters.rotate(now); len(offenders) > 0 {
+			go rl.revokeByLimits(offenders, tokensCounters.path)
+		}
+	}
+	for name, budget := range rl.budgets {
+		if offenders := budget.rotate(now); len(offenders) > 0 {
+			go rl.revokeByLimits(offenders, name)
 		}
 	}
 }
 
+// Tighten multiplies the limits of all clients by the factor, e.g. 0.5 halves them. Factor 1 restores the limits.
+func (rl *RpsLimiter) Tighten(factor float64) {
+	rl.factor.Store(math.Float64bits(factor))
+}
+
 // Serve runs a periodic task to update counters and revoke tokens.
 //
 // This method blocks until the provided context is canceled.
@@ -184,26 +768,27 @@ func (rl *RpsLimiter) Serve() {
 	}
 }
 
-// NewRpsLimiter creates a new RpsLimiter instance with Prometheus metrics integration.
+// NewRpsLimiter creates a new RpsLimiter instance. Revoked tokens are counted by the shared metric.
 //
 // Parameters:
 //   - ctx: Context for lifecycle management.
+//   - site: Name of the site of the limits, the site label of the metrics.
 //   - tokenManager: Token manager used to revoke client tokens.
+//   - bans: Ban list of the clients exceeding the limits with the ban action.
+//   - tracker: Tracker of the repeat offenders striking on every revocation, optional.
 //
 // Returns:
-//   - *RpsLimiter: Initialized rate limiter with metrics registration.
-func NewRpsLimiter(ctx context.Context, tokenManager usecase.TokenManager) *RpsLimiter {
+//   - *RpsLimiter: Initialized rate limiter.
+func NewRpsLimiter(ctx context.Context, site string, tokenManager usecase.TokenManager, bans *ban.List, tracker *strikes.Tracker) *RpsLimiter {
 	rl := RpsLimiter{
 		ctx:              ctx,
-		endpointCounters: map[string]*remap.ReMap[*limitedCounter]{},
+		site:             site,
+		endpointCounters: remap.NewMethodMap[*limitedCounter](),
+		budgets:          map[string]*limitedCounter{},
 		tokenManager:     tokenManager,
+		bans:             bans,
+		strikes:          tracker,
 	}
-	rl.metricRevokeToken = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: MetricRevokeToken,
-		},
-		[]string{"reason", "path"},
-	)
-	prometheus.MustRegister(rl.metricRevokeToken)
+	rl.Tighten(1)
 	return &rl
 }
@@ -0,0 +1,337 @@
+package limiter_test
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/limiter"
+	"aegis/internal/matcher"
+	"aegis/internal/store"
+	"aegis/internal/usecase"
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseKey verifies parsing of the combined keys.
+func TestParseKey(t *testing.T) {
+	key, err := limiter.ParseKey("")
+	assert.NoError(t, err)
+	assert.Equal(t, limiter.Key{limiter.KeyToken}, key)
+	key, err = limiter.ParseKey("subnet+Fingerprint")
+	assert.NoError(t, err)
+	assert.Equal(t, "subnet+fingerprint", key.String())
+	assert.False(t, key.HasToken())
+	_, err = limiter.ParseKey("ip+cookie")
+	assert.Error(t, err)
+	_, err = limiter.ParseKey("ip+ip")
+	assert.Error(t, err)
+	_, err = limiter.ParseKey("global+ip")
+	assert.Error(t, err)
+	key, _ = limiter.ParseKey("token")
+	key = key.WithGroups(regexp.MustCompile(`^/api/(?P<article>\d+)/(\w+)/(?P<page>\d+)$`))
+	assert.Equal(t, "token+{article}+{page}", key.String())
+}
+
+// TestKeyValue verifies the counter keys of the requests.
+func TestKeyValue(t *testing.T) {
+	request := limiter.Request{Address: "192.0.2.10", Fingerprint: []byte{0xab, 0xcd}}
+	key, _ := limiter.ParseKey("subnet+fingerprint")
+	value, ok := key.Value(&request, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "192.0.2.0/24+abcd", value)
+
+	key, _ = limiter.ParseKey("token+ip")
+	_, ok = key.Value(&request, nil)
+	assert.False(t, ok)
+	request.Token = "t"
+	value, _ = key.Value(&request, nil)
+	assert.Equal(t, "t+192.0.2.10", value)
+
+	key, _ = limiter.ParseKey("global")
+	key = key.WithGroups(regexp.MustCompile(`^/articles/(?P<article>\d+)$`))
+	value, _ = key.Value(&request, map[string]string{"article": "42"})
+	assert.Equal(t, "*+42", value)
+
+	assert.Equal(t, "2001:db8:0:1::/64", limiter.Subnet("2001:db8:0:1:2:3:4:5"))
+	assert.Equal(t, "unknown", limiter.Subnet("unknown"))
+}
+
+// TestCheck verifies that limits keyed by the address reject requests without tokens.
+func TestCheck(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/api/", Method: "GET", Limit: 2, Key: "subnet"},
+		{Path: "^/api/", Method: "GET", Limit: 1, Key: "token"},
+	}, nil))
+	first := limiter.Request{Method: "GET", Path: "/api/items", Address: "192.0.2.1"}
+	second := limiter.Request{Method: "GET", Path: "/api/items", Address: "192.0.2.2"}
+	other := limiter.Request{Method: "GET", Path: "/api/items", Address: "198.51.100.1"}
+
+	assert.True(t, rl.Check(&first).Allowed())
+	assert.True(t, rl.Check(&second).Allowed())
+	assert.False(t, rl.Check(&first).Allowed())
+	assert.True(t, rl.Check(&other).Allowed())
+	assert.True(t, rl.Check(&limiter.Request{Method: "POST", Path: "/api/items", Address: "192.0.2.1"}).Allowed())
+
+	// Token limits are not checked before the validation
+	first.Token = "token"
+	rl.Count(&first)
+	rl.Count(&first)
+	counters := rl.Counters()
+	assert.Len(t, counters, 2)
+	for _, c := range counters {
+		if c.Key == "token" {
+			assert.Equal(t, map[string]uint32{"token": 2}, c.Clients)
+		} else {
+			assert.Equal(t, map[string]uint32{"192.0.2.0/24": 3, "198.51.100.0/24": 1}, c.Clients)
+		}
+	}
+}
+
+// benchmarkCount measures Count of a single endpoint by parallel clients.
+func benchmarkCount(b *testing.B, algorithm string, clients int) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(b, rl.SetLimits([]usecase.Protection{
+		{Path: "^/api/", Method: "GET", Limit: 1000, Key: "token", Algorithm: algorithm},
+	}, nil))
+	requests := make([]limiter.Request, clients)
+	for i := range requests {
+		requests[i] = limiter.Request{Method: "GET", Path: "/api/items", Token: fmt.Sprintf("token-%d", i)}
+	}
+	var next atomic.Uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		request := &requests[int(next.Add(1))%clients]
+		for pb.Next() {
+			rl.Count(request)
+		}
+	})
+}
+
+func BenchmarkCount(b *testing.B) {
+	for _, algorithm := range []string{limiter.AlgorithmFixedWindow, limiter.AlgorithmSlidingWindow, limiter.AlgorithmTokenBucket} {
+		b.Run(algorithm+"/single_client", func(b *testing.B) {
+			benchmarkCount(b, algorithm, 1)
+		})
+		b.Run(algorithm+"/many_clients", func(b *testing.B) {
+			benchmarkCount(b, algorithm, 1024)
+		})
+	}
+}
+
+// TestLimits verifies that every limit of the endpoint applies its own action.
+func TestLimits(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/export$", Method: "GET", Key: "token", Algorithm: "token_bucket", Limit: 2, Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 3, Period: time.Hour}, Action: "deny"},
+		}},
+	}, nil))
+	request := limiter.Request{Method: "GET", Path: "/export", Token: "token"}
+	// The RPS limit revokes the token on the rotation, the hourly limit denies requests
+	assert.True(t, rl.Count(&request).Allowed())
+	assert.True(t, rl.Count(&request).Allowed())
+	assert.True(t, rl.Count(&request).Allowed())
+	assert.False(t, rl.Count(&request).Allowed())
+
+	counters := rl.Counters()
+	assert.Len(t, counters, 2)
+	assert.Equal(t, "2/s", counters[0].Rate.String())
+	assert.Equal(t, "revoke", counters[0].Action)
+	assert.Equal(t, "3/h", counters[1].Rate.String())
+	assert.Equal(t, "deny", counters[1].Action)
+	assert.Equal(t, map[string]uint32{"token": 3}, counters[1].Clients)
+
+	err := rl.SetLimits([]usecase.Protection{
+		{Path: "^/export$", Method: "GET", Key: "ip", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 3, Period: time.Hour}, Action: "revoke"},
+		}},
+	}, nil)
+	assert.ErrorContains(t, err, "action revoke requires the key including token")
+}
+
+// TestActions verifies the verdicts of the reject, throttle and ban actions.
+func TestActions(t *testing.T) {
+	bans, err := ban.NewList(store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, bans, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/search$", Method: "GET", Key: "ip", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 1, Period: time.Minute}, Action: "reject"},
+		}},
+		{Path: "^/feed$", Method: "GET", Key: "ip", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 1, Period: time.Hour}, Action: "throttle", Duration: usecase.Duration(time.Hour)},
+		}},
+		{Path: "^/login$", Method: "POST", Key: "subnet", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 1, Period: time.Hour}, Action: "ban", Duration: usecase.Duration(time.Minute)},
+		}},
+	}, nil))
+
+	search := limiter.Request{Method: "GET", Path: "/search", Address: "192.0.2.1"}
+	assert.True(t, rl.Check(&search).Allowed())
+	verdict := rl.Check(&search)
+	assert.Equal(t, limiter.ActionReject, verdict.Action)
+	assert.True(t, verdict.RetryAfter > 0 && verdict.RetryAfter <= time.Minute)
+
+	feed := limiter.Request{Method: "GET", Path: "/feed", Address: "192.0.2.1"}
+	assert.True(t, rl.Check(&feed).Allowed())
+	assert.Equal(t, limiter.Verdict{Action: limiter.ActionThrottle, RetryAfter: time.Hour}, rl.Check(&feed))
+	verdict = rl.Check(&feed)
+	assert.Equal(t, limiter.ActionThrottle, verdict.Action)
+	assert.True(t, verdict.RetryAfter > 59*time.Minute && verdict.RetryAfter < time.Hour)
+
+	login := limiter.Request{Method: "POST", Path: "/login", Address: "192.0.2.1"}
+	assert.True(t, rl.Check(&login).Allowed())
+	verdict = rl.Check(&login)
+	assert.Equal(t, limiter.ActionBan, verdict.Action)
+	b, banned := bans.Banned("192.0.2.200")
+	assert.True(t, banned)
+	assert.Equal(t, "192.0.2.0/24", b.Target)
+	assert.Equal(t, 1, b.Offences)
+}
+
+// TestTighten verifies that the tightened limits are multiplied by the factor.
+func TestTighten(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/search$", Method: "GET", Key: "ip", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 4, Period: time.Hour}, Action: "deny"},
+		}},
+	}, nil))
+	rl.Tighten(0.5)
+	request := limiter.Request{Method: "GET", Path: "/search", Address: "192.0.2.1"}
+	assert.True(t, rl.Check(&request).Allowed())
+	assert.True(t, rl.Check(&request).Allowed())
+	assert.False(t, rl.Check(&request).Allowed())
+	rl.Tighten(1)
+	assert.True(t, rl.Check(&request).Allowed())
+}
+
+// TestBudget verifies that the budget is charged once per request with the cost of the protections.
+func TestBudget(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	budgets := []usecase.Budget{{Name: "api", Key: "ip", Limits: []usecase.Limit{
+		{Rate: usecase.Rate{Limit: 101, Period: time.Minute}, Action: "reject"},
+	}}}
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/api/", Method: "GET", Key: "ip", Cost: 1, Budget: "api"},
+		{Path: "^/api/search$", Method: "GET", Key: "ip", Cost: 50, Budget: "api"},
+		{Path: "^/api/export$", Method: "GET", Key: "ip", Limit: 1, Cost: 2, Budget: "api"},
+	}, budgets))
+	page := limiter.Request{Method: "GET", Path: "/api/items", Address: "192.0.2.1"}
+	search := limiter.Request{Method: "GET", Path: "/api/search", Address: "192.0.2.1"}
+	assert.True(t, rl.Check(&page).Allowed())
+	assert.True(t, rl.Check(&search).Allowed())
+	assert.True(t, rl.Check(&search).Allowed(), "the search is charged 50, not 51")
+	assert.Equal(t, limiter.ActionReject, rl.Check(&page).Action)
+	assert.True(t, rl.Check(&limiter.Request{Method: "GET", Path: "/api/items", Address: "192.0.2.2"}).Allowed())
+
+	// The cost weighs the limits of the protection too
+	export := limiter.Request{Method: "GET", Path: "/api/export", Address: "198.51.100.1"}
+	assert.Equal(t, limiter.ActionDeny, rl.Check(&export).Action)
+
+	var budget []usecase.EndpointCounters
+	for _, c := range rl.Counters() {
+		if c.Budget != "" {
+			budget = append(budget, c)
+		}
+	}
+	assert.Len(t, budget, 1)
+	assert.Equal(t, "*", budget[0].Method)
+	assert.Equal(t, map[string]uint32{"192.0.2.1": 102, "192.0.2.2": 1, "198.51.100.1": 2}, budget[0].Clients)
+
+	err := rl.SetLimits([]usecase.Protection{{Path: "^/api/", Method: "GET", Budget: "unknown"}}, budgets)
+	assert.ErrorContains(t, err, "unknown budget unknown")
+}
+
+// TestGroupKeys verifies the limits per client and per article across all clients.
+func TestGroupKeys(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: `^/api/articles/(?P<article>\d+)/comments$`, Method: "POST", Key: "ip", Limit: 2},
+		{Path: `^/api/articles/(?P<article>\d+)/comments$`, Method: "POST", Key: "global", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 3, Period: time.Minute}, Action: "reject"},
+		}},
+	}, nil))
+	comment := func(address, article string) limiter.Verdict {
+		return rl.Check(&limiter.Request{Method: "POST", Path: "/api/articles/" + article + "/comments", Address: address})
+	}
+	assert.True(t, comment("192.0.2.1", "1").Allowed())
+	assert.True(t, comment("192.0.2.1", "1").Allowed())
+	assert.Equal(t, limiter.ActionDeny, comment("192.0.2.1", "1").Action)
+	// Other articles of the client are counted separately
+	assert.True(t, comment("192.0.2.1", "2").Allowed())
+	// The fourth comment to the article by any client exceeds the global limit
+	assert.True(t, comment("192.0.2.2", "2").Allowed())
+	assert.True(t, comment("192.0.2.3", "2").Allowed())
+	assert.Equal(t, limiter.ActionReject, comment("192.0.2.4", "2").Action)
+	assert.True(t, comment("192.0.2.4", "3").Allowed())
+
+	for _, c := range rl.Counters() {
+		if c.Key == "global+{article}" {
+			assert.Equal(t, map[string]uint32{"*+1": 3, "*+2": 4, "*+3": 1}, c.Clients)
+		}
+	}
+}
+
+// TestRuleOrder verifies that the allow rules exclude the requests and the final protections stop the evaluation.
+func TestRuleOrder(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/api/health$", Method: "GET", Action: usecase.ActionAllow, Limit: 1, Key: "ip"},
+		{Path: "^/api/v1/", Method: "GET", Limit: 2, Key: "ip", Final: true},
+		{Path: "^/api/", Method: "GET", Limit: 1, Key: "ip"},
+	}, nil))
+	request := func(path string) limiter.Verdict {
+		return rl.Check(&limiter.Request{Method: "GET", Path: path, Address: "192.0.2.1"})
+	}
+	for range 3 {
+		assert.True(t, request("/api/health").Allowed())
+	}
+	assert.True(t, request("/api/v1/items").Allowed())
+	assert.True(t, request("/api/v1/items").Allowed(), "only the final protection applies")
+	assert.False(t, request("/api/v1/items").Allowed())
+	assert.True(t, request("/api/items").Allowed())
+	assert.False(t, request("/api/items").Allowed())
+
+	for _, c := range rl.Counters() {
+		assert.NotEqual(t, "^/api/health$", c.Path, "limits of the allow rule are ignored")
+	}
+}
+
+// TestConditions verifies that the protections with the conditions count only the matching requests.
+func TestConditions(t *testing.T) {
+	rl := limiter.NewRpsLimiter(context.Background(), "default", nil, nil, nil)
+	assert.NoError(t, rl.SetLimits([]usecase.Protection{
+		{Path: "^/report$", Method: "GET", Limit: 1, Key: "ip", Query: map[string]usecase.Pattern{"format": {Regex: "^(csv|xlsx)$"}}},
+		{Path: "^/", Method: "*", Limit: 2, Key: "ip", Networks: []string{"198.51.100.0/24"}},
+	}, nil))
+	request := func(method, address string, query url.Values) limiter.Verdict {
+		return rl.Check(&limiter.Request{
+			Method:     method,
+			Path:       "/report",
+			Address:    address,
+			Attributes: &matcher.Request{Query: query},
+		})
+	}
+	for range 3 {
+		assert.True(t, request("GET", "192.0.2.1", nil).Allowed())
+		assert.True(t, request("GET", "192.0.2.1", url.Values{"format": {"html"}}).Allowed())
+	}
+	assert.True(t, request("GET", "192.0.2.1", url.Values{"format": {"csv"}}).Allowed())
+	assert.False(t, request("GET", "192.0.2.1", url.Values{"format": {"xlsx"}}).Allowed())
+
+	// The wildcard method matches every method, also the ones no other protection has
+	assert.True(t, request("POST", "198.51.100.1", nil).Allowed())
+	assert.True(t, request("PROPFIND", "198.51.100.1", nil).Allowed())
+	assert.False(t, request("GET", "198.51.100.1", nil).Allowed())
+	assert.True(t, request("POST", "203.0.113.1", nil).Allowed())
+	assert.True(t, request("POST", "203.0.113.1", nil).Allowed())
+	assert.True(t, request("POST", "203.0.113.1", nil).Allowed())
+}
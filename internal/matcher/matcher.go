@@ -0,0 +1,232 @@
+// Package matcher compiles the conditions of the protections on the request attributes besides the method
+// and the path.
+package matcher
+
+import (
+	"aegis/internal/usecase"
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Request is the request attributes the conditions are matched with.
+type Request struct {
+	Host    string            // Lowercase host without the port
+	Headers map[string]string // Values by the canonical header name
+	Cookies map[string]string
+	Query   url.Values
+	Address string // Client address
+}
+
+// Pattern kinds
+const (
+	kindAny = iota // Any present value
+	kindExact
+	kindPrefix
+	kindRegex // Regular expression or glob
+)
+
+// pattern is the compiled usecase.Pattern.
+type pattern struct {
+	kind   int
+	value  string
+	re     *regexp.Regexp
+	absent bool
+}
+
+// match returns true if the attribute matches the pattern.
+func (p *pattern) match(value string, present bool) bool {
+	if p.absent || !present {
+		return p.absent && !present
+	}
+	switch p.kind {
+	case kindExact:
+		return value == p.value
+	case kindPrefix:
+		return strings.HasPrefix(value, p.value)
+	case kindRegex:
+		return p.re.MatchString(value)
+	}
+	return true
+}
+
+// glob converts the glob with * matching any sequence and ? matching any character to the regular expression.
+func glob(g string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range g {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// compilePattern compiles the pattern. Exactly one of exact, prefix, glob and regex may be set, absent
+// excludes all of them.
+func compilePattern(p usecase.Pattern) (compiled pattern, err error) {
+	set := 0
+	for _, value := range []string{p.Exact, p.Prefix, p.Glob, p.Regex} {
+		if value != "" {
+			set++
+		}
+	}
+	switch {
+	case set > 1 || set == 1 && p.Absent:
+		return pattern{}, errors.New("only one of exact, prefix, glob, regex and absent is allowed")
+	case p.Exact != "":
+		compiled = pattern{kind: kindExact, value: p.Exact}
+	case p.Prefix != "":
+		compiled = pattern{kind: kindPrefix, value: p.Prefix}
+	case p.Glob != "":
+		compiled = pattern{kind: kindRegex, re: regexp.MustCompile(glob(p.Glob))}
+	case p.Regex != "":
+		compiled.kind = kindRegex
+		compiled.re, err = regexp.Compile(p.Regex)
+	}
+	compiled.absent = p.Absent
+	return
+}
+
+// field is the pattern of a named attribute.
+type field struct {
+	name    string
+	pattern pattern
+}
+
+// compileFields compiles the patterns of the named attributes sorted by the name.
+func compileFields(kind string, patterns map[string]usecase.Pattern, canonical func(string) string) ([]field, error) {
+	fields := make([]field, 0, len(patterns))
+	for name, p := range patterns {
+		compiled, err := compilePattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", kind, name, err)
+		}
+		fields = append(fields, field{name: canonical(name), pattern: compiled})
+	}
+	slices.SortFunc(fields, func(a, b field) int { return cmp.Compare(a.name, b.name) })
+	return fields, nil
+}
+
+// Conditions are the compiled conditions of a protection. The nil conditions match every request.
+type Conditions struct {
+	host     *pattern
+	headers  []field
+	cookies  []field
+	query    []field
+	networks []netip.Prefix
+}
+
+// Match returns true if the request meets every condition: the host, every listed header, cookie and query
+// parameter match their patterns and the client address belongs to one of the networks. A query parameter
+// repeated in the query matches if any of its values does.
+func (c *Conditions) Match(r *Request) bool {
+	if c == nil {
+		return true
+	}
+	if c.host != nil && !c.host.match(r.Host, r.Host != "") {
+		return false
+	}
+	for _, f := range c.headers {
+		if value, found := r.Headers[f.name]; !f.pattern.match(value, found) {
+			return false
+		}
+	}
+	for _, f := range c.cookies {
+		if value, found := r.Cookies[f.name]; !f.pattern.match(value, found) {
+			return false
+		}
+	}
+	for _, f := range c.query {
+		values, found := r.Query[f.name]
+		if !found || f.pattern.absent {
+			if !f.pattern.match("", found) {
+				return false
+			}
+			continue
+		}
+		if !slices.ContainsFunc(values, func(value string) bool { return f.pattern.match(value, true) }) {
+			return false
+		}
+	}
+	if len(c.networks) > 0 {
+		address, err := netip.ParseAddr(r.Address)
+		if err != nil {
+			return false
+		}
+		address = address.Unmap()
+		if !slices.ContainsFunc(c.networks, func(network netip.Prefix) bool { return network.Contains(address) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseNetwork parses the network in the CIDR notation or the single address.
+func ParseNetwork(network string) (netip.Prefix, error) {
+	if strings.Contains(network, "/") {
+		prefix, err := netip.ParsePrefix(network)
+		return prefix.Masked(), err
+	}
+	address, err := netip.ParseAddr(network)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(address.Unmap(), address.Unmap().BitLen()), nil
+}
+
+// identity returns the name as is.
+func identity(name string) string {
+	return name
+}
+
+// Compile compiles the conditions of the protection. Returns nil if the protection has none.
+func Compile(protection *usecase.Protection) (*Conditions, error) {
+	if protection.Host == nil && len(protection.Headers) == 0 && len(protection.Cookies) == 0 &&
+		len(protection.Query) == 0 && len(protection.Networks) == 0 {
+		return nil, nil
+	}
+	var c Conditions
+	var err error
+	if protection.Host != nil {
+		// The request host is lowercase, the regular expression is matched with it as written
+		hostPattern := *protection.Host
+		hostPattern.Exact = strings.ToLower(hostPattern.Exact)
+		hostPattern.Prefix = strings.ToLower(hostPattern.Prefix)
+		hostPattern.Glob = strings.ToLower(hostPattern.Glob)
+		host, err := compilePattern(hostPattern)
+		if err != nil {
+			return nil, fmt.Errorf("host: %w", err)
+		}
+		c.host = &host
+	}
+	if c.headers, err = compileFields("header", protection.Headers, textproto.CanonicalMIMEHeaderKey); err != nil {
+		return nil, err
+	}
+	if c.cookies, err = compileFields("cookie", protection.Cookies, identity); err != nil {
+		return nil, err
+	}
+	if c.query, err = compileFields("query parameter", protection.Query, identity); err != nil {
+		return nil, err
+	}
+	for _, network := range protection.Networks {
+		prefix, err := ParseNetwork(network)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %w", network, err)
+		}
+		c.networks = append(c.networks, prefix)
+	}
+	return &c, nil
+}
@@ -0,0 +1,83 @@
+package matcher_test
+
+import (
+	"aegis/internal/matcher"
+	"aegis/internal/usecase"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPatterns verifies the exact, prefix, glob and regex patterns and the presence of the attributes.
+func TestPatterns(t *testing.T) {
+	var protection usecase.Protection
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"host": {"glob": "*.example.com"},
+		"headers": {"x-requested-with": {"exact": "XMLHttpRequest"}, "User-Agent": {"prefix": "Mozilla/"}, "X-Debug": {"absent": true}},
+		"cookies": {"session": {}},
+		"query": {"action": "^export$"}
+	}`), &protection))
+	assert.Equal(t, usecase.Pattern{Regex: "^export$"}, protection.Query["action"])
+	conditions, err := matcher.Compile(&protection)
+	assert.NoError(t, err)
+	request := func() *matcher.Request {
+		return &matcher.Request{
+			Host:    "shop.example.com",
+			Headers: map[string]string{"X-Requested-With": "XMLHttpRequest", "User-Agent": "Mozilla/5.0"},
+			Cookies: map[string]string{"session": "s"},
+			Query:   url.Values{"action": {"view", "export"}},
+		}
+	}
+	assert.True(t, conditions.Match(request()))
+	for name, change := range map[string]func(r *matcher.Request){
+		"host":           func(r *matcher.Request) { r.Host = "example.com" },
+		"exact header":   func(r *matcher.Request) { r.Headers["X-Requested-With"] = "xmlhttprequest" },
+		"prefix header":  func(r *matcher.Request) { r.Headers["User-Agent"] = "curl/8.0" },
+		"absent header":  func(r *matcher.Request) { r.Headers["X-Debug"] = "" },
+		"missing cookie": func(r *matcher.Request) { r.Cookies = nil },
+		"query":          func(r *matcher.Request) { r.Query = url.Values{"action": {"exports"}} },
+	} {
+		r := request()
+		change(r)
+		assert.False(t, conditions.Match(r), name)
+	}
+
+	conditions, err = matcher.Compile(&usecase.Protection{})
+	assert.NoError(t, err)
+	assert.Nil(t, conditions)
+	assert.True(t, conditions.Match(&matcher.Request{}))
+
+	_, err = matcher.Compile(&usecase.Protection{Query: map[string]usecase.Pattern{"action": {Regex: "(export"}}})
+	assert.ErrorContains(t, err, "query parameter action")
+	_, err = matcher.Compile(&usecase.Protection{Host: &usecase.Pattern{Exact: "a", Prefix: "b"}})
+	assert.ErrorContains(t, err, "host: only one of")
+
+	for _, host := range []usecase.Pattern{{Exact: "Shop.Example.com"}, {Prefix: "SHOP."}, {Glob: "*.Example.COM"}} {
+		conditions, err = matcher.Compile(&usecase.Protection{Host: &host})
+		assert.NoError(t, err)
+		assert.True(t, conditions.Match(&matcher.Request{Host: "shop.example.com"}), host)
+	}
+}
+
+// TestNetworks verifies the client networks and addresses.
+func TestNetworks(t *testing.T) {
+	conditions, err := matcher.Compile(&usecase.Protection{Networks: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"}})
+	assert.NoError(t, err)
+	for address, expected := range map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"2001:db8::1":      true,
+		"192.0.2.7":        true,
+		"192.0.2.8":        false,
+		"11.0.0.1":         false,
+		"not an address":   false,
+		"2001:db9::1":      false,
+		"::ffff:192.0.2.7": true,
+	} {
+		assert.Equal(t, expected, conditions.Match(&matcher.Request{Address: address}), address)
+	}
+	_, err = matcher.Compile(&usecase.Protection{Networks: []string{"10.0.0.0/33"}})
+	assert.ErrorContains(t, err, "network 10.0.0.0/33")
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/usecase"
+	"log/slog"
+)
+
+// BanChecker refuses requests of clients banned by the address, fingerprint or token before any other check.
+type BanChecker struct {
+	next Middleware[usecase.HttpFactors]
+	bans *ban.List
+}
+
+// Verdict returns usecase.VerdictBan if the client is banned by the address, fingerprint or token
+// and usecase.VerdictContinue otherwise.
+func (m *BanChecker) Verdict(request *usecase.RequestContext[usecase.HttpFactors]) int {
+	b, banned := m.bans.Match(request.Factors.ClientAddress, request.Fingerprint.Value, request.Factors.Token)
+	if !banned {
+		return usecase.VerdictContinue
+	}
+	slog.Debug(
+		"Banned",
+		"address",
+		request.Factors.ClientAddress,
+		"fingerprint",
+		request.Fingerprint.String,
+		"ban",
+		b.Target,
+		"reason",
+		b.Reason,
+		"method",
+		request.Factors.Method,
+		"path",
+		request.Factors.Path,
+		"verdict",
+		"ban",
+	)
+	return usecase.VerdictBan
+}
+
+func (m *BanChecker) Handle(request *usecase.RequestContext[usecase.HttpFactors], response ResponseSender) {
+	if respond(response, m.Verdict(request)) {
+		return
+	}
+	if m.next != nil {
+		m.next.Handle(request, response)
+	} else {
+		response.Allow()
+	}
+}
+
+func (m *BanChecker) Bind(next Middleware[usecase.HttpFactors]) {
+	m.next = next
+}
+
+func NewBanChecker(bans *ban.List) *BanChecker {
+	return &BanChecker{bans: bans}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/store"
+	"aegis/internal/usecase"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBanChecker verifies that the banned clients get the ban verdict answered with the block page and the others
+// are passed on.
+func TestBanChecker(t *testing.T) {
+	bans, err := ban.NewList(store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+	_, err = bans.Add("192.0.2.0/24", 0, "scanner")
+	assert.NoError(t, err)
+	checker := NewBanChecker(bans)
+
+	for address, expected := range map[string]struct {
+		verdict  int
+		response string
+	}{
+		"192.0.2.10":   {usecase.VerdictBan, "ban"},
+		"198.51.100.1": {usecase.VerdictContinue, "allow"},
+	} {
+		request := usecase.RequestContext[usecase.HttpFactors]{Factors: usecase.HttpFactors{ClientAddress: address}}
+		assert.Equal(t, expected.verdict, checker.Verdict(&request), address)
+		var response sender
+		checker.Handle(&request, &response)
+		assert.Equal(t, expected.response, response.verdict, address)
+	}
+}
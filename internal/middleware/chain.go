@@ -18,6 +18,20 @@ func (c *Chain[T]) Execute(request *usecase.RequestContext[T], response Response
 	return nil
 }
 
+// respond sends the response of the final verdict of a middleware. Returns false if the verdict passes the request
+// to the next check.
+func respond(response ResponseSender, verdict int) bool {
+	switch verdict {
+	case usecase.VerdictBan:
+		response.Ban()
+	case usecase.VerdictAllow:
+		response.Allow()
+	default:
+		return false
+	}
+	return true
+}
+
 func NewChain[T any](middlewares ...Middleware[T]) *Chain[T] {
 	chain := Chain[T]{}
 	chain.chain = middlewares
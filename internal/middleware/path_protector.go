@@ -1,28 +1,158 @@
 package middleware
 
 import (
+	"aegis/internal/attack"
 	"aegis/internal/limiter"
+	"aegis/internal/matcher"
 	"aegis/internal/remap"
+	"aegis/internal/strikes"
 	"aegis/internal/usecase"
+	"cmp"
+	"errors"
+	"fmt"
 	"log/slog"
 	"regexp"
+	"slices"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const MetricMonitored = "monitored"
+
+var metricMonitored = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: MetricMonitored,
+	},
+	[]string{"action", "endpoint", "site"},
 )
 
+func init() {
+	prometheus.MustRegister(metricMonitored)
+}
+
+// protectedPath is the path pattern of a protection, the protection and its other conditions.
+type protectedPath struct {
+	path       string
+	protection *usecase.Protection
+	conditions *matcher.Conditions
+}
+
+// protectedRules is the compiled set of the protections. It is replaced as a whole on reload.
+type protectedRules struct {
+	protected   *remap.MethodMap[protectedPath]
+	protections []usecase.Protection
+}
+
+// compileRules compiles the protections in the evaluation order. Protections with invalid patterns or conditions
+// are skipped and reported in the error.
+func compileRules(protections []usecase.Protection) (*protectedRules, error) {
+	rules := protectedRules{
+		protected:   remap.NewMethodMap[protectedPath](),
+		protections: slices.Clone(protections),
+	}
+	var errs []error
+	for i := range rules.protections {
+		protection := &rules.protections[i]
+		endpointRe, err := regexp.Compile(protection.Path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("protection %s %s: %w", protection.Method, protection.Path, err))
+			continue
+		}
+		conditions, err := matcher.Compile(protection)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("protection %s %s: %w", protection.Method, protection.Path, err))
+			continue
+		}
+		rules.protected.Put(protection.Methods(), endpointRe, protectedPath{
+			path:       protection.Path,
+			protection: protection,
+			conditions: conditions,
+		})
+	}
+	return &rules, errors.Join(errs...)
+}
+
+// sendVerdict responds to the request rejected by the rate limiter. Denied clients are sent to the challenge,
+// banned ones get the block page, other actions respond 429 with Retry-After.
+func sendVerdict(response ResponseSender, verdict limiter.Verdict) {
+	switch verdict.Action {
+	case limiter.ActionDeny:
+		response.Deny()
+	case limiter.ActionBan:
+		response.Ban()
+	default:
+		response.Reject(verdict.RetryAfter)
+	}
+}
+
 type PathProtector struct {
 	next                  Middleware[usecase.HttpFactors]
+	site                  string
 	fingerprintCalculator usecase.FingerprintCalculator[usecase.HttpFactors]
-	protected             map[string]*remap.ReMap[string]
+	rules                 atomic.Pointer[protectedRules]
 	rateLimiter           *limiter.RpsLimiter
 	tokenManager          usecase.TokenManager
+	strikes               *strikes.Tracker
+	guard                 *attack.Guard
 }
 
+// monitored logs and counts the action which the monitored protections would apply to the request.
+func (m *PathProtector) monitored(request *usecase.RequestContext[usecase.HttpFactors], endpoint, action, reason string) {
+	slog.Info(
+		"Monitored",
+		"reason",
+		reason,
+		"site",
+		m.site,
+		"fingerprint",
+		request.Fingerprint.String,
+		"address",
+		request.Factors.ClientAddress,
+		"endpoint",
+		endpoint,
+		"path",
+		request.Factors.Path,
+		"action",
+		action,
+	)
+	metricMonitored.WithLabelValues(action, endpoint, m.site).Inc()
+}
+
+// Handle checks the request against the protections applied in the evaluation order. Requests matching only
+// the protections in the monitor mode pass all checks, the refusals are logged and counted by the monitored metric
+// instead. Requests excluded by an allow rule pass without the checks, also in the under attack mode.
 func (m *PathProtector) Handle(request *usecase.RequestContext[usecase.HttpFactors], response ResponseSender) {
-	var isProtected bool
-	if methodPaths, found := m.protected[request.Factors.Method]; found {
-		_, isProtected = methodPaths.Find(request.Factors.Path)
+	var isProtected, enforced, excluded bool
+	endpoint := attack.AllEndpoints
+	attributes := matcher.Request{
+		Host:    request.Factors.Host,
+		Headers: request.Factors.Headers,
+		Cookies: request.Factors.Cookies,
+		Query:   request.Factors.Query,
+		Address: request.Factors.ClientAddress,
 	}
+	if methodPaths, found := m.rules.Load().protected.Get(request.Factors.Method); found {
+		var pathsBuf [8]protectedPath
+		paths := slices.DeleteFunc(methodPaths.AppendFind(pathsBuf[:0], request.Factors.Path), func(p protectedPath) bool {
+			return !p.conditions.Match(&attributes)
+		})
+		paths, excluded = usecase.Applied(paths, func(p protectedPath) *usecase.Protection { return p.protection })
+		if isProtected = len(paths) > 0; isProtected {
+			endpoint = request.Factors.Method + " " + slices.MinFunc(paths, func(a, b protectedPath) int {
+				return cmp.Compare(a.path, b.path)
+			}).path
+			enforced = slices.ContainsFunc(paths, func(p protectedPath) bool { return !p.protection.Monitored() })
+		}
+	}
+	var underAttack bool
+	if m.guard != nil {
+		m.guard.Count(endpoint)
+		underAttack = !excluded && m.guard.Active() && m.guard.Covers(request.Factors.Path)
+	}
+	dryRun := isProtected && !enforced && !underAttack
 
-	if !isProtected {
+	if !isProtected && !underAttack {
 		slog.Debug(
 			"Unprotected",
 			"fingerprint",
@@ -38,7 +168,41 @@ func (m *PathProtector) Handle(request *usecase.RequestContext[usecase.HttpFacto
 		return
 	}
 
+	limited := limiter.Request{
+		Method:      request.Factors.Method,
+		Path:        request.Factors.Path,
+		Address:     request.Factors.ClientAddress,
+		Attributes:  &attributes,
+		Fingerprint: request.Fingerprint.Value,
+	}
+	verdict := m.rateLimiter.Check(&limited)
+	if verdict.Monitored != "" {
+		m.monitored(request, endpoint, verdict.Monitored, "limit is exceeded")
+	}
+	if !verdict.Allowed() {
+		slog.Debug(
+			"Limit is exceeded",
+			"fingerprint",
+			request.Fingerprint.String,
+			"address",
+			request.Factors.ClientAddress,
+			"method",
+			request.Factors.Method,
+			"path",
+			request.Factors.Path,
+			"verdict",
+			verdict.Action,
+		)
+		sendVerdict(response, verdict)
+		return
+	}
+
 	if len(request.Factors.Token) == 0 {
+		if dryRun {
+			m.monitored(request, endpoint, limiter.ActionDeny, "token is absent")
+			m.pass(request, response)
+			return
+		}
 		slog.Debug(
 			"Token is absent",
 			"fingerprint",
@@ -54,10 +218,38 @@ func (m *PathProtector) Handle(request *usecase.RequestContext[usecase.HttpFacto
 		return
 	}
 
-	isValid := m.tokenManager.Validate(&request.Fingerprint, request.Factors.Token)
-	if !isValid {
+	if err := m.tokenManager.Validate(&request.Fingerprint, request.Factors.Token); err != nil {
+		if dryRun {
+			m.monitored(request, endpoint, limiter.ActionDeny, err.Error())
+			m.pass(request, response)
+			return
+		}
 		slog.Debug(
 			"Token is invalid",
+			"reason",
+			err.Error(),
+			"fingerprint",
+			request.Fingerprint.String,
+			"method",
+			request.Factors.Method,
+			"path",
+			request.Factors.Path,
+			"token",
+			request.Factors.Token,
+			"verdict",
+			"deny",
+		)
+		var rejected usecase.TokenValidationError
+		if m.strikes != nil && errors.As(err, &rejected) && strikes.Suspicious(rejected.Reason) {
+			m.strikes.Strike(request.Fingerprint.Value, request.Factors.ClientAddress, rejected.Reason)
+		}
+		response.Deny()
+		return
+	}
+
+	if underAttack && !m.guard.Fresh(request.Factors.Token) {
+		slog.Debug(
+			"Token is not fresh under attack",
 			"fingerprint",
 			request.Fingerprint.String,
 			"method",
@@ -73,8 +265,33 @@ func (m *PathProtector) Handle(request *usecase.RequestContext[usecase.HttpFacto
 		return
 	}
 
-	m.rateLimiter.Count(request.Factors.Token, request.Factors.Path, request.Factors.Method)
+	limited.Token = request.Factors.Token
+	verdict = m.rateLimiter.Count(&limited)
+	if verdict.Monitored != "" {
+		m.monitored(request, endpoint, verdict.Monitored, "limit is exceeded")
+	}
+	if !verdict.Allowed() {
+		slog.Debug(
+			"Limit is exceeded",
+			"fingerprint",
+			request.Fingerprint.String,
+			"method",
+			request.Factors.Method,
+			"path",
+			request.Factors.Path,
+			"token",
+			request.Factors.Token,
+			"verdict",
+			verdict.Action,
+		)
+		sendVerdict(response, verdict)
+		return
+	}
+	m.pass(request, response)
+}
 
+// pass passes the request to the next middleware or allows it if the protector is the last one.
+func (m *PathProtector) pass(request *usecase.RequestContext[usecase.HttpFactors], response ResponseSender) {
 	if m.next != nil {
 		m.next.Handle(request, response)
 	} else {
@@ -95,39 +312,47 @@ func (m *PathProtector) Handle(request *usecase.RequestContext[usecase.HttpFacto
 	}
 }
 
+// Protections returns the effective protection rules.
+func (m *PathProtector) Protections() []usecase.Protection {
+	return slices.Clone(m.rules.Load().protections)
+}
+
+// PrepareProtections compiles the protection rules without applying them. The returned function atomically
+// replaces the running rules with the compiled ones.
+func (m *PathProtector) PrepareProtections(protections []usecase.Protection) (func(), error) {
+	rules, err := compileRules(protections)
+	if err != nil {
+		return nil, err
+	}
+	return func() { m.rules.Store(rules) }, nil
+}
+
 func (m *PathProtector) Bind(next Middleware[usecase.HttpFactors]) {
 	m.next = next
 }
 
 func NewPathProtector(
+	site string,
 	fingerprintCalculator usecase.FingerprintCalculator[usecase.HttpFactors],
 	rateLimiter *limiter.RpsLimiter,
 	tokenManager usecase.TokenManager,
+	tracker *strikes.Tracker,
+	guard *attack.Guard,
 	protections []usecase.Protection,
 
 ) *PathProtector {
 	middleware := PathProtector{
+		site:                  site,
 		fingerprintCalculator: fingerprintCalculator,
 		rateLimiter:           rateLimiter,
 		tokenManager:          tokenManager,
-		protected:             map[string]*remap.ReMap[string]{},
+		strikes:               tracker,
+		guard:                 guard,
 	}
-	for _, protection := range protections {
-		endpointRe, err := regexp.Compile(protection.Path)
-		if err != nil {
-			slog.Error("Failed to compile regexp",
-				slog.String("method", protection.Method),
-				slog.String("path", protection.Path),
-				slog.String("error", err.Error()),
-			)
-			continue
-		}
-		pathPattern, exists := middleware.protected[protection.Method]
-		if !exists {
-			pathPattern = remap.NewReMap[string]()
-			middleware.protected[protection.Method] = pathPattern
-		}
-		pathPattern.Put(endpointRe, protection.Path)
+	rules, err := compileRules(protections)
+	if err != nil {
+		slog.Error("Failed to compile protections", slog.String("site", site), slog.String("error", err.Error()))
 	}
+	middleware.rules.Store(rules)
 	return &middleware
 }
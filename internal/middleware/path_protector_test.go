@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/limiter"
+	"aegis/internal/store"
+	"aegis/internal/usecase"
+	"context"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// sender records the response of the chain.
+type sender struct {
+	verdict string
+}
+
+func (s *sender) Allow()                          { s.verdict = "allow" }
+func (s *sender) Deny()                           { s.verdict = "deny" }
+func (s *sender) Reject(retryAfter time.Duration) { s.verdict = "reject" }
+func (s *sender) Ban()                            { s.verdict = "ban" }
+
+// validTokens accepts the "valid" token only.
+type validTokens struct {
+	usecase.TokenManager
+}
+
+func (validTokens) Validate(fp *usecase.Fingerprint, token string) error {
+	if token != "valid" {
+		return usecase.TokenValidationError{Reason: usecase.TokenReasonUnknown}
+	}
+	return nil
+}
+
+// TestPathProtectorMonitor verifies that the requests matching only the monitored protections pass and the refusals
+// are counted, while an enforced protection of the same endpoint still refuses them.
+func TestPathProtectorMonitor(t *testing.T) {
+	monitored := usecase.Protection{Path: "^/api/", Method: "GET", Limit: 1, Mode: usecase.ModeMonitor}
+	enforced := usecase.Protection{Path: "^/api/items$", Method: "GET", Limit: 100, Mode: usecase.ModeEnforce}
+	for _, test := range []struct {
+		name        string
+		protections []usecase.Protection
+		path        string
+		tokens      []string
+		verdicts    []string
+		monitored   map[string]float64
+	}{
+		{
+			name:        "monitored token is absent",
+			protections: []usecase.Protection{monitored},
+			path:        "/api/items",
+			tokens:      []string{"", "invalid"},
+			verdicts:    []string{"allow", "allow"},
+			monitored:   map[string]float64{limiter.ActionDeny: 2},
+		},
+		{
+			name:        "monitored limit is exceeded",
+			protections: []usecase.Protection{monitored},
+			path:        "/api/items",
+			tokens:      []string{"valid", "valid"},
+			verdicts:    []string{"allow", "allow"},
+			monitored:   map[string]float64{limiter.ActionDeny: 0, limiter.ActionRevoke: 1},
+		},
+		{
+			name:        "enforced next to monitored",
+			protections: []usecase.Protection{monitored, enforced},
+			path:        "/api/items",
+			tokens:      []string{"", "invalid", "valid", "valid"},
+			verdicts:    []string{"deny", "deny", "allow", "allow"},
+			monitored:   map[string]float64{limiter.ActionDeny: 0, limiter.ActionRevoke: 1},
+		},
+		{
+			name:        "enforced only",
+			protections: []usecase.Protection{enforced},
+			path:        "/api/items",
+			tokens:      []string{"", "valid"},
+			verdicts:    []string{"deny", "allow"},
+			monitored:   map[string]float64{limiter.ActionDeny: 0},
+		},
+		{
+			name:        "unprotected",
+			protections: []usecase.Protection{enforced},
+			path:        "/about",
+			tokens:      []string{""},
+			verdicts:    []string{"allow"},
+			monitored:   map[string]float64{limiter.ActionDeny: 0},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rl := limiter.NewRpsLimiter(context.Background(), test.name, validTokens{}, nil, nil)
+			assert.NoError(t, rl.SetLimits(test.protections, nil))
+			protector := NewPathProtector(test.name, nil, rl, validTokens{}, nil, nil, test.protections)
+			for i, token := range test.tokens {
+				request := usecase.RequestContext[usecase.HttpFactors]{
+					Factors: usecase.HttpFactors{
+						Method:        "GET",
+						Path:          test.path,
+						ClientAddress: "192.0.2.1",
+						Token:         token,
+					},
+				}
+				var response sender
+				protector.Handle(&request, &response)
+				assert.Equal(t, test.verdicts[i], response.verdict, "request %d", i)
+			}
+			for action, expected := range test.monitored {
+				var counted dto.Metric
+				assert.NoError(t, metricMonitored.WithLabelValues(action, "GET ^/api/", test.name).Write(&counted))
+				assert.Equal(t, expected, counted.GetCounter().GetValue(), action)
+			}
+		})
+	}
+}
+
+// TestPathProtectorVerdicts verifies the responses to the requests exceeding the limits of every action.
+func TestPathProtectorVerdicts(t *testing.T) {
+	bans, err := ban.NewList(store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+	for action, expected := range map[string]string{
+		limiter.ActionDeny:     "deny",
+		limiter.ActionReject:   "reject",
+		limiter.ActionThrottle: "reject",
+		limiter.ActionBan:      "ban",
+	} {
+		protections := []usecase.Protection{{Path: "^/login$", Method: "POST", Key: "ip", Limits: []usecase.Limit{
+			{Rate: usecase.Rate{Limit: 1, Period: time.Minute}, Action: action, Duration: usecase.Duration(time.Hour)},
+		}}}
+		rl := limiter.NewRpsLimiter(context.Background(), action, validTokens{}, bans, nil)
+		assert.NoError(t, rl.SetLimits(protections, nil))
+		protector := NewPathProtector(action, nil, rl, validTokens{}, nil, nil, protections)
+		var responses []string
+		for range 2 {
+			request := usecase.RequestContext[usecase.HttpFactors]{
+				Factors: usecase.HttpFactors{Method: "POST", Path: "/login", ClientAddress: "192.0.2.1", Token: "valid"},
+			}
+			var response sender
+			protector.Handle(&request, &response)
+			responses = append(responses, response.verdict)
+		}
+		assert.Equal(t, []string{"allow", expected}, responses, action)
+		_, err = bans.Remove("192.0.2.1")
+		assert.NoError(t, err)
+	}
+}
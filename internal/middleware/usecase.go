@@ -1,6 +1,9 @@
 package middleware
 
-import "aegis/internal/usecase"
+import (
+	"aegis/internal/usecase"
+	"time"
+)
 
 type Middleware[T any] interface {
 	Handle(*usecase.RequestContext[T], ResponseSender)
@@ -10,4 +13,8 @@ type Middleware[T any] interface {
 type ResponseSender interface {
 	Allow()
 	Deny()
+	// Reject refuses the request of the client exceeding the rate limits until the retry time.
+	Reject(retryAfter time.Duration)
+	// Ban refuses the request of the banned client with the block page instead of the challenge.
+	Ban()
 }
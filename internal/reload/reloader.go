@@ -0,0 +1,225 @@
+// Package reload applies a changed configuration to the running instance.
+package reload
+
+import (
+	"aegis/internal/config"
+	"aegis/internal/usecase"
+	"aegis/internal/validator"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MetricConfigReload = "config_reload"
+)
+
+var metricConfigReload = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: MetricConfigReload,
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(metricConfigReload)
+}
+
+// ParseLevel converts the configured logger level into the slog level.
+func ParseLevel(level string) (slog.Level, error) {
+	switch level {
+	case "ERROR":
+		return slog.LevelError, nil
+	case "WARNING":
+		return slog.LevelWarn, nil
+	case "INFO":
+		return slog.LevelInfo, nil
+	case "DEBUG":
+		return slog.LevelDebug, nil
+	default:
+		return 0, fmt.Errorf("unknown level %s", level)
+	}
+}
+
+// ProtectionsTarget accepts the reloaded protection rules.
+type ProtectionsTarget interface {
+	// PrepareProtections compiles the rules, the returned function atomically replaces the running ones.
+	PrepareProtections(protections []usecase.Protection) (func(), error)
+}
+
+// LimitsTarget accepts the reloaded rate limits.
+type LimitsTarget interface {
+	// PrepareLimits compiles the limits and the budgets, the returned function atomically replaces the running ones.
+	PrepareLimits(limits []usecase.Protection, budgets []usecase.Budget) (func(), error)
+}
+
+// Target is the running site the reloaded rules are applied to.
+type Target struct {
+	Protections ProtectionsTarget
+	Limits      LimitsTarget
+}
+
+// Result describes the applied configuration.
+type Result struct {
+	Warnings []string `json:"warnings"` // Validation warnings and settings which require the restart
+}
+
+// Reloader re-reads the configuration file and applies the protections, the rate limits of the running sites
+// and the log level. Tokens, challenges and bans are kept. Other settings and the added or removed sites require
+// the restart.
+type Reloader struct {
+	path     string
+	current  *config.Config
+	level    *slog.LevelVar
+	targets  map[string]Target
+	validate func(*config.Config) *validator.Report
+	mu       sync.Mutex
+}
+
+// restartRequired returns the changed settings which are not applied by the reload.
+func restartRequired(current, next *config.Config) []string {
+	var changed []string
+	sections := []struct {
+		name          string
+		current, next any
+	}{
+		{"address", current.Address, next.Address},
+		{"verification", current.Verification, next.Verification},
+		{"tokens", current.Tokens, next.Tokens},
+		{"storage", current.Storage, next.Storage},
+		{"admin", current.Admin, next.Admin},
+		{"strikes", current.Strikes, next.Strikes},
+		{"under_attack", current.UnderAttack, next.UnderAttack},
+		{"permanent_tokens", current.PermanentTokens, next.PermanentTokens},
+		{"cookie_domain", current.CookieDomain, next.CookieDomain},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.next) {
+			changed = append(changed, section.name+" is changed, restart is required to apply it")
+		}
+	}
+	currentSites := map[string]config.SiteConfig{}
+	for _, site := range current.Sites {
+		currentSites[site.Name] = site
+	}
+	for _, site := range next.Sites {
+		previous, found := currentSites[site.Name]
+		delete(currentSites, site.Name)
+		switch {
+		case !found:
+			changed = append(changed, "site "+site.Name+" is added, restart is required to apply it")
+		case !slices.Equal(previous.Hosts, site.Hosts) || previous.Verification != site.Verification ||
+			!slices.Equal(previous.PermanentTokens, site.PermanentTokens) || previous.CookieDomain != site.CookieDomain:
+			changed = append(changed, "site "+site.Name+" hosts, verification, permanent tokens or cookie domain "+
+				"are changed, restart is required to apply them")
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(currentSites)) {
+		changed = append(changed, "site "+name+" is removed, restart is required to apply it")
+	}
+	return changed
+}
+
+// Reload reads and validates the configuration and applies it. If the configuration is invalid,
+// the running configuration is kept and the error describes the problems.
+//
+// Returns:
+//   - *Result: Warnings of the applied configuration.
+//   - error: Non-nil if the configuration is not applied.
+func (r *Reloader) Reload() (*Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, err := r.reload()
+	if err != nil {
+		metricConfigReload.WithLabelValues("failure").Inc()
+		slog.Error("Configuration is not reloaded", slog.String("path", r.path), slog.String("error", err.Error()))
+		return nil, err
+	}
+	metricConfigReload.WithLabelValues("success").Inc()
+	for _, warning := range result.Warnings {
+		slog.Warn("Configuration warning", slog.String("warning", warning))
+	}
+	slog.Info("Configuration is reloaded", slog.String("path", r.path), slog.Int("protections", len(r.current.Protections)))
+	return result, nil
+}
+
+func (r *Reloader) reload() (*Result, error) {
+	var next config.Config
+	if err := next.Load(r.path); err != nil {
+		return nil, err
+	}
+	report := r.validate(&next)
+	if !report.Valid() {
+		return nil, report.Err()
+	}
+	level, err := ParseLevel(next.Logger.Level)
+	if err != nil {
+		return nil, err
+	}
+	// Compile the rules of every site before publishing any of them, so the sites and the protections
+	// of a site are never left half-applied
+	var publishers []func()
+	for _, site := range next.AllSites() {
+		target, found := r.targets[site.Name]
+		if !found {
+			continue
+		}
+		prepared, err := prepare(target, &site)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", site.Name, err)
+		}
+		publishers = append(publishers, prepared...)
+	}
+	for _, publish := range publishers {
+		publish()
+	}
+	r.level.Set(level)
+	result := Result{Warnings: append(report.Warnings, restartRequired(r.current, &next)...)}
+	r.current = &next
+	return &result, nil
+}
+
+// prepare compiles the protections and the limits of the site. Returns the functions publishing them,
+// the limits go first so the new rules are never evaluated with the old limits.
+func prepare(target Target, site *config.SiteConfig) ([]func(), error) {
+	rules := site.ProtectionRules()
+	publishLimits, err := target.Limits.PrepareLimits(rules, site.BudgetRules())
+	if err != nil {
+		return nil, err
+	}
+	publishProtections, err := target.Protections.PrepareProtections(rules)
+	if err != nil {
+		return nil, err
+	}
+	return []func(){publishLimits, publishProtections}, nil
+}
+
+// NewReloader creates a reloader of the running configuration.
+//
+// Parameters:
+//   - path: Configuration file.
+//   - current: Running configuration.
+//   - level: Level of the default logger.
+//   - targets: Receivers of the protection rules and the rate limits by the site name.
+//
+// Returns:
+//   - *Reloader: Reloader of the configuration.
+func NewReloader(
+	path string,
+	current *config.Config,
+	level *slog.LevelVar,
+	targets map[string]Target,
+) *Reloader {
+	return &Reloader{
+		path:     path,
+		current:  current,
+		level:    level,
+		targets:  targets,
+		validate: validator.Validate,
+	}
+}
@@ -0,0 +1,142 @@
+package reload
+
+import (
+	"aegis/internal/config"
+	"aegis/internal/usecase"
+	"aegis/internal/validator"
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type target struct {
+	protections []usecase.Protection
+	limits      []usecase.Protection
+	budgets     []usecase.Budget
+	err         error
+}
+
+func (t *target) PrepareProtections(protections []usecase.Protection) (func(), error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return func() { t.protections = protections }, nil
+}
+
+func (t *target) PrepareLimits(limits []usecase.Protection, budgets []usecase.Budget) (func(), error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return func() { t.limits, t.budgets = limits, budgets }, nil
+}
+
+// withoutAssets validates the configuration skipping the asset checks.
+func withoutAssets(cfg *config.Config) *validator.Report {
+	report := validator.Validate(cfg)
+	report.Errors = slices.DeleteFunc(report.Errors, func(e string) bool {
+		return strings.Contains(e, "verification: asset")
+	})
+	return report
+}
+
+// TestReload verifies that a valid configuration is applied and an invalid one is refused.
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"protections":[{"path":"^/a$","method":"GET"}]}`), 0600))
+	var current config.Config
+	assert.NoError(t, current.Load(path))
+
+	var level slog.LevelVar
+	protector, limiter := &target{}, &target{}
+	reloader := NewReloader(path, &current, &level, map[string]Target{config.DefaultSite: {protector, limiter}})
+	reloader.validate = withoutAssets
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"logger": {"level": "debug"},
+		"address": "localhost:3000",
+		"protections": [{"path": "^/b$", "method": "post", "rps": 5}],
+		"shadow": [{"path": "^/b$", "method": "post", "rps": 2, "mode": "enforce"}]
+	}`), 0600))
+	result, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level.Level())
+	assert.Equal(t, []usecase.Protection{
+		{Path: "^/b$", Method: "POST", Limit: 5, Key: "token", Algorithm: "fixed_window", Mode: usecase.ModeEnforce, Cost: 1},
+		{Path: "^/b$", Method: "POST", Limit: 2, Key: "token", Algorithm: "fixed_window", Mode: usecase.ModeMonitor, Cost: 1},
+	}, protector.protections)
+	assert.Equal(t, protector.protections, limiter.limits)
+	assert.Contains(t, result.Warnings, "address is changed, restart is required to apply it")
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"protections": [{"path": "^/(c", "method": "GET"}]}`), 0600))
+	_, err = reloader.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, slog.LevelDebug, level.Level())
+	assert.Len(t, protector.protections, 2)
+}
+
+// TestReloadSites verifies that the rules of every running site are applied and the added sites require the restart.
+func TestReloadSites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"sites":[{"name":"shop","hosts":["shop.example.com"]}]}`), 0600))
+	var current config.Config
+	assert.NoError(t, current.Load(path))
+
+	var level slog.LevelVar
+	main, shop := &target{}, &target{}
+	reloader := NewReloader(path, &current, &level, map[string]Target{
+		config.DefaultSite: {main, main},
+		"shop":             {shop, shop},
+	})
+	reloader.validate = withoutAssets
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"protections": [{"path": "^/a$", "method": "GET"}],
+		"sites": [
+			{"name": "shop", "hosts": ["shop.example.com"], "match": "first", "protections": [{"path": "^/cart$", "method": "POST", "rps": 2}]},
+			{"name": "blog", "hosts": ["blog.example.com"]}
+		]
+	}`), 0600))
+	result, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []usecase.Protection{
+		{Path: "^/a$", Method: "GET", Limit: math.MaxUint32, Key: "token", Algorithm: "fixed_window", Mode: usecase.ModeEnforce, Cost: 1},
+	}, main.protections)
+	assert.Equal(t, []usecase.Protection{
+		{Path: "^/cart$", Method: "POST", Limit: 2, Key: "token", Algorithm: "fixed_window", Mode: usecase.ModeEnforce, Cost: 1, Final: true},
+	}, shop.protections)
+	assert.Contains(t, result.Warnings, "site blog is added, restart is required to apply it")
+}
+
+// TestReloadFailure verifies that no site is changed if the rules of any site are not applied.
+func TestReloadFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"sites":[{"name":"shop","hosts":["shop.example.com"]}]}`), 0600))
+	var current config.Config
+	assert.NoError(t, current.Load(path))
+
+	var level slog.LevelVar
+	main, shop := &target{}, &target{err: errors.New("invalid limit")}
+	reloader := NewReloader(path, &current, &level, map[string]Target{
+		config.DefaultSite: {main, main},
+		"shop":             {main, shop},
+	})
+	reloader.validate = withoutAssets
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+		"logger": {"level": "debug"},
+		"protections": [{"path": "^/a$", "method": "GET"}],
+		"sites": [{"name": "shop", "hosts": ["shop.example.com"], "protections": [{"path": "^/cart$", "method": "POST"}]}]
+	}`), 0600))
+	_, err := reloader.Reload()
+	assert.ErrorContains(t, err, "site shop: invalid limit")
+	assert.Nil(t, main.protections)
+	assert.Nil(t, main.limits)
+	assert.NotEqual(t, slog.LevelDebug, level.Level())
+}
@@ -0,0 +1,48 @@
+package remap
+
+import "regexp"
+
+// AnyMethod is the method of the patterns matching the requests of every method.
+const AnyMethod = "*"
+
+// MethodMap maps the request methods to the ReMaps of their patterns. Patterns of AnyMethod are added
+// to the ReMap of every method, so every ReMap keeps the insertion order across the methods.
+type MethodMap[T any] struct {
+	methods map[string]*ReMap[T]
+}
+
+// Put adds the pattern to the ReMaps of the methods. The ReMap of a new method starts with the patterns
+// of AnyMethod added before.
+func (m *MethodMap[T]) Put(methods []string, k *regexp.Regexp, v T) {
+	for _, method := range methods {
+		if method == AnyMethod {
+			for _, patterns := range m.methods {
+				patterns.Put(k, v)
+			}
+			continue
+		}
+		patterns, found := m.methods[method]
+		if !found {
+			patterns = NewReMap[T]()
+			for re, value := range m.methods[AnyMethod].All() {
+				patterns.Put(re, value)
+			}
+			m.methods[method] = patterns
+		}
+		patterns.Put(k, v)
+	}
+}
+
+// Get returns the ReMap of the method, the ReMap of AnyMethod if the method has no own patterns.
+func (m *MethodMap[T]) Get(method string) (*ReMap[T], bool) {
+	if patterns, found := m.methods[method]; found {
+		return patterns, true
+	}
+	patterns, found := m.methods[AnyMethod]
+	return patterns, found
+}
+
+// NewMethodMap creates an empty MethodMap.
+func NewMethodMap[T any]() *MethodMap[T] {
+	return &MethodMap[T]{methods: map[string]*ReMap[T]{AnyMethod: NewReMap[T]()}}
+}
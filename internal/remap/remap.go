@@ -1,53 +1,254 @@
 package remap
 
 import (
+	"iter"
+	"maps"
 	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
 	"sync"
 )
 
+// maxStackCandidates is the number of candidate patterns of a lookup kept without the allocation
+const maxStackCandidates = 64
+
+// entry is a pattern with its value.
+type entry[T any] struct {
+	re      *regexp.Regexp
+	value   T
+	groups  bool   // Pattern has named capture groups
+	literal string // Literal beginning every match of the unanchored pattern, the key must contain it
+}
+
+// trieEdge is a child of the trie node.
+type trieEdge struct {
+	b    byte
+	node *trieNode
+}
+
+// trieNode indexes the patterns anchored at the beginning by their literal prefix.
+type trieNode struct {
+	children []trieEdge
+	entries  []int // Indexes of the patterns whose prefix ends at the node
+}
+
+// child returns the child of the byte or nil.
+func (n *trieNode) child(b byte) *trieNode {
+	for _, edge := range n.children {
+		if edge.b == b {
+			return edge.node
+		}
+	}
+	return nil
+}
+
+// insert adds the pattern index under the prefix.
+func (n *trieNode) insert(prefix string, index int) {
+	for i := 0; i < len(prefix); i++ {
+		child := n.child(prefix[i])
+		if child == nil {
+			child = &trieNode{}
+			n.children = append(n.children, trieEdge{b: prefix[i], node: child})
+		}
+		n = child
+	}
+	n.entries = append(n.entries, index)
+}
+
+// anchoredPrefix returns the literal prefix every matching key starts with. Returns false if the pattern
+// is not anchored with ^, so it may match anywhere in the key.
+func anchoredPrefix(re *regexp.Regexp) (string, bool) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	parsed = parsed.Simplify()
+	subs := []*syntax.Regexp{parsed}
+	if parsed.Op == syntax.OpConcat {
+		subs = parsed.Sub
+	}
+	if len(subs) == 0 || subs[0].Op != syntax.OpBeginText {
+		return "", false
+	}
+	var prefix []rune
+	for _, sub := range subs[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix = append(prefix, sub.Rune...)
+	}
+	return string(prefix), true
+}
+
+// ReMap maps regular expressions to values. Lookups return the values of all patterns matching the key
+// in the insertion order. Patterns anchored with ^ are pre-filtered by their literal prefix with a trie,
+// other patterns by the literal beginning their matches, so only the patterns which may match the key
+// are executed.
 type ReMap[T any] struct {
-	kv map[*regexp.Regexp]T
-	mu sync.RWMutex
+	entries    []entry[T]
+	index      map[*regexp.Regexp]int
+	root       trieNode
+	unanchored []int // Indexes of the patterns checked for every key
+	mu         sync.RWMutex
+}
+
+// reindex rebuilds the index and the trie after the entries are changed. Must be called under the lock.
+func (r *ReMap[T]) reindex() {
+	r.index = make(map[*regexp.Regexp]int, len(r.entries))
+	r.root = trieNode{}
+	r.unanchored = nil
+	for i := range r.entries {
+		r.indexEntry(i)
+	}
+}
+
+// indexEntry adds the entry to the index and the trie. Must be called under the lock.
+func (r *ReMap[T]) indexEntry(i int) {
+	re := r.entries[i].re
+	r.index[re] = i
+	if prefix, anchored := anchoredPrefix(re); anchored {
+		r.root.insert(prefix, i)
+	} else {
+		r.entries[i].literal, _ = re.LiteralPrefix()
+		r.unanchored = append(r.unanchored, i)
+	}
+}
+
+// candidates appends the indexes of the patterns which may match the key in the insertion order.
+// Must be called under the read lock.
+func (r *ReMap[T]) candidates(dst []int, k string) []int {
+	for _, i := range r.unanchored {
+		if strings.Contains(k, r.entries[i].literal) {
+			dst = append(dst, i)
+		}
+	}
+	node := &r.root
+	dst = append(dst, node.entries...)
+	for i := 0; i < len(k); i++ {
+		if node = node.child(k[i]); node == nil {
+			break
+		}
+		dst = append(dst, node.entries...)
+	}
+	slices.Sort(dst)
+	return dst
 }
 
 func (r *ReMap[T]) Put(k *regexp.Regexp, v T) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.kv[k] = v
+	if i, found := r.index[k]; found {
+		r.entries[i].value = v
+		return
+	}
+	groups := slices.ContainsFunc(k.SubexpNames(), func(name string) bool { return name != "" })
+	r.entries = append(r.entries, entry[T]{re: k, value: v, groups: groups})
+	r.indexEntry(len(r.entries) - 1)
 }
 
 func (r *ReMap[T]) Get(k *regexp.Regexp) (T, bool) {
-	v, exists := r.kv[k]
-	return v, exists
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if i, found := r.index[k]; found {
+		return r.entries[i].value, true
+	}
+	var zero T
+	return zero, false
 }
 
+// Find returns the values of the patterns matching the key in the insertion order.
 func (r *ReMap[T]) Find(k string) ([]T, bool) {
+	values := r.AppendFind(make([]T, 0, 8), k)
+	return values, len(values) > 0
+}
+
+// AppendFind appends the values of the patterns matching the key in the insertion order to dst and returns
+// the extended slice. It does not allocate if dst has enough capacity.
+func (r *ReMap[T]) AppendFind(dst []T, k string) []T {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var stack [maxStackCandidates]int
+	for _, i := range r.candidates(stack[:0], k) {
+		if r.entries[i].re.MatchString(k) {
+			dst = append(dst, r.entries[i].value)
+		}
+	}
+	return dst
+}
+
+// Match is the value of the pattern matching the key with the values of the named capture groups.
+type Match[T any] struct {
+	Value  T
+	Groups map[string]string // Values of the named capture groups, nil if the pattern has none
+}
+
+// FindMatches returns the values of the patterns matching the key with the values of their named capture groups.
+func (r *ReMap[T]) FindMatches(k string) ([]Match[T], bool) {
+	matches := r.AppendMatches(make([]Match[T], 0, 8), k)
+	return matches, len(matches) > 0
+}
+
+// AppendMatches appends the matches of the patterns in the insertion order to dst and returns the extended slice.
+// Only the patterns with named capture groups allocate.
+func (r *ReMap[T]) AppendMatches(dst []Match[T], k string) []Match[T] {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	values := make([]T, 0, 8)
-	found := false
-	for storedKey, storedValue := range r.kv {
-		if storedKey.MatchString(k) {
-			values = append(values, storedValue)
-			found = true
+	var stack [maxStackCandidates]int
+	for _, i := range r.candidates(stack[:0], k) {
+		e := &r.entries[i]
+		if !e.groups {
+			if e.re.MatchString(k) {
+				dst = append(dst, Match[T]{Value: e.value})
+			}
+			continue
 		}
+		submatches := e.re.FindStringSubmatch(k)
+		if submatches == nil {
+			continue
+		}
+		groups := map[string]string{}
+		for i, name := range e.re.SubexpNames() {
+			if name != "" {
+				groups[name] = submatches[i]
+			}
+		}
+		dst = append(dst, Match[T]{Value: e.value, Groups: groups})
 	}
-	return values, found
+	return dst
 }
 
+// All returns the patterns and their values in the insertion order. The map must not be changed
+// during the iteration.
+func (r *ReMap[T]) All() iter.Seq2[*regexp.Regexp, T] {
+	return func(yield func(*regexp.Regexp, T) bool) {
+		for _, e := range r.entries {
+			if !yield(e.re, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// Entries returns the patterns and their values.
 func (r *ReMap[T]) Entries() map[*regexp.Regexp]T {
-	return r.kv
+	return maps.Collect(r.All())
 }
 
 func (r *ReMap[T]) Delete(k *regexp.Regexp) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	delete(r.kv, k)
+	i, found := r.index[k]
+	if !found {
+		return
+	}
+	r.entries = slices.Delete(r.entries, i, i+1)
+	r.reindex()
 }
 
 // NewReMap creates a new empty ReMap[T] instance, initializing an internal map
 // that associates regular expression patterns (*regexp.Regexp) with values of type T.
 // The map is initially empty and ready for insertion of regex-to-value pairs.
 func NewReMap[T any]() *ReMap[T] {
-	return &ReMap[T]{kv: make(map[*regexp.Regexp]T)}
+	return &ReMap[T]{index: map[*regexp.Regexp]int{}}
 }
@@ -2,6 +2,7 @@ package remap_test
 
 import (
 	"aegis/internal/remap"
+	"fmt"
 	"regexp"
 	"testing"
 
@@ -118,3 +119,139 @@ func TestRemapFind(t *testing.T) {
 	assert.Len(t, vals, 2)
 	assert.Equal(t, vals, []string{"index", "images"})
 }
+
+// TestRemapFindMatches verifies that the named capture groups of the matching patterns are returned.
+func TestRemapFindMatches(t *testing.T) {
+	rm := remap.NewReMap[string]()
+	rm.Put(regexp.MustCompile(`^/articles/(?P<article>\d+)/comments/(\d+)$`), "comments")
+	rm.Put(imagesRe, "images")
+
+	matches, found := rm.FindMatches("/articles/42/comments/7")
+	assert.True(t, found)
+	assert.Equal(t, []remap.Match[string]{{Value: "comments", Groups: map[string]string{"article": "42"}}}, matches)
+
+	matches, found = rm.FindMatches("/images/logo.png")
+	assert.True(t, found)
+	assert.Equal(t, []remap.Match[string]{{Value: "images"}}, matches)
+
+	_, found = rm.FindMatches("/articles/42")
+	assert.False(t, found)
+}
+
+// rules returns n protection-like patterns: anchored with literal prefixes, with capture groups and unanchored.
+func rules(n int) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, n)
+	for i := range n {
+		var pattern string
+		switch i % 4 {
+		case 0:
+			pattern = fmt.Sprintf(`^/api/v%d/items/\d+$`, i)
+		case 1:
+			pattern = fmt.Sprintf(`^/api/v%d/(?P<section>\w+)/search$`, i)
+		case 2:
+			pattern = fmt.Sprintf(`^/static%d/`, i)
+		default:
+			pattern = fmt.Sprintf(`/page%d\.html`, i)
+		}
+		patterns = append(patterns, regexp.MustCompile(pattern))
+	}
+	return patterns
+}
+
+// TestRemapIndex verifies that the indexed lookup returns the same values as executing every pattern.
+func TestRemapIndex(t *testing.T) {
+	patterns := append(rules(100),
+		regexp.MustCompile(`^/`),
+		regexp.MustCompile(`(?i)^/API/`),
+		regexp.MustCompile(`^/api/v1|/items/`),
+		regexp.MustCompile(`^(/api|/static)`),
+		regexp.MustCompile(`.*`),
+	)
+	rm := remap.NewReMap[int]()
+	for i, re := range patterns {
+		rm.Put(re, i)
+	}
+	for _, path := range []string{"/", "/api/v4/items/7", "/API/V1/x", "/api/v5/books/search", "/static6/app.js",
+		"/x/page7.html", "/api/v1", "/other/items/", "", "/static"} {
+		var expected []int
+		for i, re := range patterns {
+			if re.MatchString(path) {
+				expected = append(expected, i)
+			}
+		}
+		values, found := rm.Find(path)
+		assert.Equal(t, expected, values, path)
+		assert.Equal(t, len(expected) > 0, found, path)
+	}
+
+	// Deleted patterns are removed from the index
+	rm.Delete(patterns[0])
+	values, _ := rm.Find("/api/v0/items/1")
+	assert.NotContains(t, values, 0)
+	assert.Contains(t, values, len(patterns)-1)
+}
+
+// TestRemapZeroAlloc verifies that the lookup into a buffer with enough capacity does not allocate.
+func TestRemapZeroAlloc(t *testing.T) {
+	rm := remap.NewReMap[int]()
+	for i, re := range rules(1000) {
+		rm.Put(re, i)
+	}
+	buf := make([]int, 0, 8)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = rm.AppendFind(buf[:0], "/api/v400/items/42")
+	})
+	assert.Equal(t, []int{400}, buf)
+	assert.Zero(t, allocs)
+}
+
+func BenchmarkRemapFind(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		patterns := rules(n)
+		rm := remap.NewReMap[int]()
+		for i, re := range patterns {
+			rm.Put(re, i)
+		}
+		path := fmt.Sprintf("/api/v%d/items/42", n/2/4*4)
+		b.Run(fmt.Sprintf("rules=%d/indexed", n), func(b *testing.B) {
+			buf := make([]int, 0, 8)
+			b.ReportAllocs()
+			for b.Loop() {
+				buf = rm.AppendFind(buf[:0], path)
+			}
+		})
+		b.Run(fmt.Sprintf("rules=%d/linear", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				values := make([]int, 0, 8)
+				for i, re := range patterns {
+					if re.MatchString(path) {
+						values = append(values, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMethodMap verifies that the patterns of any method keep the insertion order in the ReMaps of every method.
+func TestMethodMap(t *testing.T) {
+	mm := remap.NewMethodMap[string]()
+	mm.Put([]string{remap.AnyMethod}, regexp.MustCompile("^/"), "any")
+	mm.Put([]string{"GET", "HEAD"}, indexRe, "page")
+	mm.Put([]string{remap.AnyMethod}, imagesRe, "any images")
+	mm.Put([]string{"POST"}, usersRe, "users")
+
+	find := func(method, path string) []string {
+		patterns, found := mm.Get(method)
+		assert.True(t, found, method)
+		values, _ := patterns.Find(path)
+		return values
+	}
+	assert.Equal(t, []string{"any", "page"}, find("GET", "/index.html"))
+	assert.Equal(t, []string{"any", "page", "any images"}, find("HEAD", "/images/index.html"))
+	assert.Equal(t, []string{"any", "any images"}, find("POST", "/images/logo.png"))
+	assert.Equal(t, []string{"any", "any images"}, find("PROPFIND", "/images/logo.png"))
+	assert.Equal(t, []string{"any"}, find("PROPFIND", "/users/"))
+	assert.Equal(t, []string{"any", "users"}, find("POST", "/users/"))
+}
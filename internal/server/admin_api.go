@@ -0,0 +1,434 @@
+package server
+
+import (
+	"aegis/internal/attack"
+	"aegis/internal/ban"
+	"aegis/internal/fingerprint/ipfp"
+	"aegis/internal/reload"
+	"aegis/internal/tokens"
+	"aegis/internal/usecase"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CountersProvider exposes the rate limiter counters.
+type CountersProvider interface {
+	Counters() []usecase.EndpointCounters
+}
+
+// ProtectionsProvider exposes the effective protection rules of the sites.
+type ProtectionsProvider interface {
+	// SiteProtections returns the rules of the site, the default site if the name is empty.
+	// Returns false if the site is unknown.
+	SiteProtections(site string) ([]usecase.Protection, bool)
+}
+
+// Reloader applies the changed configuration file.
+type Reloader interface {
+	Reload() (*reload.Result, error)
+}
+
+// AttackMode reports and switches the under attack mode.
+type AttackMode interface {
+	Status() attack.Status
+	Switch(toggle string) error
+}
+
+// switchRequest is the body of the under attack mode switch.
+type switchRequest struct {
+	Switch string `json:"switch"` // on, off or auto
+}
+
+// banRequest is the body of the ban request.
+type banRequest struct {
+	Target string `json:"target"` // Address, CIDR, fingerprint:<hex> or token:<token>
+	TTL    string `json:"ttl"`    // Duration of the ban, permanent if empty
+	Reason string `json:"reason"`
+}
+
+// EndpointStats summarizes the rate limiter counters of the endpoint limit.
+type EndpointStats struct {
+	Site     string       `json:"site,omitempty"`
+	Method   string       `json:"method"`
+	Path     string       `json:"path"`
+	Rate     usecase.Rate `json:"rate"`
+	Clients  int          `json:"clients"`  // Clients counted by the limit
+	Requests uint64       `json:"requests"` // Requests counted by the limit
+}
+
+// Stats describes the running instance.
+type Stats struct {
+	Version   string          `json:"version"`
+	Uptime    string          `json:"uptime"`
+	Tokens    *int            `json:"tokens,omitempty"` // Number of stored tokens, absent for stateless tokens
+	Bans      int             `json:"bans"`
+	Endpoints []EndpointStats `json:"endpoints"`
+}
+
+// revokeRequest is the body of the revocation request. Exactly one field must be set.
+type revokeRequest struct {
+	Token       string `json:"token"`
+	Fingerprint string `json:"fingerprint"` // Hex encoded fingerprint value
+}
+
+// revokeResponse is the result of the revocation.
+type revokeResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// AdminApi serves the administration API. Requests over TCP must carry the secret in the
+// "Authorization: Bearer <secret>" header, requests over the Unix socket are trusted and protected
+// by the socket file permissions.
+type AdminApi struct {
+	address     string
+	secret      []byte
+	socket      string
+	version     string
+	started     time.Time
+	tokens      usecase.TokenRegistry
+	bans        *ban.List
+	counters    CountersProvider
+	protections ProtectionsProvider
+	reloader    Reloader
+	attackMode  AttackMode
+	handler     http.Handler
+	servers     []*http.Server
+}
+
+// mounted returns true if the API is served by ApiServer on the main address.
+func (a *AdminApi) mounted() bool {
+	return len(a.secret) > 0 && a.address == ""
+}
+
+// ServeHTTP checks the secret and dispatches the request.
+func (a *AdminApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), a.secret) != 1 {
+		slog.Warn("Unauthorized admin request", "method", r.Method, "path", r.URL.Path, "address", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+// writeJson sends the value as a JSON response.
+func writeJson(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		slog.Error("Failed to send admin response", slog.String("error", err.Error()))
+	}
+}
+
+// writeError sends the error message as a JSON response.
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJson(w, code, map[string]string{"error": message})
+}
+
+// listTokens handles GET /admin/tokens?fingerprint=<hex>|ip=<address>&limit=<n>.
+func (a *AdminApi) listTokens(w http.ResponseWriter, r *http.Request) {
+	var query usecase.TokenQuery
+	params := r.URL.Query()
+	fingerprint, ip := params.Get("fingerprint"), params.Get("ip")
+	switch {
+	case fingerprint != "" && ip != "":
+		writeError(w, http.StatusBadRequest, "either fingerprint or ip must be set")
+		return
+	case fingerprint != "":
+		value, err := hex.DecodeString(fingerprint)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "fingerprint must be hex encoded")
+			return
+		}
+		query.Fingerprint = value
+	case ip != "":
+		query.Fingerprint = ipfp.Prefix(ip)
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative number")
+			return
+		}
+		query.Limit = n
+	}
+	found, err := a.tokens.Tokens(query)
+	if errors.Is(err, tokens.ErrNotStored) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to list tokens", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, found)
+}
+
+// revokeTokens handles POST /admin/tokens/revoke.
+func (a *AdminApi) revokeTokens(w http.ResponseWriter, r *http.Request) {
+	var request revokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request")
+		return
+	}
+	switch {
+	case (request.Token == "") == (request.Fingerprint == ""):
+		writeError(w, http.StatusBadRequest, "either token or fingerprint must be set")
+	case request.Token != "":
+		response := revokeResponse{}
+		if a.tokens.Revoke(request.Token) {
+			response.Revoked = 1
+		}
+		slog.Info("Admin revoke", "token", request.Token, "revoked", response.Revoked)
+		writeJson(w, http.StatusOK, response)
+	default:
+		fingerprint, err := hex.DecodeString(request.Fingerprint)
+		if err != nil || len(fingerprint) == 0 {
+			writeError(w, http.StatusBadRequest, "fingerprint must be hex encoded")
+			return
+		}
+		revoked, err := a.tokens.RevokeFingerprint(fingerprint)
+		if err != nil {
+			slog.Error("Failed to revoke fingerprint", slog.String("fingerprint", request.Fingerprint), slog.String("error", err.Error()))
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("Admin revoke", "fingerprint", request.Fingerprint, "revoked", revoked)
+		writeJson(w, http.StatusOK, revokeResponse{Revoked: revoked})
+	}
+}
+
+// listBans handles GET /admin/bans.
+func (a *AdminApi) listBans(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, a.bans.Bans())
+}
+
+// addBan handles POST /admin/bans.
+func (a *AdminApi) addBan(w http.ResponseWriter, r *http.Request) {
+	var request banRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request")
+		return
+	}
+	var ttl time.Duration
+	if request.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(request.TTL); err != nil {
+			writeError(w, http.StatusBadRequest, "ttl must be a duration")
+			return
+		}
+	}
+	b, err := a.bans.Add(request.Target, ttl, request.Reason)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("Admin ban", "target", b.Target, "ttl", ttl.String(), "reason", b.Reason)
+	writeJson(w, http.StatusOK, b)
+}
+
+// removeBan handles DELETE /admin/bans?target=<target>.
+func (a *AdminApi) removeBan(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	removed, err := a.bans.Remove(target)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, "ban is not found")
+		return
+	}
+	slog.Info("Admin unban", "target", target)
+	writeJson(w, http.StatusOK, map[string]bool{"removed": true})
+}
+
+// stats handles GET /admin/stats.
+func (a *AdminApi) stats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		Version:   a.version,
+		Uptime:    time.Since(a.started).Round(time.Second).String(),
+		Bans:      len(a.bans.Bans()),
+		Endpoints: []EndpointStats{},
+	}
+	if n, err := a.tokens.Count(); err == nil {
+		stats.Tokens = &n
+	}
+	for _, counters := range a.counters.Counters() {
+		endpoint := EndpointStats{
+			Site:    counters.Site,
+			Method:  counters.Method,
+			Path:    counters.Path,
+			Rate:    counters.Rate,
+			Clients: len(counters.Clients),
+		}
+		for _, n := range counters.Clients {
+			endpoint.Requests += uint64(n)
+		}
+		stats.Endpoints = append(stats.Endpoints, endpoint)
+	}
+	writeJson(w, http.StatusOK, stats)
+}
+
+// switchAttackMode handles POST /admin/attack.
+func (a *AdminApi) switchAttackMode(w http.ResponseWriter, r *http.Request) {
+	var request switchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request")
+		return
+	}
+	if err := a.attackMode.Switch(request.Switch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("Admin under attack switch", "switch", request.Switch)
+	writeJson(w, http.StatusOK, a.attackMode.Status())
+}
+
+// reload handles POST /admin/reload.
+func (a *AdminApi) reload(w http.ResponseWriter, r *http.Request) {
+	result, err := a.reloader.Reload()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+// serve runs the server on the listener until it is shut down.
+func (a *AdminApi) serve(listener net.Listener, handler http.Handler) {
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  20 * time.Second,
+	}
+	a.servers = append(a.servers, server)
+	go func() {
+		slog.Info("Serving admin API " + listener.Addr().String())
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server stopped abnormal", slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// Serve starts listening the separate admin address and the Unix socket if they are configured.
+// The TCP address requires the secret to be set.
+func (a *AdminApi) Serve() error {
+	if a.address != "" && len(a.secret) > 0 {
+		listener, err := net.Listen("tcp", a.address)
+		if err != nil {
+			return err
+		}
+		a.serve(listener, a)
+	}
+	if a.socket != "" {
+		// The socket file is left behind if the process was killed
+		if err := os.Remove(a.socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		listener, err := net.Listen("unix", a.socket)
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(a.socket, 0660); err != nil {
+			listener.Close()
+			return err
+		}
+		a.serve(listener, a.handler)
+	}
+	return nil
+}
+
+// Shutdown stops the separate admin servers.
+func (a *AdminApi) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, server := range a.servers {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// NewAdminApi creates the administration API.
+//
+// Parameters:
+//   - address: Separate listen address. If empty, the API is served by ApiServer under /admin/.
+//   - secret: Bearer secret required by every TCP request. If empty, the API is served only on the socket.
+//   - socket: Path of the Unix socket used by the CLI. If empty, the socket is not created.
+//   - version: Version reported by the stats.
+//   - tokens: Registry used to list and revoke tokens.
+//   - bans: List of the banned clients.
+//   - counters: Rate limiter counters of all sites.
+//   - protections: Effective protection rules of the sites.
+//   - reloader: Reloader of the configuration file.
+//   - attackMode: Under attack mode switch, optional.
+//
+// Returns:
+//   - *AdminApi: Administration API handler.
+func NewAdminApi(
+	address string,
+	secret string,
+	socket string,
+	version string,
+	tokens usecase.TokenRegistry,
+	bans *ban.List,
+	counters CountersProvider,
+	protections ProtectionsProvider,
+	reloader Reloader,
+	attackMode AttackMode,
+) *AdminApi {
+	a := AdminApi{
+		address:     address,
+		secret:      []byte(secret),
+		socket:      socket,
+		version:     version,
+		started:     time.Now(),
+		tokens:      tokens,
+		bans:        bans,
+		counters:    counters,
+		protections: protections,
+		reloader:    reloader,
+		attackMode:  attackMode,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/tokens", a.listTokens)
+	mux.HandleFunc("POST /admin/tokens/revoke", a.revokeTokens)
+	mux.HandleFunc("GET /admin/bans", a.listBans)
+	mux.HandleFunc("POST /admin/bans", a.addBan)
+	mux.HandleFunc("DELETE /admin/bans", a.removeBan)
+	mux.HandleFunc("GET /admin/stats", a.stats)
+	mux.HandleFunc("POST /admin/reload", a.reload)
+	mux.HandleFunc("GET /admin/limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, a.counters.Counters())
+	})
+	mux.HandleFunc("GET /admin/protections", func(w http.ResponseWriter, r *http.Request) {
+		protections, found := a.protections.SiteProtections(r.URL.Query().Get("site"))
+		if !found {
+			writeError(w, http.StatusNotFound, "unknown site")
+			return
+		}
+		writeJson(w, http.StatusOK, protections)
+	})
+	if attackMode != nil {
+		mux.HandleFunc("GET /admin/attack", func(w http.ResponseWriter, r *http.Request) {
+			writeJson(w, http.StatusOK, a.attackMode.Status())
+		})
+		mux.HandleFunc("POST /admin/attack", a.switchAttackMode)
+	}
+	a.handler = mux
+	return &a
+}
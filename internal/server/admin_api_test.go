@@ -0,0 +1,76 @@
+package server_test
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/server"
+	"aegis/internal/store"
+	"aegis/internal/tokens"
+	"aegis/internal/usecase"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticCounters []usecase.EndpointCounters
+
+func (c staticCounters) Counters() []usecase.EndpointCounters { return c }
+
+type staticProtections []usecase.Protection
+
+func (p staticProtections) SiteProtections(site string) ([]usecase.Protection, bool) {
+	return p, site == ""
+}
+
+func adminRequest(handler http.Handler, method, target, secret, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// TestAdminApi verifies authentication, token search and revocation by token and fingerprint.
+func TestAdminApi(t *testing.T) {
+	registry := tokens.NewRegistry(tokens.Policy{TTL: time.Hour}, store.NewMemoryStore(nil))
+	client := usecase.Fingerprint{Value: []byte{1, 2, 3, 4, 5}}
+	other := usecase.Fingerprint{Value: []byte{1, 2, 9, 9, 9}}
+	first, _ := registry.Issue(&client)
+	registry.Issue(&client)
+	registry.Issue(&other)
+	protections := staticProtections{{Path: "^/api/", Method: "GET", Limit: 10, Key: "ip", Algorithm: "token_bucket", Burst: 20, Mode: "enforce", Cost: 1,
+		Limits: []usecase.Limit{{Rate: usecase.Rate{Limit: 5000, Period: 24 * time.Hour}, Action: "deny"}}}}
+	bans, _ := ban.NewList(store.NewMemoryStore(nil))
+	admin := server.NewAdminApi("", "secret", "", "test", registry, bans, staticCounters{}, protections, nil, nil)
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(admin, "GET", "/admin/tokens", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(admin, "GET", "/admin/tokens", "wrong", "").Code)
+
+	var found []usecase.TokenInfo
+	w := adminRequest(admin, "GET", "/admin/tokens?fingerprint=0102", "secret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	assert.Len(t, found, 3)
+	w = adminRequest(admin, "GET", "/admin/tokens?fingerprint=0102030405&limit=1", "secret", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+	assert.Len(t, found, 1)
+	assert.Equal(t, "0102030405", found[0].Fingerprint)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(admin, "GET", "/admin/tokens?fingerprint=zz", "secret", "").Code)
+
+	w = adminRequest(admin, "POST", "/admin/tokens/revoke", "secret", `{"token":"`+first+`"}`)
+	assert.JSONEq(t, `{"revoked":1}`, w.Body.String())
+	w = adminRequest(admin, "POST", "/admin/tokens/revoke", "secret", `{"fingerprint":"0102030405"}`)
+	assert.JSONEq(t, `{"revoked":1}`, w.Body.String())
+	assert.Error(t, registry.Validate(&client, first))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(admin, "POST", "/admin/tokens/revoke", "secret", `{}`).Code)
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(admin, "GET", "/admin/protections?site=shop", "secret", "").Code)
+	w = adminRequest(admin, "GET", "/admin/protections", "secret", "")
+	assert.JSONEq(t, `[{"path":"^/api/","method":"GET","rps":10,"key":"ip","algorithm":"token_bucket","burst":20,"limits":[{"rate":"5000/day","action":"deny"}],"mode":"enforce","cost":1,"budget":"","priority":0,"action":"","final":false}]`, w.Body.String())
+}
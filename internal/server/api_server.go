@@ -2,6 +2,8 @@ package server
 
 import (
 	"aegis/internal/middleware"
+	"aegis/internal/site"
+	"aegis/internal/urlnorm"
 	"aegis/internal/usecase"
 	"context"
 	"errors"
@@ -17,29 +19,49 @@ import (
 
 const (
 	MetricAntibotResponse = "antibot_response"
+
+	// HeaderCookieDomain tells the verification page the domain of the token cookie
+	HeaderCookieDomain = "X-Aegis-Cookie-Domain"
+)
+
+var metricAntibotResponse = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: MetricAntibotResponse,
+	},
+	[]string{"code", "site"},
 )
 
+func init() {
+	prometheus.MustRegister(metricAntibotResponse)
+}
+
 // API server
 type ApiServer struct {
 	address               string
 	chain                 *middleware.Chain[usecase.HttpFactors]
 	server                *http.Server
 	fingerprintCalculator usecase.FingerprintCalculator[usecase.HttpFactors]
-	tokenManager          usecase.TokenManager
+	sites                 *site.Sites
+	admin                 *AdminApi
 }
 
+// NewApiServer creates the API server. The challenges and the tokens are served by the token manager of the site
+// of the original host. The admin API is optional, it is served under /admin/ unless it has a separate address
+// or it is available only on the Unix socket.
 func NewApiServer(
 	address string,
 	chain *middleware.Chain[usecase.HttpFactors],
 	fingerprintCalculator usecase.FingerprintCalculator[usecase.HttpFactors],
-	tokenManager usecase.TokenManager,
+	sites *site.Sites,
+	admin *AdminApi,
 ) *ApiServer {
 	return &ApiServer{
 		address:               address,
 		chain:                 chain,
 		server:                &http.Server{},
 		fingerprintCalculator: fingerprintCalculator,
-		tokenManager:          tokenManager,
+		sites:                 sites,
+		admin:                 admin,
 	}
 }
 
@@ -52,14 +74,23 @@ func requestContext(r *http.Request) (rc *usecase.RequestContext[usecase.HttpFac
 	}
 	defer r.Body.Close()
 	factors.Method = r.Header.Get("X-Original-Method")
-	factors.Path = r.Header.Get("X-Original-Url")
+	factors.Host = urlnorm.Host(r.Header.Get("X-Original-Host"))
+	factors.Path, factors.Query = urlnorm.Split(r.Header.Get("X-Original-Url"))
 	factors.ClientAddress = r.Header.Get("X-Original-Addr")
-	factors.Path = r.Header.Get("X-Original-Url")
 	aegisTokens := r.CookiesNamed("AEGIS_TOKEN")
 	if len(aegisTokens) == 1 {
 		factors.Token = aegisTokens[0].Value
 	}
-	factors.Cookies = map[string]string{"AEGIS_TOKEN": factors.Token}
+	factors.Cookies = map[string]string{}
+	for _, cookie := range r.Cookies() {
+		if _, found := factors.Cookies[cookie.Name]; !found {
+			factors.Cookies[cookie.Name] = cookie.Value
+		}
+	}
+	if len(aegisTokens) > 0 {
+		// The ambiguous duplicated token cookies are matched as the empty token
+		factors.Cookies["AEGIS_TOKEN"] = factors.Token
+	}
 	factors.Headers = make(map[string]string)
 	for name, values := range r.Header {
 		factors.Headers[name] = strings.Join(values, ",")
@@ -68,16 +99,17 @@ func requestContext(r *http.Request) (rc *usecase.RequestContext[usecase.HttpFac
 	return
 }
 
+// route returns the token manager of the client challenge on the site.
+func route(st *site.Site, fp *usecase.Fingerprint, address string) usecase.TokenManager {
+	if router, ok := st.TokenManager.(usecase.ChallengeRouter); ok {
+		return router.Route(fp, address)
+	}
+	return st.TokenManager
+}
+
 // Serve listens and serves REST API of the Antibot
 func (s *ApiServer) Serve() error {
 	mux := http.NewServeMux()
-	metricAntibotResponse := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: MetricAntibotResponse,
-		},
-		[]string{"code"},
-	)
-	prometheus.MustRegister(metricAntibotResponse)
 	mux.Handle("/metrics", promhttp.Handler())
 
 	mux.HandleFunc("GET /aegis/token", func(w http.ResponseWriter, r *http.Request) {
@@ -88,7 +120,7 @@ func (s *ApiServer) Serve() error {
 			return
 		}
 		fp := s.fingerprintCalculator.Calculate(&rc.Factors)
-		payload, err := s.tokenManager.GetChallenge(&fp)
+		payload, err := route(s.sites.Select(rc.Factors.Host), &fp, rc.Factors.ClientAddress).GetChallenge(&fp)
 		if err != nil {
 			slog.Error("Get challenge", "error", err, "context", rc)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -106,12 +138,16 @@ func (s *ApiServer) Serve() error {
 			return
 		}
 		fp := s.fingerprintCalculator.Calculate(&rc.Factors)
-		payload, err := s.tokenManager.GetToken(&fp, rc.Factors.Body)
+		st := s.sites.Select(rc.Factors.Host)
+		payload, err := route(st, &fp, rc.Factors.ClientAddress).GetToken(&fp, rc.Factors.Body)
 		if err != nil {
 			slog.Error("Get token", "error", err, "context", rc)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		if st.CookieDomain != "" {
+			w.Header().Set(HeaderCookieDomain, st.CookieDomain)
+		}
 		slog.Debug("POST /aegis/token", "rc", rc)
 		w.Write([]byte(payload))
 	})
@@ -123,8 +159,17 @@ func (s *ApiServer) Serve() error {
 			w.WriteHeader(http.StatusUnprocessableEntity)
 			return
 		}
-		s.chain.Execute(rc, NewHttpResponseSender(w))
+		s.chain.Execute(rc, NewHttpResponseSender(w, s.sites.Select(rc.Factors.Host).Name))
 	})
+
+	if s.admin != nil {
+		if s.admin.mounted() {
+			mux.Handle("/admin/", s.admin)
+		}
+		if err := s.admin.Serve(); err != nil {
+			slog.Error("Failed to serve admin API", slog.String("error", err.Error()))
+		}
+	}
 	s.server = &http.Server{
 		Addr:         s.address,
 		Handler:      mux,
@@ -136,5 +181,10 @@ func (s *ApiServer) Serve() error {
 }
 
 func (s *ApiServer) Shutdown(ctx context.Context) error {
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			slog.Error("Failed to stop admin server", slog.String("error", err.Error()))
+		}
+	}
 	return s.server.Shutdown(ctx)
 }
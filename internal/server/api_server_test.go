@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRequestContextCookies verifies that the token cookie is among the matched cookies only if it is sent.
+func TestRequestContextCookies(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/protection", nil)
+	r.Header.Set("X-Original-Host", "Example.com:443")
+	r.Header.Set("Cookie", "session=s1; session=s2")
+	rc, err := requestContext(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", rc.Factors.Host)
+	assert.Equal(t, map[string]string{"session": "s1"}, rc.Factors.Cookies)
+	assert.Empty(t, rc.Factors.Token)
+
+	r.Header.Set("Cookie", "AEGIS_TOKEN=t1; session=s1")
+	rc, err = requestContext(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "t1", rc.Factors.Token)
+	assert.Equal(t, map[string]string{"AEGIS_TOKEN": "t1", "session": "s1"}, rc.Factors.Cookies)
+
+	r.Header.Set("Cookie", "AEGIS_TOKEN=t1; AEGIS_TOKEN=t2")
+	rc, err = requestContext(r)
+	assert.NoError(t, err)
+	assert.Empty(t, rc.Factors.Token)
+	assert.Equal(t, map[string]string{"AEGIS_TOKEN": ""}, rc.Factors.Cookies)
+}
@@ -1,20 +1,49 @@
 package server
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
 
+// StatusBanned is the response code of the banned clients. nginx passes 401 of the auth request through,
+// so it can be mapped to the block page separately from the challenge redirect.
+const StatusBanned = http.StatusUnauthorized
+
+// HttpResponseSender responds to the auth request of nginx. Responses are counted by the code and the site.
 type HttpResponseSender struct {
-	w http.ResponseWriter
+	w    http.ResponseWriter
+	site string
+}
+
+// respond writes and counts the response code.
+func (s *HttpResponseSender) respond(code int) {
+	s.w.WriteHeader(code)
+	metricAntibotResponse.WithLabelValues(strconv.Itoa(code), s.site).Inc()
 }
 
 func (s *HttpResponseSender) Allow() {
-	s.w.WriteHeader(http.StatusNoContent)
+	s.respond(http.StatusNoContent)
 }
 
 func (s *HttpResponseSender) Deny() {
 	s.w.Header().Add("Location", "/aegis/token")
-	s.w.WriteHeader(http.StatusForbidden)
+	s.respond(http.StatusForbidden)
+}
+
+// Reject responds 429 with Retry-After in whole seconds, at least one.
+func (s *HttpResponseSender) Reject(retryAfter time.Duration) {
+	seconds := max((retryAfter+time.Second-1)/time.Second, 1)
+	s.w.Header().Add("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	s.respond(http.StatusTooManyRequests)
+}
+
+// Ban responds StatusBanned without the challenge location.
+func (s *HttpResponseSender) Ban() {
+	s.respond(StatusBanned)
 }
 
-func NewHttpResponseSender(w http.ResponseWriter) *HttpResponseSender {
-	return &HttpResponseSender{w: w}
+// NewHttpResponseSender creates the sender of the responses to the request of the site.
+func NewHttpResponseSender(w http.ResponseWriter, site string) *HttpResponseSender {
+	return &HttpResponseSender{w: w, site: site}
 }
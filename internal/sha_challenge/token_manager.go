@@ -1,22 +1,34 @@
 package sha_challenge
 
 import (
+	"aegis/internal/store"
+	"aegis/internal/tokens"
 	"aegis/internal/usecase"
 	"bytes"
-	"context"
 	"crypto/rand"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"html/template"
 	"log/slog"
 	"os"
-	"sync"
+	"strconv"
 	"time"
 )
 
 const (
 	tokenCookie = "AEGIS_TOKEN"
 	indexPath   = "/usr/share/aegis/sha-challenge/static/index.html"
+
+	// BucketChallenges is the store bucket of the issued challenges
+	BucketChallenges = "sha_challenges"
+	// BucketEscalations is the store bucket of the raised complexities of the fingerprints
+	BucketEscalations = "sha_escalations"
+	challengeTTL      = time.Minute
+
+	// maxComplexity is the length of the hash prefix of the hardest challenge
+	maxComplexity = 4
 )
 
 type TokenGenerationError struct {
@@ -27,29 +39,16 @@ func (e TokenGenerationError) Error() string {
 	return e.message
 }
 
-type token struct {
-	bytes     []byte
-	time      time.Time
-	challenge *challenge
-}
-
-func (t token) String() string {
-	return string(t.bytes)
-}
-
+// challenge is the stored issued challenge. The store key is the base64-encoded challenge.
 type challenge struct {
-	clientFp  *usecase.Fingerprint
-	time      time.Time
-	challenge []byte
+	ClientFp []byte `json:"fingerprint"`
 }
 
 type ShaChallengeTokenManager struct {
 	complexity      int
-	tokens          map[string]*token
+	tokens          tokens.Issuer
 	permanentTokens map[string]struct{}
-	challenges      map[string]*challenge
-	cmu             sync.RWMutex
-	tmu             sync.RWMutex
+	challenges      store.Store
 	template        *template.Template
 }
 
@@ -63,18 +62,45 @@ func (m *ShaChallengeTokenManager) ExtractToken(request *usecase.Request) (token
 	return
 }
 
+// complexityOf returns the complexity of the challenges of the fingerprint raised by the escalations.
+func (m *ShaChallengeTokenManager) complexityOf(fp []byte) int {
+	value, exists, err := m.challenges.Get(BucketEscalations, hex.EncodeToString(fp))
+	if err != nil || !exists {
+		return m.complexity
+	}
+	escalations, _ := strconv.Atoi(string(value))
+	return min(m.complexity+escalations, maxComplexity)
+}
+
+// Escalate raises the complexity of the challenges of the fingerprint by one level for the ttl.
+// The complexity is never raised above the hardest level.
+func (m *ShaChallengeTokenManager) Escalate(fp []byte, ttl time.Duration) error {
+	key := hex.EncodeToString(fp)
+	escalations := m.complexityOf(fp) - m.complexity + 1
+	if m.complexity+escalations > maxComplexity {
+		escalations = maxComplexity - m.complexity
+	}
+	slog.Info("SHA challenge is escalated", "fingerprint", key, "complexity", m.complexity+escalations, "ttl", ttl)
+	return m.challenges.Set(BucketEscalations, key, []byte(strconv.Itoa(escalations)), ttl)
+}
+
 func (m *ShaChallengeTokenManager) GetChallenge(fp *usecase.Fingerprint) ([]byte, error) {
-	c := challenge{clientFp: fp, time: time.Now(), challenge: make([]byte, m.complexity)}
-	rand.Read(c.challenge)
-	m.cmu.Lock()
-	defer m.cmu.Unlock()
-	m.challenges[string(c.challenge)] = &c
+	complexity := m.complexityOf(fp.Value)
+	prefix := make([]byte, complexity)
+	rand.Read(prefix)
+	challengeString := base64.StdEncoding.EncodeToString(prefix)
+	record, err := json.Marshal(challenge{ClientFp: fp.Value})
+	if err != nil {
+		return nil, err
+	}
+	if err = m.challenges.Set(BucketChallenges, challengeString, record, challengeTTL); err != nil {
+		return nil, err
+	}
 	var content bytes.Buffer
-	challengeString := base64.StdEncoding.EncodeToString(c.challenge)
-	err := m.template.Execute(&content, pageData{
+	err = m.template.Execute(&content, pageData{
 		Challenge: challengeString,
 	})
-	slog.Info("SHA challenge is prepared", "fingerprint", fp.String, "complexity", m.complexity, "challenge", challengeString)
+	slog.Info("SHA challenge is prepared", "fingerprint", fp.String, "complexity", complexity, "challenge", challengeString)
 	return content.Bytes(), err
 }
 
@@ -86,60 +112,62 @@ func (m *ShaChallengeTokenManager) GetToken(fp *usecase.Fingerprint, payload []b
 		return
 	}
 	message, err := base64.StdEncoding.DecodeString(string(payload))
-	challenge, solution := message[:m.complexity], message[m.complexity:]
-	m.cmu.Lock()
-	defer m.cmu.Unlock()
-	challengeString := string(challenge)
-	c, exists := m.challenges[challengeString]
-	if !exists {
+	if err != nil || len(message) <= m.complexity {
+		err = TokenGenerationError{message: "wrong solution"}
+		return
+	}
+	// Escalated challenges have longer prefixes
+	var prefix, solution []byte
+	var challengeString string
+	var record []byte
+	var exists bool
+	for complexity := m.complexity; complexity <= maxComplexity && complexity < len(message) && !exists; complexity++ {
+		prefix, solution = message[:complexity], message[complexity:]
+		challengeString = base64.StdEncoding.EncodeToString(prefix)
+		if record, exists, err = m.challenges.Get(BucketChallenges, challengeString); err != nil {
+			return
+		}
+	}
+	var c challenge
+	if !exists || json.Unmarshal(record, &c) != nil {
 		err = TokenGenerationError{message: "wrong challenge"}
 		return
 	}
-	if !bytes.Equal(fp.Value, c.clientFp.Value) {
+	if !bytes.Equal(fp.Value, c.ClientFp) {
 		err = TokenGenerationError{message: "wrong client"}
 		return
 	}
 	solutionHash := sha512.Sum512(solution)
-	for i, b := range challenge {
+	for i, b := range prefix {
 		if solutionHash[i] != b {
 			err = TokenGenerationError{message: "wrong solution"}
 			return
 		}
 	}
-	r := make([]byte, 32)
-	rand.Read(r)
-	t = base64.StdEncoding.EncodeToString(r)
-	m.tmu.Lock()
-	defer m.tmu.Unlock()
-	m.tokens[t] = &token{bytes: []byte(t), time: time.Now(), challenge: c}
-	slog.Info("Token is issued", "fingerprint", fp.String, "token", t, "challenge", challenge, "solution", solution)
-	delete(m.challenges, challengeString)
+	// The challenge is solved only once even if the solution is sent concurrently
+	if deleted, _ := m.challenges.Delete(BucketChallenges, challengeString); !deleted {
+		err = TokenGenerationError{message: "wrong challenge"}
+		return
+	}
+	t, err = m.tokens.Issue(fp)
+	if err != nil {
+		return
+	}
+	slog.Info("Token is issued", "fingerprint", fp.String, "token", t, "challenge", prefix, "solution", solution)
 	return
 }
 
-// Validates token and returns true if the token is valid.
-func (m *ShaChallengeTokenManager) Validate(clientFp *usecase.Fingerprint, token string) bool {
-	m.tmu.RLock()
-	defer m.tmu.RUnlock()
+// Validates token and returns nil if the token is valid. Otherwise the error contains the rejection reason.
+func (m *ShaChallengeTokenManager) Validate(clientFp *usecase.Fingerprint, token string) error {
 	if _, exists := m.permanentTokens[token]; exists {
-		return true
-	}
-	storedToken, exists := m.tokens[token]
-	if !exists {
-		return false
+		return nil
 	}
-	if !bytes.Equal(storedToken.challenge.clientFp.Value, clientFp.Value) {
-		return false
-	}
-	return true
+	return m.tokens.Validate(clientFp, token)
 }
 
 // Revoke token if it exists. Returns true is token exists ant was revoked.
 func (m *ShaChallengeTokenManager) Revoke(token string) bool {
-	m.tmu.Lock()
-	defer m.tmu.Unlock()
-	_, revoked := m.tokens[token]
-	delete(m.tokens, token)
+	revoked := m.tokens.Revoke(token)
 	slog.Debug("Revoked token", "token", token)
 	return revoked
 }
@@ -149,24 +177,12 @@ func (m *ShaChallengeTokenManager) GetComplexity() int {
 	return m.complexity
 }
 
-func (m *ShaChallengeTokenManager) Serve(ctx context.Context) {
-	m.cmu.Lock()
-	defer m.cmu.Unlock()
-	ticker := time.NewTicker(time.Second)
-	select {
-	case <-ticker.C:
-		ticker.Stop()
-		return
-	case <-ctx.Done():
-		for k, v := range m.challenges {
-			if time.Since(v.time) > time.Minute {
-				delete(m.challenges, k)
-			}
-		}
-	}
+// Assets returns the files required by the JS challenge.
+func Assets() []string {
+	return []string{indexPath}
 }
 
-func NewShaChallengeTokenManager(permanentTokens []string, complexity string) *ShaChallengeTokenManager {
+func NewShaChallengeTokenManager(permanentTokens []string, complexity string, issuer tokens.Issuer, challenges store.Store) *ShaChallengeTokenManager {
 	var complexityLevel int
 	switch complexity {
 	case "easy":
@@ -185,8 +201,8 @@ func NewShaChallengeTokenManager(permanentTokens []string, complexity string) *S
 	}
 	tm := ShaChallengeTokenManager{
 		complexity:      complexityLevel,
-		tokens:          make(map[string]*token),
-		challenges:      make(map[string]*challenge),
+		tokens:          issuer,
+		challenges:      challenges,
 		template:        template.Must(template.New("sha-challenge").Parse(string(pageContent))),
 		permanentTokens: make(map[string]struct{}),
 	}
@@ -0,0 +1,152 @@
+// Package site selects the protection profile of the request by the original Host header.
+package site
+
+import (
+	"aegis/internal/limiter"
+	"aegis/internal/middleware"
+	"aegis/internal/usecase"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Site is the running protection profile of a group of hosts: its protections, rate limits and tokens.
+type Site struct {
+	Name         string
+	CookieDomain string // Domain of the token cookie, the requested host if empty
+	TokenManager usecase.TokenManager
+	Protector    *middleware.PathProtector
+	Limiter      *limiter.RpsLimiter
+}
+
+// hostGlob is the glob of the hosts of a site.
+type hostGlob struct {
+	glob string
+	site *Site
+}
+
+// IsGlob returns true if the host is a glob, e.g. "*.example.com".
+func IsGlob(host string) bool {
+	return strings.ContainsAny(host, "*?[")
+}
+
+// Sites selects the site of the request host. Exact hosts take precedence over the globs, the globs are
+// matched in the order the sites are added. Requests of other hosts belong to the default site.
+type Sites struct {
+	next     middleware.Middleware[usecase.HttpFactors]
+	fallback *Site
+	sites    []*Site
+	exact    map[string]*Site
+	globs    []hostGlob
+}
+
+// Add adds the site serving the hosts. The hosts are lowercase without the port.
+//
+// Returns:
+//   - error: Non-nil if a glob is malformed or a host belongs to another site. The site is not added then.
+func (s *Sites) Add(site *Site, hosts []string) error {
+	for _, host := range hosts {
+		if other, found := s.exact[host]; found {
+			return fmt.Errorf("host %s belongs to the sites %s and %s", host, other.Name, site.Name)
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("host %s: %w", host, err)
+		}
+	}
+	for _, host := range hosts {
+		if IsGlob(host) {
+			s.globs = append(s.globs, hostGlob{glob: host, site: site})
+		} else {
+			s.exact[host] = site
+		}
+	}
+	if site.Protector != nil {
+		site.Protector.Bind(s.next)
+	}
+	s.sites = append(s.sites, site)
+	return nil
+}
+
+// Select returns the site of the host, the default site if no site serves it.
+func (s *Sites) Select(host string) *Site {
+	if site, found := s.exact[host]; found {
+		return site
+	}
+	for _, g := range s.globs {
+		if matched, _ := path.Match(g.glob, host); matched {
+			return g.site
+		}
+	}
+	return s.fallback
+}
+
+// Get returns the site by the name.
+func (s *Sites) Get(name string) (*Site, bool) {
+	for _, site := range s.sites {
+		if site.Name == name {
+			return site, true
+		}
+	}
+	return nil, false
+}
+
+// All returns the default site followed by the other sites in the order they are added.
+func (s *Sites) All() []*Site {
+	return s.sites
+}
+
+// Counters returns the rate limiter counters of all sites.
+func (s *Sites) Counters() []usecase.EndpointCounters {
+	counters := []usecase.EndpointCounters{}
+	for _, site := range s.sites {
+		if site.Limiter != nil {
+			counters = append(counters, site.Limiter.Counters()...)
+		}
+	}
+	return counters
+}
+
+// SiteProtections returns the effective protection rules of the site, the default site if the name is empty.
+func (s *Sites) SiteProtections(name string) ([]usecase.Protection, bool) {
+	if name == "" {
+		return s.fallback.Protector.Protections(), true
+	}
+	site, found := s.Get(name)
+	if !found {
+		return nil, false
+	}
+	return site.Protector.Protections(), true
+}
+
+// Handle checks the request with the protector of the site of the request host.
+func (s *Sites) Handle(request *usecase.RequestContext[usecase.HttpFactors], response middleware.ResponseSender) {
+	s.Select(request.Factors.Host).Protector.Handle(request, response)
+}
+
+// Bind binds the protectors of all sites to the next middleware.
+func (s *Sites) Bind(next middleware.Middleware[usecase.HttpFactors]) {
+	s.next = next
+	for _, site := range s.sites {
+		if site.Protector != nil {
+			site.Protector.Bind(next)
+		}
+	}
+}
+
+// Tighten multiplies the per-client limits of all sites by the factor, 1 restores them.
+func (s *Sites) Tighten(factor float64) {
+	for _, site := range s.sites {
+		if site.Limiter != nil {
+			site.Limiter.Tighten(factor)
+		}
+	}
+}
+
+// NewSites creates the selector of the sites serving the hosts of no other site with the default one.
+func NewSites(fallback *Site) *Sites {
+	return &Sites{
+		fallback: fallback,
+		sites:    []*Site{fallback},
+		exact:    map[string]*Site{},
+	}
+}
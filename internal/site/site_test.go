@@ -0,0 +1,35 @@
+package site_test
+
+import (
+	"aegis/internal/site"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSelect verifies that exact hosts take precedence over the globs, the globs are matched in the order
+// of the sites and other hosts belong to the default site.
+func TestSelect(t *testing.T) {
+	fallback := &site.Site{Name: "default"}
+	sites := site.NewSites(fallback)
+	shop := &site.Site{Name: "shop"}
+	wildcard := &site.Site{Name: "wildcard"}
+	api := &site.Site{Name: "api"}
+	assert.NoError(t, sites.Add(shop, []string{"shop.example.com", "*.shop.example.com"}))
+	assert.NoError(t, sites.Add(wildcard, []string{"*.example.com"}))
+	assert.NoError(t, sites.Add(api, []string{"api.example.com"}))
+	assert.Error(t, sites.Add(&site.Site{Name: "other"}, []string{"api.example.com"}))
+	assert.Error(t, sites.Add(&site.Site{Name: "broken"}, []string{"[a-"}))
+
+	assert.Equal(t, shop, sites.Select("shop.example.com"))
+	assert.Equal(t, shop, sites.Select("eu.shop.example.com"))
+	assert.Equal(t, api, sites.Select("api.example.com"))
+	assert.Equal(t, wildcard, sites.Select("blog.example.com"))
+	assert.Equal(t, fallback, sites.Select("example.com"))
+	assert.Equal(t, fallback, sites.Select(""))
+
+	found, exists := sites.Get("api")
+	assert.True(t, exists)
+	assert.Equal(t, api, found)
+	assert.Equal(t, []*site.Site{fallback, shop, wildcard, api}, sites.All())
+}
@@ -0,0 +1,297 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFile  = "snapshot.jsonl"
+	logFile       = "journal.jsonl"
+	flushInterval = time.Second
+
+	DefaultSnapshotInterval = 5 * time.Minute
+
+	opSet    = "set"
+	opDelete = "del"
+)
+
+// entry is a line of the journal and of the snapshot.
+type entry struct {
+	Op      string `json:"op"`
+	Bucket  string `json:"b"`
+	Key     string `json:"k"`
+	Value   []byte `json:"v,omitempty"`
+	Expires int64  `json:"e,omitempty"` // Unix milliseconds, 0 if the record never expires
+}
+
+// FileStore is an embedded on-disk store. Records are served from memory, every change is appended
+// to the journal which is periodically compacted into the snapshot. On start the snapshot and the
+// journal are replayed, so records survive restarts.
+type FileStore struct {
+	*MemoryStore
+	dir              string
+	snapshotInterval time.Duration
+	journal          *os.File
+	writer           *bufio.Writer
+	mu               sync.Mutex
+}
+
+// errJournalClosed is returned by the changes of the closed store.
+var errJournalClosed = errors.New("store journal is closed")
+
+// append writes the change to the journal. The caller must hold the lock.
+func (s *FileStore) append(e *entry) error {
+	if s.writer == nil {
+		return errJournalClosed
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = s.writer.Write(line); err != nil {
+		return err
+	}
+	return s.writer.WriteByte('\n')
+}
+
+func (s *FileStore) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	r := record{bucket: bucket, key: key, value: value, expires: expires}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MemoryStore.put(&r)
+	return s.append(toEntry(&r))
+}
+
+func (s *FileStore) Delete(bucket, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted, _ := s.MemoryStore.Delete(bucket, key)
+	if !deleted {
+		return false, nil
+	}
+	return true, s.append(&entry{Op: opDelete, Bucket: bucket, Key: key})
+}
+
+// toEntry converts the record to the journal entry.
+func toEntry(r *record) *entry {
+	e := entry{Op: opSet, Bucket: r.bucket, Key: r.key, Value: r.value}
+	if !r.expires.IsZero() {
+		e.Expires = r.expires.UnixMilli()
+	}
+	return &e
+}
+
+// replay applies the entries of the file to the memory. A damaged tail of the file, which may be
+// left after a crash, is skipped.
+func (s *FileStore) replay(path string) (applied int, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	now := time.Now()
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var e entry
+		if err = decoder.Decode(&e); err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Damaged store file is partially loaded", "file", path, "entries", applied, "error", err.Error())
+			}
+			return applied, nil
+		}
+		switch e.Op {
+		case opSet:
+			r := record{bucket: e.Bucket, key: e.Key, value: e.Value}
+			if e.Expires != 0 {
+				r.expires = time.UnixMilli(e.Expires)
+				if r.expired(now) {
+					s.MemoryStore.Delete(e.Bucket, e.Key)
+					continue
+				}
+			}
+			s.MemoryStore.put(&r)
+		case opDelete:
+			s.MemoryStore.Delete(e.Bucket, e.Key)
+		}
+		applied++
+	}
+}
+
+// snapshot writes all alive records into the snapshot and truncates the journal.
+// The caller must hold the lock.
+func (s *FileStore) snapshot() (err error) {
+	if s.writer != nil {
+		if err = s.writer.Flush(); err != nil {
+			return
+		}
+	}
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	now := time.Now()
+	records := 0
+	for _, r := range s.MemoryStore.snapshot("") {
+		if r.expired(now) {
+			continue
+		}
+		if err = encoder.Encode(toEntry(r)); err != nil {
+			f.Close()
+			return
+		}
+		records++
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return
+	}
+	// The new journal is opened before the old one is closed, so the store keeps journaling into the old one
+	// if it fails. Replaying the old journal over the snapshot restores the same records.
+	journal, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal = journal
+	s.writer = bufio.NewWriter(s.journal)
+	slog.Debug("Store snapshot is written", "records", records)
+	return
+}
+
+// flush writes buffered journal entries to the file.
+func (s *FileStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil {
+		return errJournalClosed
+	}
+	return s.writer.Flush()
+}
+
+// compact writes the snapshot of the open store.
+func (s *FileStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return errJournalClosed
+	}
+	return s.snapshot()
+}
+
+// Serve flushes the journal every second, periodically writes snapshots and removes expired records
+// until the context is canceled or the store is closed.
+func (s *FileStore) Serve(ctx context.Context) {
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+	snapshotTicker := time.NewTicker(s.snapshotInterval)
+	defer snapshotTicker.Stop()
+	sweepTicker := time.NewTicker(sweepInterval)
+	defer sweepTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushTicker.C:
+			err := s.flush()
+			if errors.Is(err, errJournalClosed) {
+				return
+			}
+			if err != nil {
+				slog.Error("Failed to flush store journal", slog.String("error", err.Error()))
+			}
+		case <-snapshotTicker.C:
+			err := s.compact()
+			if errors.Is(err, errJournalClosed) {
+				return
+			}
+			if err != nil {
+				slog.Error("Failed to write store snapshot", slog.String("error", err.Error()))
+			}
+		case <-sweepTicker.C:
+			s.MemoryStore.sweep()
+		}
+	}
+}
+
+// Close writes the final snapshot and closes the journal. Changes of the closed store return an error.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return errJournalClosed
+	}
+	err := s.snapshot()
+	s.journal.Close()
+	s.journal = nil
+	s.writer = nil
+	return err
+}
+
+// NewFileStore loads the store from the directory. The directory is created if it does not exist.
+//
+// Parameters:
+//   - dir: Directory with the snapshot and the journal.
+//   - snapshotInterval: Period of the journal compaction, DefaultSnapshotInterval if it is not positive.
+//   - capacities: Maximum number of records per bucket. Buckets which are absent are unlimited.
+//
+// Returns:
+//   - *FileStore: Store with the loaded records.
+//   - error: Non-nil if the directory or the files are not accessible.
+func NewFileStore(dir string, snapshotInterval time.Duration, capacities map[string]int) (*FileStore, error) {
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := FileStore{
+		MemoryStore:      NewMemoryStore(capacities),
+		dir:              dir,
+		snapshotInterval: snapshotInterval,
+	}
+	snapshotEntries, err := s.replay(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	journalEntries, err := s.replay(filepath.Join(dir, logFile))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.snapshot(); err != nil {
+		return nil, err
+	}
+	slog.Info("Store is loaded", "dir", dir, "snapshot", snapshotEntries, "journal", journalEntries)
+	return &s, nil
+}
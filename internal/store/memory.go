@@ -0,0 +1,195 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const sweepInterval = 10 * time.Second
+
+// record is a stored value with its expiration time. Zero expiration time means the record never expires.
+type record struct {
+	bucket  string
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (r *record) expired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
+
+// bucket keeps records in the order of usage, the most recently used record is at the front.
+type bucket struct {
+	records  map[string]*list.Element
+	lru      *list.List
+	capacity int
+}
+
+// MemoryStore keeps records in memory. If the bucket has a capacity, the least recently used
+// records are evicted when the capacity is exceeded.
+type MemoryStore struct {
+	buckets    map[string]*bucket
+	capacities map[string]int
+	mu         sync.Mutex
+}
+
+// lookup returns the bucket by name and creates it if necessary. The caller must hold the lock.
+func (s *MemoryStore) lookup(name string) *bucket {
+	b, exists := s.buckets[name]
+	if !exists {
+		b = &bucket{
+			records:  make(map[string]*list.Element),
+			lru:      list.New(),
+			capacity: s.capacities[name],
+		}
+		s.buckets[name] = b
+	}
+	return b
+}
+
+// remove deletes the record from the bucket. The caller must hold the lock.
+func (s *MemoryStore) remove(b *bucket, e *list.Element) {
+	r := b.lru.Remove(e).(*record)
+	delete(b.records, r.key)
+}
+
+func (s *MemoryStore) Get(bucket, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.lookup(bucket)
+	e, exists := b.records[key]
+	if !exists {
+		return nil, false, nil
+	}
+	r := e.Value.(*record)
+	if r.expired(time.Now()) {
+		s.remove(b, e)
+		metricStoreEvicted.WithLabelValues(bucket, "expired").Inc()
+		return nil, false, nil
+	}
+	b.lru.MoveToFront(e)
+	return r.value, true, nil
+}
+
+func (s *MemoryStore) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	s.put(&record{bucket: bucket, key: key, value: value, expires: expires})
+	return nil
+}
+
+// put stores the record and evicts the least recently used records above the bucket capacity.
+func (s *MemoryStore) put(r *record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.lookup(r.bucket)
+	if e, exists := b.records[r.key]; exists {
+		e.Value = r
+		b.lru.MoveToFront(e)
+		return
+	}
+	b.records[r.key] = b.lru.PushFront(r)
+	for b.capacity > 0 && b.lru.Len() > b.capacity {
+		s.remove(b, b.lru.Back())
+		metricStoreEvicted.WithLabelValues(r.bucket, "capacity").Inc()
+	}
+}
+
+func (s *MemoryStore) Delete(bucket, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.lookup(bucket)
+	e, exists := b.records[key]
+	if exists {
+		s.remove(b, e)
+	}
+	return exists, nil
+}
+
+func (s *MemoryStore) Range(bucket string, fn func(key string, value []byte) bool) error {
+	now := time.Now()
+	for _, r := range s.snapshot(bucket) {
+		if !r.expired(now) && !fn(r.key, r.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// snapshot returns records of the bucket or of all buckets if the name is empty.
+// The callback of Range may call the store, so records are copied out of the lock.
+func (s *MemoryStore) snapshot(name string) []*record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []*record
+	for bucketName, b := range s.buckets {
+		if name != "" && name != bucketName {
+			continue
+		}
+		for e := b.lru.Back(); e != nil; e = e.Prev() {
+			records = append(records, e.Value.(*record))
+		}
+	}
+	return records
+}
+
+func (s *MemoryStore) Len(bucket string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(bucket).lru.Len(), nil
+}
+
+// sweep removes expired records from all buckets.
+func (s *MemoryStore) sweep() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, b := range s.buckets {
+		removed := 0
+		for _, e := range b.records {
+			if e.Value.(*record).expired(now) {
+				s.remove(b, e)
+				removed++
+			}
+		}
+		if removed > 0 {
+			metricStoreEvicted.WithLabelValues(name, "expired").Add(float64(removed))
+			slog.Debug("Expired records are removed", "bucket", name, "removed", removed, "stored", b.lru.Len())
+		}
+	}
+}
+
+// Serve periodically removes expired records until the context is canceled.
+func (s *MemoryStore) Serve(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// NewMemoryStore creates an empty in-memory store.
+//
+// Parameters:
+//   - capacities: Maximum number of records per bucket. Buckets which are absent are unlimited.
+func NewMemoryStore(capacities map[string]int) *MemoryStore {
+	return &MemoryStore{
+		buckets:    make(map[string]*bucket),
+		capacities: capacities,
+	}
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRedisPoolSize = 16
+	DefaultRedisTimeout  = time.Second
+
+	scanBatch = 1000
+)
+
+// RedisOptions describes the connection to a Redis-compatible server.
+type RedisOptions struct {
+	Address  string        // Server address, host:port
+	Username string        // ACL user name, optional
+	Password string        // Password, optional
+	DB       int           // Database number
+	Prefix   string        // Prefix of all keys, allows several installations to share the server
+	PoolSize int           // Maximum number of idle connections
+	Timeout  time.Duration // Dial and command timeout
+}
+
+// RedisStore keeps records in a Redis-compatible server, so several Aegis instances share tokens,
+// revocations and challenges. Expiration is done by the server. Bucket capacities are not applied,
+// configure the eviction policy of the server instead.
+type RedisStore struct {
+	options RedisOptions
+	pool    chan *respConn
+}
+
+// key returns the server key of the record.
+func (s *RedisStore) key(bucket, key string) string {
+	return s.options.Prefix + bucket + ":" + key
+}
+
+// do runs the command on a pooled connection. Connections with transport errors are dropped.
+func (s *RedisStore) do(args ...string) (any, error) {
+	var c *respConn
+	select {
+	case c = <-s.pool:
+	default:
+		var err error
+		c, err = dialResp(s.options.Address, s.options.Username, s.options.Password, s.options.DB, s.options.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(args...)
+	var respErr RespError
+	if err != nil && !errors.As(err, &respErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case s.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+func (s *RedisStore) Get(bucket, key string) ([]byte, bool, error) {
+	reply, err := s.do("GET", s.key(bucket, key))
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return value, true, nil
+}
+
+func (s *RedisStore) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", s.key(bucket, key), string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+func (s *RedisStore) Delete(bucket, key string) (bool, error) {
+	reply, err := s.do("DEL", s.key(bucket, key))
+	if err != nil {
+		return false, err
+	}
+	deleted, _ := reply.(int64)
+	return deleted > 0, nil
+}
+
+// scan calls fn with batches of the server keys of the bucket until fn returns false.
+func (s *RedisStore) scan(bucket string, fn func(keys []string) (bool, error)) error {
+	pattern := escapeGlob(s.key(bucket, "")) + "*"
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(scanBatch))
+		if err != nil {
+			return err
+		}
+		values, ok := reply.([]any)
+		if !ok || len(values) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply %T", reply)
+		}
+		next, _ := values[0].([]byte)
+		items, _ := values[1].([]any)
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if k, ok := item.([]byte); ok {
+				keys = append(keys, string(k))
+			}
+		}
+		if len(keys) > 0 {
+			if proceed, err := fn(keys); err != nil || !proceed {
+				return err
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (s *RedisStore) Range(bucket string, fn func(key string, value []byte) bool) error {
+	prefix := s.key(bucket, "")
+	return s.scan(bucket, func(keys []string) (bool, error) {
+		reply, err := s.do(append([]string{"MGET"}, keys...)...)
+		if err != nil {
+			return false, err
+		}
+		values, _ := reply.([]any)
+		for i := range values {
+			// The record may expire between SCAN and MGET
+			value, ok := values[i].([]byte)
+			if ok && i < len(keys) && !fn(strings.TrimPrefix(keys[i], prefix), value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+func (s *RedisStore) Len(bucket string) (n int, err error) {
+	err = s.scan(bucket, func(keys []string) (bool, error) {
+		n += len(keys)
+		return true, nil
+	})
+	return
+}
+
+// Serve does nothing, records are expired by the server.
+func (s *RedisStore) Serve(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// escapeGlob escapes special characters of the SCAN MATCH pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// NewRedisStore creates a store on top of a Redis-compatible server and checks the connection.
+//
+// Parameters:
+//   - options: Server address, credentials and pool settings. Zero pool size and timeout are replaced
+//     with defaults.
+//
+// Returns:
+//   - *RedisStore: Connected store.
+//   - error: Non-nil if the server is not reachable or refuses the credentials.
+func NewRedisStore(options RedisOptions) (*RedisStore, error) {
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultRedisPoolSize
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultRedisTimeout
+	}
+	if _, _, err := net.SplitHostPort(options.Address); err != nil {
+		return nil, err
+	}
+	s := RedisStore{
+		options: options,
+		pool:    make(chan *respConn, options.PoolSize),
+	}
+	if _, err := s.do("PING"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,56 @@
+package store_test
+
+import (
+	"aegis/internal/store"
+	"aegis/internal/store/resptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRedisStore verifies records, server-side expiration and ranging over a bucket
+// against the in-process RESP server.
+func TestRedisStore(t *testing.T) {
+	server, err := resptest.NewServer("secret")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	_, err = store.NewRedisStore(store.RedisOptions{Address: server.Addr(), Password: "wrong"})
+	assert.Error(t, err)
+
+	s, err := store.NewRedisStore(store.RedisOptions{Address: server.Addr(), Password: "secret", Prefix: "aegis:"})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Set("tokens", "a+b/c=", []byte("1"), time.Hour))
+	assert.NoError(t, s.Set("tokens", "short", []byte("2"), 20*time.Millisecond))
+	assert.NoError(t, s.Set("denied", "d", []byte{}, 0))
+
+	value, exists, err := s.Get("tokens", "a+b/c=")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []byte("1"), value)
+	_, exists, _ = s.Get("denied", "d")
+	assert.True(t, exists)
+
+	time.Sleep(30 * time.Millisecond)
+	_, exists, _ = s.Get("tokens", "short")
+	assert.False(t, exists)
+
+	records := map[string]string{}
+	assert.NoError(t, s.Range("tokens", func(key string, value []byte) bool {
+		records[key] = string(value)
+		return true
+	}))
+	assert.Equal(t, map[string]string{"a+b/c=": "1"}, records)
+	n, _ := s.Len("tokens")
+	assert.Equal(t, 1, n)
+
+	deleted, err := s.Delete("tokens", "a+b/c=")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, _ = s.Delete("tokens", "a+b/c=")
+	assert.False(t, deleted)
+	assert.Equal(t, 1, server.Len())
+}
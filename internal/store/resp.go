@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RespError is an error reply of the server.
+type RespError struct {
+	message string
+}
+
+func (e RespError) Error() string {
+	return e.message
+}
+
+// respConn is a connection speaking the Redis serialization protocol (RESP2).
+type respConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+// do sends the command and reads the reply. Replies are returned as:
+//   - string for simple strings
+//   - []byte or nil for bulk strings
+//   - int64 for integers
+//   - []any or nil for arrays
+//   - RespError for errors
+func (c *respConn) do(args ...string) (reply any, err error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err = c.writer.Flush(); err != nil {
+		return
+	}
+	return readReply(c.reader)
+}
+
+// readLine reads a line terminated by CRLF without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("resp: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a single RESP value.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RespError{message: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			// Errors of the nested values are returned as values
+			values[i], err = readReply(r)
+			if respErr, ok := err.(RespError); ok {
+				values[i], err = respErr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("resp: unknown reply type %q", line[0])
+	}
+}
+
+// dialResp connects to the server, authenticates and selects the database.
+func dialResp(address, username, password string, db int, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := respConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+	if password != "" {
+		args := []string{"AUTH", password}
+		if username != "" {
+			args = []string{"AUTH", username, password}
+		}
+		if _, err = c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &c, nil
+}
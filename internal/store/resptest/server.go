@@ -0,0 +1,260 @@
+// Package resptest provides an in-process stand-in of a Redis-compatible server for tests.
+package resptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type value struct {
+	data    string
+	expires time.Time
+}
+
+// Server implements the subset of commands used by the store: PING, AUTH, SELECT, GET, SET with PX or EX,
+// DEL, MGET and SCAN with a prefix MATCH pattern. Every SCAN returns all matching keys at once.
+type Server struct {
+	listener net.Listener
+	password string
+	values   map[string]value
+	conns    map[net.Conn]struct{}
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, drops the connections and waits for them to finish.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Len returns the number of alive keys.
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.values {
+		if _, exists := s.get(key); exists {
+			n++
+		}
+	}
+	return n
+}
+
+// get returns the alive value. The caller must hold the lock.
+func (s *Server) get(key string) (string, bool) {
+	v, exists := s.values[key]
+	if !exists {
+		return "", false
+	}
+	if !v.expires.IsZero() && time.Now().After(v.expires) {
+		delete(s.values, key)
+		return "", false
+	}
+	return v.data, true
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authenticated := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "AUTH":
+			if args[len(args)-1] != s.password {
+				writeError(w, "WRONGPASS invalid password")
+			} else {
+				authenticated = true
+				w.WriteString("+OK\r\n")
+			}
+		case !authenticated:
+			writeError(w, "NOAUTH Authentication required")
+		default:
+			s.execute(w, command, args[1:])
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) execute(w *bufio.Writer, command string, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch command {
+	case "PING":
+		w.WriteString("+PONG\r\n")
+	case "SELECT":
+		w.WriteString("+OK\r\n")
+	case "GET":
+		if v, exists := s.get(args[0]); exists {
+			writeBulk(w, v)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case "MGET":
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, key := range args {
+			if v, exists := s.get(key); exists {
+				writeBulk(w, v)
+			} else {
+				w.WriteString("$-1\r\n")
+			}
+		}
+	case "SET":
+		v := value{data: args[1]}
+		for i := 2; i+1 < len(args); i += 2 {
+			n, _ := strconv.ParseInt(args[i+1], 10, 64)
+			switch strings.ToUpper(args[i]) {
+			case "PX":
+				v.expires = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EX":
+				v.expires = time.Now().Add(time.Duration(n) * time.Second)
+			}
+		}
+		s.values[args[0]] = v
+		w.WriteString("+OK\r\n")
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			if _, exists := s.get(key); exists {
+				delete(s.values, key)
+				deleted++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", deleted)
+	case "SCAN":
+		prefix := ""
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				prefix = unescape(strings.TrimSuffix(args[i+1], "*"))
+			}
+		}
+		var keys []string
+		for key := range s.values {
+			if _, exists := s.get(key); exists && strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		fmt.Fprintf(w, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			writeBulk(w, key)
+		}
+	default:
+		writeError(w, "ERR unknown command '"+command+"'")
+	}
+}
+
+func unescape(pattern string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeError(w *bufio.Writer, message string) {
+	w.WriteString("-" + message + "\r\n")
+}
+
+// readCommand reads an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// NewServer starts a server on a random local port. If the password is not empty, clients must authenticate.
+func NewServer(password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := Server{
+		listener: listener,
+		password: password,
+		values:   make(map[string]value),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return &s, nil
+}
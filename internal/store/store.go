@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MetricStoreEvicted = "store_evicted"
+)
+
+// Storage types
+const (
+	TypeMemory = "memory"
+	TypeFile   = "file"
+	TypeRedis  = "redis"
+)
+
+var metricStoreEvicted = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: MetricStoreEvicted,
+	},
+	[]string{"bucket", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(metricStoreEvicted)
+}
+
+// Store keeps records grouped into buckets. Every record may have a TTL after which it disappears.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the record value and true if the record exists.
+	Get(bucket, key string) ([]byte, bool, error)
+	// Set creates or replaces the record. Zero TTL means the record never expires.
+	Set(bucket, key string, value []byte, ttl time.Duration) error
+	// Delete removes the record. Returns true if the record existed.
+	Delete(bucket, key string) (bool, error)
+	// Range calls fn for every record of the bucket until fn returns false.
+	Range(bucket string, fn func(key string, value []byte) bool) error
+	// Len returns the number of records in the bucket.
+	Len(bucket string) (int, error)
+	// Serve runs background maintenance until the context is canceled.
+	Serve(ctx context.Context)
+	// Close flushes pending changes and releases resources.
+	Close() error
+}
@@ -0,0 +1,122 @@
+package store_test
+
+import (
+	"aegis/internal/store"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemoryStoreCapacity verifies that the least recently used record is evicted
+// when the bucket capacity is exceeded and other buckets are not affected.
+func TestMemoryStoreCapacity(t *testing.T) {
+	s := store.NewMemoryStore(map[string]int{"limited": 2})
+	s.Set("limited", "first", []byte("1"), 0)
+	s.Set("limited", "second", []byte("2"), 0)
+	s.Set("unlimited", "first", []byte("1"), 0)
+	s.Get("limited", "first")
+	s.Set("limited", "third", []byte("3"), 0)
+
+	_, exists, _ := s.Get("limited", "second")
+	assert.False(t, exists)
+	value, exists, _ := s.Get("limited", "first")
+	assert.True(t, exists)
+	assert.Equal(t, []byte("1"), value)
+	n, _ := s.Len("limited")
+	assert.Equal(t, 2, n)
+	n, _ = s.Len("unlimited")
+	assert.Equal(t, 1, n)
+}
+
+// TestMemoryStoreExpiration verifies that records disappear after their TTL.
+func TestMemoryStoreExpiration(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	s.Set("bucket", "short", []byte("1"), 20*time.Millisecond)
+	s.Set("bucket", "long", []byte("2"), time.Hour)
+	time.Sleep(30 * time.Millisecond)
+
+	_, exists, _ := s.Get("bucket", "short")
+	assert.False(t, exists)
+	var keys []string
+	s.Range("bucket", func(key string, value []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"long"}, keys)
+}
+
+// TestFileStoreReload verifies that records, deletions and expiration survive reopening of the store,
+// including the journal which was not compacted into the snapshot.
+func TestFileStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.NewFileStore(dir, time.Hour, nil)
+	assert.NoError(t, err)
+	s.Set("bucket", "kept", []byte("1"), time.Hour)
+	s.Set("bucket", "deleted", []byte("2"), 0)
+	s.Set("bucket", "expired", []byte("3"), 20*time.Millisecond)
+	s.Delete("bucket", "deleted")
+	assert.NoError(t, s.Close())
+
+	s, err = store.NewFileStore(dir, time.Hour, nil)
+	assert.NoError(t, err)
+	s.Set("bucket", "journaled", []byte("4"), 0)
+	// Simulate a crash: the journal is flushed by the background routine but the final snapshot is not written
+	ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+	defer cancel()
+	s.Serve(ctx)
+
+	s, err = store.NewFileStore(dir, time.Hour, nil)
+	assert.NoError(t, err)
+	value, exists, _ := s.Get("bucket", "kept")
+	assert.True(t, exists)
+	assert.Equal(t, []byte("1"), value)
+	_, exists, _ = s.Get("bucket", "deleted")
+	assert.False(t, exists)
+	_, exists, _ = s.Get("bucket", "expired")
+	assert.False(t, exists)
+	value, exists, _ = s.Get("bucket", "journaled")
+	assert.True(t, exists)
+	assert.Equal(t, []byte("4"), value)
+}
+
+// TestFileStoreDamagedJournal verifies that a damaged tail of the journal does not prevent loading.
+func TestFileStoreDamagedJournal(t *testing.T) {
+	dir := t.TempDir()
+	journal := `{"op":"set","b":"bucket","k":"kept","v":"MQ=="}` + "\n" + `{"op":"set","b":"buck`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "journal.jsonl"), []byte(journal), 0600))
+
+	s, err := store.NewFileStore(dir, time.Hour, nil)
+	assert.NoError(t, err)
+	value, exists, _ := s.Get("bucket", "kept")
+	assert.True(t, exists)
+	assert.Equal(t, []byte("1"), value)
+}
+
+// TestFileStoreClose verifies that the store keeps journaling when the journal can not be reopened by the snapshot
+// and refuses the changes after it is closed.
+func TestFileStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.NewFileStore(dir, 20*time.Millisecond, nil)
+	assert.NoError(t, err)
+	journal := filepath.Join(dir, "journal.jsonl")
+	assert.NoError(t, os.Remove(journal))
+	assert.NoError(t, os.Mkdir(journal, 0700))
+	ctx, cancel := context.WithTimeout(context.Background(), 1100*time.Millisecond)
+	defer cancel()
+	s.Serve(ctx)
+	assert.NoError(t, s.Set("bucket", "key", []byte("1"), 0))
+
+	assert.NoError(t, os.Remove(journal))
+	assert.NoError(t, s.Close())
+	assert.Error(t, s.Set("bucket", "key", []byte("2"), 0))
+	assert.Error(t, s.Close())
+
+	s, err = store.NewFileStore(dir, time.Hour, nil)
+	assert.NoError(t, err)
+	value, _, _ := s.Get("bucket", "key")
+	assert.Equal(t, []byte("1"), value)
+}
@@ -0,0 +1,49 @@
+package strikes
+
+import (
+	"aegis/internal/usecase"
+	"time"
+)
+
+// TokenManager shows the captcha instead of the JS challenge to the repeat offenders. Tokens issued
+// by both verifications are validated by the JS challenge manager which shares the token issuer.
+type TokenManager struct {
+	usecase.TokenManager
+	captcha usecase.TokenManager
+	tracker *Tracker
+}
+
+// Route returns the token manager of the client challenge.
+func (m *TokenManager) Route(fp *usecase.Fingerprint, address string) usecase.TokenManager {
+	if m.tracker.Captcha(fp.Value, address) {
+		return m.captcha
+	}
+	return m.TokenManager
+}
+
+// GetChallenge returns the challenge of the verification chosen by the strikes of the fingerprint.
+func (m *TokenManager) GetChallenge(fp *usecase.Fingerprint) ([]byte, error) {
+	return m.Route(fp, "").GetChallenge(fp)
+}
+
+// GetToken checks the solution by the verification chosen by the strikes of the fingerprint.
+func (m *TokenManager) GetToken(fp *usecase.Fingerprint, solution []byte) (string, error) {
+	return m.Route(fp, "").GetToken(fp, solution)
+}
+
+// Escalate raises the complexity of the JS challenge if it is supported.
+func (m *TokenManager) Escalate(fingerprint []byte, ttl time.Duration) error {
+	if escalator, ok := m.TokenManager.(usecase.ChallengeEscalator); ok {
+		return escalator.Escalate(fingerprint, ttl)
+	}
+	return nil
+}
+
+// NewTokenManager wraps the JS challenge token manager with the captcha for the repeat offenders.
+func NewTokenManager(challenge, captcha usecase.TokenManager, tracker *Tracker) *TokenManager {
+	return &TokenManager{
+		TokenManager: challenge,
+		captcha:      captcha,
+		tracker:      tracker,
+	}
+}
@@ -0,0 +1,202 @@
+// Package strikes remembers repeat offenders across token revocations and punishes them harder.
+package strikes
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/store"
+	"aegis/internal/usecase"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// BucketStrikes is the store bucket of the strike counters
+	BucketStrikes = "strikes"
+
+	MetricStrikes      = "strikes"
+	MetricStrikeAction = "strike_action"
+)
+
+// Strike reasons
+const (
+	ReasonLimit = "limit" // Token is revoked by the rate limiter, other strikes are counted by the token rejection reason
+)
+
+// Strike actions
+const (
+	ActionEscalate = "escalate"
+	ActionCaptcha  = "captcha"
+	ActionBan      = "ban"
+)
+
+var (
+	metricStrikes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricStrikes,
+		},
+		[]string{"reason"},
+	)
+	metricStrikeAction = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricStrikeAction,
+		},
+		[]string{"action"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricStrikes, metricStrikeAction)
+}
+
+// suspicious are the token rejection reasons counted as strikes. Expired and unknown tokens
+// are left by the regular clients, so they are not counted.
+var suspicious = []string{
+	usecase.TokenReasonFingerprint,
+	usecase.TokenReasonMalformed,
+	usecase.TokenReasonSignature,
+	usecase.TokenReasonVerification,
+	usecase.TokenReasonRevoked,
+}
+
+// Suspicious returns true if the token rejection reason is counted as a strike.
+func Suspicious(reason string) bool {
+	return slices.Contains(suspicious, reason)
+}
+
+// Thresholds are the numbers of strikes after which the client is punished. Zero disables the punishment.
+type Thresholds struct {
+	TTL         time.Duration // Strikes are forgotten after the last one
+	Escalate    int           // Every next challenge is harder
+	Captcha     int           // Captcha is shown instead of the JS challenge
+	Ban         int           // Client is banned
+	BanDuration time.Duration // Duration of the ban
+}
+
+// Tracker counts strikes per fingerprint and per network of the client address. The network is /24 for IPv4
+// and /64 for IPv6. Counters are kept in the store, so they are shared by the instances.
+type Tracker struct {
+	thresholds Thresholds
+	store      store.Store
+	bans       *ban.List
+	escalator  usecase.ChallengeEscalator
+	mu         sync.Mutex
+}
+
+// network returns the network of the client address, empty if the address is malformed.
+func network(address string) string {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 24
+	if addr.Is6() {
+		bits = 64
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// targets returns the ban targets the strikes of the client are counted by.
+func targets(fingerprint []byte, address string) []string {
+	var keys []string
+	if len(fingerprint) > 0 {
+		keys = append(keys, ban.KindFingerprint+":"+hex.EncodeToString(fingerprint))
+	}
+	if n := network(address); n != "" {
+		keys = append(keys, n)
+	}
+	return keys
+}
+
+// get returns the strikes of the target.
+func (t *Tracker) get(target string) int {
+	value, found, err := t.store.Get(BucketStrikes, target)
+	if err != nil || !found {
+		return 0
+	}
+	strikes, _ := strconv.Atoi(string(value))
+	return strikes
+}
+
+// Strikes returns the number of strikes of the client, the largest one of the fingerprint and the network.
+func (t *Tracker) Strikes(fingerprint []byte, address string) int {
+	strikes := 0
+	for _, target := range targets(fingerprint, address) {
+		strikes = max(strikes, t.get(target))
+	}
+	return strikes
+}
+
+// Captcha returns true if the client has to solve the captcha instead of the JS challenge.
+func (t *Tracker) Captcha(fingerprint []byte, address string) bool {
+	return t.thresholds.Captcha > 0 && t.Strikes(fingerprint, address) >= t.thresholds.Captcha
+}
+
+// Strike counts the offence of the client and punishes it if a threshold is crossed. Returns the number
+// of strikes of the client.
+func (t *Tracker) Strike(fingerprint []byte, address, reason string) int {
+	t.mu.Lock()
+	strikes, worst := 0, ""
+	for _, target := range targets(fingerprint, address) {
+		count := t.get(target) + 1
+		if err := t.store.Set(BucketStrikes, target, []byte(strconv.Itoa(count)), t.thresholds.TTL); err != nil {
+			slog.Error("Failed to store strikes", slog.String("target", target), slog.String("error", err.Error()))
+		}
+		if count > strikes {
+			strikes, worst = count, target
+		}
+	}
+	t.mu.Unlock()
+	if worst == "" {
+		return 0
+	}
+	metricStrikes.WithLabelValues(reason).Inc()
+	slog.Info("Strike", "target", worst, "strikes", strikes, "reason", reason)
+
+	switch {
+	case t.thresholds.Ban > 0 && strikes >= t.thresholds.Ban:
+		if t.bans == nil {
+			break
+		}
+		b, err := t.bans.Add(worst, t.thresholds.BanDuration, fmt.Sprintf("%d strikes", strikes))
+		if err != nil {
+			slog.Error("Failed to ban", slog.String("target", worst), slog.String("error", err.Error()))
+			break
+		}
+		slog.Info("Repeat offender is banned", slog.String("target", b.Target), slog.Time("expires", b.Expires))
+		metricStrikeAction.WithLabelValues(ActionBan).Inc()
+	case t.thresholds.Captcha > 0 && strikes == t.thresholds.Captcha:
+		slog.Info("Repeat offender is switched to captcha", slog.String("target", worst))
+		metricStrikeAction.WithLabelValues(ActionCaptcha).Inc()
+	case t.thresholds.Escalate > 0 && strikes >= t.thresholds.Escalate && len(fingerprint) > 0:
+		if t.escalator == nil {
+			break
+		}
+		if err := t.escalator.Escalate(fingerprint, t.thresholds.TTL); err != nil {
+			slog.Error("Failed to escalate challenge", slog.String("error", err.Error()))
+			break
+		}
+		metricStrikeAction.WithLabelValues(ActionEscalate).Inc()
+	}
+	return strikes
+}
+
+// NewTracker creates the strike tracker. The escalator raises the challenge complexity, it may be nil
+// if the verification does not support it.
+func NewTracker(thresholds Thresholds, s store.Store, bans *ban.List, escalator usecase.ChallengeEscalator) *Tracker {
+	return &Tracker{
+		thresholds: thresholds,
+		store:      s,
+		bans:       bans,
+		escalator:  escalator,
+	}
+}
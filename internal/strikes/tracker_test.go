@@ -0,0 +1,76 @@
+package strikes_test
+
+import (
+	"aegis/internal/ban"
+	"aegis/internal/store"
+	"aegis/internal/strikes"
+	"aegis/internal/usecase"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// escalator counts the escalations of the fingerprints.
+type escalator map[string]int
+
+func (e escalator) Escalate(fingerprint []byte, ttl time.Duration) error {
+	e[string(fingerprint)]++
+	return nil
+}
+
+// named is a token manager which issues its name as the challenge.
+type named struct {
+	usecase.TokenManager
+	name string
+}
+
+func (m named) GetChallenge(fp *usecase.Fingerprint) ([]byte, error) {
+	return []byte(m.name), nil
+}
+
+// TestStrike verifies the punishments of the repeat offenders by the fingerprint and the network.
+func TestStrike(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	bans, err := ban.NewList(s)
+	assert.NoError(t, err)
+	escalations := escalator{}
+	tracker := strikes.NewTracker(strikes.Thresholds{
+		TTL:         time.Hour,
+		Escalate:    2,
+		Captcha:     3,
+		Ban:         5,
+		BanDuration: time.Minute,
+	}, s, bans, escalations)
+	fp := []byte{1, 2, 3}
+
+	assert.Equal(t, 1, tracker.Strike(fp, "192.0.2.1", strikes.ReasonLimit))
+	assert.Empty(t, escalations)
+	assert.Equal(t, 2, tracker.Strike(fp, "192.0.2.1", usecase.TokenReasonFingerprint))
+	assert.Equal(t, 1, escalations[string(fp)])
+	assert.False(t, tracker.Captcha(fp, ""))
+
+	// Other fingerprints of the network share its strikes
+	other := []byte{4, 5, 6}
+	assert.Equal(t, 3, tracker.Strike(other, "192.0.2.2", strikes.ReasonLimit))
+	assert.True(t, tracker.Captcha(other, "192.0.2.200"))
+	assert.False(t, tracker.Captcha(other, ""))
+	assert.Equal(t, 2, tracker.Strikes(fp, "198.51.100.1"))
+
+	manager := strikes.NewTokenManager(named{name: "js"}, named{name: "captcha"}, tracker)
+	challenge, _ := manager.Route(&usecase.Fingerprint{Value: fp}, "192.0.2.1").GetChallenge(nil)
+	assert.Equal(t, "captcha", string(challenge))
+	challenge, _ = manager.GetChallenge(&usecase.Fingerprint{Value: fp})
+	assert.Equal(t, "js", string(challenge))
+
+	tracker.Strike(nil, "192.0.2.3", usecase.TokenReasonSignature)
+	assert.Equal(t, 5, tracker.Strike(nil, "192.0.2.3", usecase.TokenReasonSignature))
+	b, banned := bans.Banned("192.0.2.99")
+	assert.True(t, banned)
+	assert.Equal(t, "192.0.2.0/24", b.Target)
+	assert.Equal(t, "5 strikes", b.Reason)
+
+	assert.Equal(t, 0, tracker.Strike(nil, "unknown", strikes.ReasonLimit))
+	assert.True(t, strikes.Suspicious(usecase.TokenReasonRevoked))
+	assert.False(t, strikes.Suspicious(usecase.TokenReasonExpired))
+}
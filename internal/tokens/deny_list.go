@@ -0,0 +1,87 @@
+package tokens
+
+import (
+	"aegis/internal/store"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// BucketDenied is the store bucket of the revoked stateless tokens
+const BucketDenied = "denied"
+
+// digest returns the truncated SHA-256 of the revoked token. It keeps the deny list compact
+// regardless of the token length.
+func digest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// DenyList keeps revoked stateless tokens in the store until their own expiration.
+type DenyList struct {
+	store store.Store
+}
+
+// Add denies the token until the expiration time. Returns false if the token is already denied.
+func (l *DenyList) Add(value string, expires time.Time) bool {
+	key := digest(value)
+	if _, exists, _ := l.store.Get(BucketDenied, key); exists {
+		return false
+	}
+	if err := l.store.Set(BucketDenied, key, nil, time.Until(expires)+time.Second); err != nil {
+		slog.Error("Failed to deny token", slog.String("error", err.Error()))
+		return false
+	}
+	return true
+}
+
+// Contains returns true if the token is denied. Tokens are considered denied if the store fails.
+func (l *DenyList) Contains(value string) bool {
+	_, exists, err := l.store.Get(BucketDenied, digest(value))
+	if err != nil {
+		slog.Error("Failed to check denied token", slog.String("error", err.Error()))
+		return true
+	}
+	return exists
+}
+
+// AddFingerprint denies tokens of the fingerprint hash issued before the second of the revocation time, so
+// the tokens issued right after the revocation are valid with the issue time of the precision of a second.
+// The entry is kept for the ttl, which should be the token lifetime.
+func (l *DenyList) AddFingerprint(hash []byte, revokedAt time.Time, ttl time.Duration) error {
+	revoked := binary.BigEndian.AppendUint64(nil, uint64(revokedAt.Unix()))
+	return l.store.Set(BucketDenied, fingerprintKey(hash), revoked, ttl)
+}
+
+// ContainsFingerprint returns true if tokens of the fingerprint hash issued at the time are denied, the time is
+// compared with the precision of a second.
+// Tokens are considered denied if the store fails.
+func (l *DenyList) ContainsFingerprint(hash []byte, issued time.Time) bool {
+	revoked, exists, err := l.store.Get(BucketDenied, fingerprintKey(hash))
+	if err != nil {
+		slog.Error("Failed to check denied fingerprint", slog.String("error", err.Error()))
+		return true
+	}
+	if !exists || len(revoked) != 8 {
+		return false
+	}
+	return issued.Unix() < int64(binary.BigEndian.Uint64(revoked))
+}
+
+// fingerprintKey returns the deny list key of the fingerprint hash.
+func fingerprintKey(hash []byte) string {
+	return "fp:" + hex.EncodeToString(hash)
+}
+
+// Len returns the number of denied tokens.
+func (l *DenyList) Len() int {
+	n, _ := l.store.Len(BucketDenied)
+	return n
+}
+
+// NewDenyList creates a deny list on top of the store.
+func NewDenyList(s store.Store) *DenyList {
+	return &DenyList{store: s}
+}
@@ -0,0 +1,13 @@
+package tokens
+
+import "time"
+
+// SetClock replaces the clock of the registry.
+func (r *Registry) SetClock(now func() time.Time) {
+	r.now = now
+}
+
+// SetClock replaces the clock of the signer.
+func (s *Signer) SetClock(now func() time.Time) {
+	s.now = now
+}
@@ -0,0 +1,33 @@
+package tokens
+
+import (
+	"aegis/internal/usecase"
+	"errors"
+	"time"
+)
+
+// Token formats
+const (
+	FormatRandom = "random"
+	FormatHmac   = "hmac"
+)
+
+// ErrNotStored is returned when stateless tokens are listed.
+var ErrNotStored = errors.New("stateless tokens are not stored")
+
+// Issuer issues, validates and revokes tokens on behalf of the token managers.
+type Issuer interface {
+	usecase.TokenRegistry
+	// Issue creates a new token bound to the fingerprint.
+	Issue(fp *usecase.Fingerprint) (string, error)
+	// Validate returns nil if the token is valid for the fingerprint or usecase.TokenValidationError otherwise.
+	Validate(fp *usecase.Fingerprint, value string) error
+	// Issued returns the issue time of the token. The token is not validated.
+	Issued(value string) (time.Time, bool)
+}
+
+// reject counts the rejection and returns the validation error.
+func reject(reason string) error {
+	metricTokenRejected.WithLabelValues(reason).Inc()
+	return usecase.TokenValidationError{Reason: reason}
+}
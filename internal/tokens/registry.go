@@ -0,0 +1,246 @@
+package tokens
+
+import (
+	"aegis/internal/store"
+	"aegis/internal/usecase"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MetricTokenEvicted  = "token_evicted"
+	MetricTokenRejected = "token_rejected"
+
+	// BucketTokens is the store bucket of the random tokens
+	BucketTokens = "tokens"
+
+	// expiryGrace keeps expired tokens in the store for a while to report the expiration reason
+	expiryGrace = time.Minute
+	// maxTouchInterval limits how often the idle TTL renewal is written to the store
+	maxTouchInterval = time.Minute
+)
+
+var (
+	metricTokenEvicted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricTokenEvicted,
+		},
+		[]string{"reason"},
+	)
+	metricTokenRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: MetricTokenRejected,
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricTokenEvicted, metricTokenRejected)
+}
+
+// Policy limits lifetime of the stored tokens.
+type Policy struct {
+	TTL     time.Duration // Absolute lifetime since issuing, 0 disables the check
+	IdleTTL time.Duration // Lifetime since the last successful validation, 0 disables the check
+	// Namespace isolates the tokens of the sites sharing the store, the tokens of other namespaces are rejected
+	Namespace string
+}
+
+// Token is an issued antibot token bound to the client fingerprint.
+type Token struct {
+	Value       string    `json:"-"`
+	Fingerprint []byte    `json:"fingerprint"`
+	Issued      time.Time `json:"issued"`
+	LastSeen    time.Time `json:"last_seen"`
+	Namespace   string    `json:"namespace,omitempty"`
+}
+
+// expired returns the reason of the token expiration or an empty string if the token is alive.
+func (t *Token) expired(policy *Policy, now time.Time) string {
+	if policy.TTL > 0 && now.Sub(t.Issued) > policy.TTL {
+		return usecase.TokenReasonExpired
+	}
+	if policy.IdleTTL > 0 && now.Sub(t.LastSeen) > policy.IdleTTL {
+		return usecase.TokenReasonIdle
+	}
+	return ""
+}
+
+// ttl returns the time the token should be kept in the store.
+func (t *Token) ttl(policy *Policy, now time.Time) time.Duration {
+	var ttl time.Duration
+	if policy.TTL > 0 {
+		ttl = t.Issued.Add(policy.TTL).Sub(now)
+	}
+	if policy.IdleTTL > 0 {
+		if idle := t.LastSeen.Add(policy.IdleTTL).Sub(now); policy.TTL == 0 || idle < ttl {
+			ttl = idle
+		}
+	}
+	if policy.TTL == 0 && policy.IdleTTL == 0 {
+		return 0
+	}
+	return max(ttl, 0) + expiryGrace
+}
+
+// Registry keeps random tokens in the store. Tokens expire after the absolute TTL or after the idle TTL
+// since the last validation.
+type Registry struct {
+	policy        Policy
+	store         store.Store
+	touchInterval time.Duration
+	now           func() time.Time
+}
+
+// save writes the token to the store.
+func (r *Registry) save(t *Token, now time.Time) error {
+	value, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return r.store.Set(BucketTokens, t.Value, value, t.ttl(&r.policy, now))
+}
+
+// Issue generates a new random token for the fingerprint and stores it.
+func (r *Registry) Issue(fp *usecase.Fingerprint) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := r.now()
+	t := Token{
+		Value:       base64.StdEncoding.EncodeToString(b),
+		Fingerprint: bytes.Clone(fp.Value),
+		Issued:      now,
+		LastSeen:    now,
+		Namespace:   r.policy.Namespace,
+	}
+	if err := r.save(&t, now); err != nil {
+		return "", err
+	}
+	return t.Value, nil
+}
+
+// Validate checks that the token exists, is not expired and belongs to the fingerprint and the namespace.
+// Successful validation renews the idle TTL of the token.
+func (r *Registry) Validate(fp *usecase.Fingerprint, value string) error {
+	now := r.now()
+	data, exists, err := r.store.Get(BucketTokens, value)
+	if err != nil {
+		slog.Error("Failed to read token", slog.String("error", err.Error()))
+		return reject(usecase.TokenReasonUnavailable)
+	}
+	if !exists {
+		return reject(usecase.TokenReasonUnknown)
+	}
+	t := Token{Value: value}
+	if err = json.Unmarshal(data, &t); err != nil {
+		return reject(usecase.TokenReasonMalformed)
+	}
+	if reason := t.expired(&r.policy, now); reason != "" {
+		r.store.Delete(BucketTokens, value)
+		metricTokenEvicted.WithLabelValues(reason).Inc()
+		return reject(reason)
+	}
+	if !bytes.Equal(t.Fingerprint, fp.Value) {
+		return reject(usecase.TokenReasonFingerprint)
+	}
+	if t.Namespace != r.policy.Namespace {
+		return reject(usecase.TokenReasonNamespace)
+	}
+	// The last use only matters for the idle expiration, the token is not saved on every request without it
+	if r.policy.IdleTTL > 0 && now.Sub(t.LastSeen) > r.touchInterval {
+		t.LastSeen = now
+		if err = r.save(&t, now); err != nil {
+			slog.Error("Failed to renew token", slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+// Issued returns the issue time of the stored token.
+func (r *Registry) Issued(value string) (time.Time, bool) {
+	data, exists, err := r.store.Get(BucketTokens, value)
+	if err != nil || !exists {
+		return time.Time{}, false
+	}
+	var t Token
+	if err = json.Unmarshal(data, &t); err != nil {
+		return time.Time{}, false
+	}
+	return t.Issued, true
+}
+
+// Revoke removes the token. Returns true if the token existed.
+func (r *Registry) Revoke(value string) bool {
+	revoked, err := r.store.Delete(BucketTokens, value)
+	if err != nil {
+		slog.Error("Failed to revoke token", slog.String("error", err.Error()))
+	}
+	return revoked
+}
+
+// Tokens returns stored alive tokens of all namespaces which fingerprints start with the query prefix.
+func (r *Registry) Tokens(query usecase.TokenQuery) ([]usecase.TokenInfo, error) {
+	now := r.now()
+	found := []usecase.TokenInfo{}
+	err := r.store.Range(BucketTokens, func(value string, data []byte) bool {
+		t := Token{Value: value}
+		if json.Unmarshal(data, &t) != nil || t.expired(&r.policy, now) != "" || !bytes.HasPrefix(t.Fingerprint, query.Fingerprint) {
+			return true
+		}
+		found = append(found, usecase.TokenInfo{
+			Token:       t.Value,
+			Fingerprint: fmt.Sprintf("%x", t.Fingerprint),
+			Issued:      t.Issued,
+			LastSeen:    t.LastSeen,
+			Namespace:   t.Namespace,
+		})
+		return query.Limit == 0 || len(found) < query.Limit
+	})
+	return found, err
+}
+
+// Count returns the number of stored tokens of all namespaces, including the expired ones which are not
+// removed yet.
+func (r *Registry) Count() (int, error) {
+	return r.store.Len(BucketTokens)
+}
+
+// RevokeFingerprint removes all tokens of the fingerprint in all namespaces.
+func (r *Registry) RevokeFingerprint(fingerprint []byte) (int, error) {
+	var values []string
+	err := r.store.Range(BucketTokens, func(value string, data []byte) bool {
+		var t Token
+		if json.Unmarshal(data, &t) == nil && bytes.Equal(t.Fingerprint, fingerprint) {
+			values = append(values, value)
+		}
+		return true
+	})
+	revoked := 0
+	for _, value := range values {
+		if r.Revoke(value) {
+			revoked++
+		}
+	}
+	return revoked, err
+}
+
+// NewRegistry creates a token registry which keeps tokens in the store.
+func NewRegistry(policy Policy, s store.Store) *Registry {
+	r := Registry{
+		policy:        policy,
+		store:         s,
+		touchInterval: min(policy.IdleTTL/10, maxTouchInterval),
+		now:           time.Now,
+	}
+	return &r
+}
@@ -0,0 +1,117 @@
+package tokens_test
+
+import (
+	"aegis/internal/store"
+	"aegis/internal/tokens"
+	"aegis/internal/usecase"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var clientFp = usecase.Fingerprint{Value: []byte{1, 2, 3}, String: "010203"}
+var otherFp = usecase.Fingerprint{Value: []byte{3, 2, 1}, String: "030201"}
+
+// TestRegistryValidate verifies that an issued token is valid only for its fingerprint
+// and that revoked or unknown tokens are rejected with the proper reason.
+func TestRegistryValidate(t *testing.T) {
+	r := tokens.NewRegistry(tokens.Policy{}, store.NewMemoryStore(nil))
+	token, err := r.Issue(&clientFp)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.Validate(&clientFp, token))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonFingerprint}, r.Validate(&otherFp, token))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonUnknown}, r.Validate(&clientFp, "unknown"))
+	issued, found := r.Issued(token)
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now(), issued, time.Second)
+
+	count, err := r.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.True(t, r.Revoke(token))
+	assert.False(t, r.Revoke(token))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonUnknown}, r.Validate(&clientFp, token))
+}
+
+// clock is the manually advanced time of the tests.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// TestRegistryExpiration verifies absolute and idle expiration at their boundaries:
+// 1. A token which is used regularly survives the idle TTL but not the absolute TTL.
+// 2. A token which is not used expires after the idle TTL.
+func TestRegistryExpiration(t *testing.T) {
+	c := clock{t: time.Now()}
+	r := tokens.NewRegistry(tokens.Policy{TTL: 10 * time.Minute, IdleTTL: 4 * time.Minute}, store.NewMemoryStore(nil))
+	r.SetClock(c.now)
+	active, _ := r.Issue(&clientFp)
+	idle, _ := r.Issue(&clientFp)
+
+	c.advance(3 * time.Minute)
+	assert.NoError(t, r.Validate(&clientFp, active))
+	c.advance(time.Minute)
+	assert.NoError(t, r.Validate(&clientFp, idle), "the idle TTL is not exceeded at the boundary")
+	c.advance(3 * time.Minute)
+	assert.NoError(t, r.Validate(&clientFp, active))
+	c.advance(3 * time.Minute)
+	assert.NoError(t, r.Validate(&clientFp, active), "the absolute TTL is not exceeded at the boundary")
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonIdle}, r.Validate(&clientFp, idle))
+
+	c.advance(time.Nanosecond)
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonExpired}, r.Validate(&clientFp, active))
+}
+
+// countingStore counts the records written to the store.
+type countingStore struct {
+	store.Store
+	sets int
+}
+
+func (s *countingStore) Set(bucket, key string, value []byte, ttl time.Duration) error {
+	s.sets++
+	return s.Store.Set(bucket, key, value, ttl)
+}
+
+// TestRegistryIdleDisabled verifies that the validated token is not saved again if the idle expiration is disabled.
+func TestRegistryIdleDisabled(t *testing.T) {
+	c := clock{t: time.Now()}
+	s := countingStore{Store: store.NewMemoryStore(nil)}
+	r := tokens.NewRegistry(tokens.Policy{TTL: time.Hour}, &s)
+	r.SetClock(c.now)
+	token, err := r.Issue(&clientFp)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.sets)
+	for range 3 {
+		c.advance(10 * time.Minute)
+		assert.NoError(t, r.Validate(&clientFp, token))
+	}
+	assert.Equal(t, 1, s.sets)
+}
+
+// TestRegistryNamespace verifies that the registries sharing the store accept only the tokens of their namespace
+// and list the tokens of all namespaces.
+func TestRegistryNamespace(t *testing.T) {
+	st := store.NewMemoryStore(nil)
+	main := tokens.NewRegistry(tokens.Policy{}, st)
+	shop := tokens.NewRegistry(tokens.Policy{Namespace: "shop"}, st)
+	token, _ := shop.Issue(&clientFp)
+
+	assert.NoError(t, shop.Validate(&clientFp, token))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonNamespace}, main.Validate(&clientFp, token))
+	listed, err := main.Tokens(usecase.TokenQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "shop", listed[0].Namespace)
+}
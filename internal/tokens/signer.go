@@ -0,0 +1,240 @@
+package tokens
+
+import (
+	"aegis/internal/store"
+	"aegis/internal/usecase"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	signedTokenVersion = "v1"
+	fingerprintHashLen = 16
+	claimsHeaderLen    = 8 + 8 + fingerprintHashLen
+	minSecretLen       = 32
+)
+
+var encoding = base64.RawURLEncoding
+
+// Key is a shared secret used to sign tokens. All instances which validate each other's tokens
+// must share the same keys.
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+// claims is the signed content of a stateless token.
+type claims struct {
+	issued       time.Time
+	expires      time.Time
+	fingerprint  []byte
+	verification string
+	namespace    string
+}
+
+// scope returns the verification type followed by the namespace if it is set.
+func (c *claims) scope() string {
+	if c.namespace == "" {
+		return c.verification
+	}
+	return c.verification + "/" + c.namespace
+}
+
+func (c *claims) marshal() []byte {
+	scope := c.scope()
+	b := make([]byte, claimsHeaderLen, claimsHeaderLen+len(scope))
+	binary.BigEndian.PutUint64(b[0:8], uint64(c.issued.Unix()))
+	binary.BigEndian.PutUint64(b[8:16], uint64(c.expires.Unix()))
+	copy(b[16:claimsHeaderLen], c.fingerprint)
+	return append(b, scope...)
+}
+
+func (c *claims) unmarshal(b []byte) bool {
+	if len(b) < claimsHeaderLen {
+		return false
+	}
+	c.issued = time.Unix(int64(binary.BigEndian.Uint64(b[0:8])), 0)
+	c.expires = time.Unix(int64(binary.BigEndian.Uint64(b[8:16])), 0)
+	c.fingerprint = b[16:claimsHeaderLen]
+	c.verification, c.namespace, _ = strings.Cut(string(b[claimsHeaderLen:]), "/")
+	return true
+}
+
+// fingerprintHash returns the truncated hash of the fingerprint which is embedded into the token.
+func fingerprintHash(fp *usecase.Fingerprint) []byte {
+	sum := sha256.Sum256(fp.Value)
+	return sum[:fingerprintHashLen]
+}
+
+// Signer issues stateless HMAC-signed tokens. A token carries the fingerprint hash, issue time,
+// expiration time, verification type and namespace, so any instance holding the key can validate it without
+// shared state. Revoked tokens are kept in the deny list until they expire.
+type Signer struct {
+	ttl          time.Duration
+	verification string
+	namespace    string
+	signingKey   Key
+	keys         map[string][]byte
+	denied       *DenyList
+	now          func() time.Time
+}
+
+// sign returns the token signature made with the secret.
+func sign(secret []byte, content string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+// Issue creates a signed token for the fingerprint.
+func (s *Signer) Issue(fp *usecase.Fingerprint) (string, error) {
+	now := s.now()
+	c := claims{
+		issued:       now,
+		expires:      now.Add(s.ttl),
+		fingerprint:  fingerprintHash(fp),
+		verification: s.verification,
+		namespace:    s.namespace,
+	}
+	content := signedTokenVersion + "." + s.signingKey.Id + "." + encoding.EncodeToString(c.marshal())
+	return content + "." + encoding.EncodeToString(sign(s.signingKey.Secret, content)), nil
+}
+
+// parse verifies the token signature and returns its claims. If the token is not valid
+// the rejection reason is returned.
+func (s *Signer) parse(value string) (c claims, reason string) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 || parts[0] != signedTokenVersion {
+		return c, usecase.TokenReasonMalformed
+	}
+	secret, exists := s.keys[parts[1]]
+	if !exists {
+		return c, usecase.TokenReasonSignature
+	}
+	signature, err := encoding.DecodeString(parts[3])
+	if err != nil {
+		return c, usecase.TokenReasonMalformed
+	}
+	if !hmac.Equal(signature, sign(secret, value[:len(value)-len(parts[3])-1])) {
+		return c, usecase.TokenReasonSignature
+	}
+	payload, err := encoding.DecodeString(parts[2])
+	if err != nil || !c.unmarshal(payload) {
+		return c, usecase.TokenReasonMalformed
+	}
+	return c, ""
+}
+
+// Validate verifies the token signature, expiration, fingerprint, verification type and namespace.
+func (s *Signer) Validate(fp *usecase.Fingerprint, value string) error {
+	c, reason := s.parse(value)
+	if reason != "" {
+		return reject(reason)
+	}
+	if s.now().After(c.expires) {
+		return reject(usecase.TokenReasonExpired)
+	}
+	if !bytes.Equal(c.fingerprint, fingerprintHash(fp)) {
+		return reject(usecase.TokenReasonFingerprint)
+	}
+	if c.verification != s.verification {
+		return reject(usecase.TokenReasonVerification)
+	}
+	if c.namespace != s.namespace {
+		return reject(usecase.TokenReasonNamespace)
+	}
+	if s.denied.Contains(value) || s.denied.ContainsFingerprint(c.fingerprint, c.issued) {
+		return reject(usecase.TokenReasonRevoked)
+	}
+	return nil
+}
+
+// Issued returns the issue time of a correctly signed token with the precision of a second.
+func (s *Signer) Issued(value string) (time.Time, bool) {
+	c, reason := s.parse(value)
+	return c.issued, reason == ""
+}
+
+// Revoke adds a correctly signed token to the deny list until it expires.
+func (s *Signer) Revoke(value string) bool {
+	c, reason := s.parse(value)
+	if reason != "" || s.now().After(c.expires) {
+		return false
+	}
+	return s.denied.Add(value, c.expires)
+}
+
+// Tokens returns ErrNotStored, signed tokens are not kept anywhere.
+func (s *Signer) Tokens(query usecase.TokenQuery) ([]usecase.TokenInfo, error) {
+	return nil, ErrNotStored
+}
+
+// Count returns ErrNotStored, signed tokens are not kept anywhere.
+func (s *Signer) Count() (int, error) {
+	return 0, ErrNotStored
+}
+
+// RevokeFingerprint denies all tokens of the fingerprint issued before the current second, the tokens
+// of the challenges solved right after the revocation are valid. The number of revoked tokens is unknown,
+// so 0 is returned.
+func (s *Signer) RevokeFingerprint(fingerprint []byte) (int, error) {
+	return 0, s.denied.AddFingerprint(fingerprintHash(&usecase.Fingerprint{Value: fingerprint}), s.now(), s.ttl)
+}
+
+// NewSigner creates a stateless token issuer.
+//
+// Parameters:
+//   - keys: All keys accepted for validation.
+//   - signingKeyId: Identifier of the key used to sign new tokens. The first key is used if it is empty.
+//   - verification: Verification type embedded into the tokens.
+//   - namespace: Site of the tokens, the tokens of other namespaces are rejected. Empty for the default site.
+//   - ttl: Token lifetime.
+//   - denied: Store of the revoked tokens.
+//
+// Returns:
+//   - *Signer: Initialized issuer.
+//   - error: Non-nil if keys are absent, duplicated or too short.
+func NewSigner(keys []Key, signingKeyId string, verification string, namespace string, ttl time.Duration, denied store.Store) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	if ttl <= 0 {
+		return nil, errors.New("token ttl is required for signed tokens")
+	}
+	s := Signer{
+		ttl:          ttl,
+		verification: verification,
+		namespace:    namespace,
+		keys:         make(map[string][]byte),
+		denied:       NewDenyList(denied),
+		now:          time.Now,
+	}
+	for _, key := range keys {
+		if key.Id == "" || strings.Contains(key.Id, ".") {
+			return nil, fmt.Errorf("invalid key id %q", key.Id)
+		}
+		if len(key.Secret) < minSecretLen {
+			return nil, fmt.Errorf("key %s is shorter than %d bytes", key.Id, minSecretLen)
+		}
+		if _, exists := s.keys[key.Id]; exists {
+			return nil, fmt.Errorf("duplicated key %s", key.Id)
+		}
+		s.keys[key.Id] = key.Secret
+	}
+	if signingKeyId == "" {
+		signingKeyId = keys[0].Id
+	}
+	secret, exists := s.keys[signingKeyId]
+	if !exists {
+		return nil, fmt.Errorf("unknown signing key %s", signingKeyId)
+	}
+	s.signingKey = Key{Id: signingKeyId, Secret: secret}
+	return &s, nil
+}
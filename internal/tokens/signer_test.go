@@ -0,0 +1,117 @@
+package tokens_test
+
+import (
+	"aegis/internal/store"
+	"aegis/internal/store/resptest"
+	"aegis/internal/tokens"
+	"aegis/internal/usecase"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var oldKey = tokens.Key{Id: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")}
+var newKey = tokens.Key{Id: "k2", Secret: []byte("fedcba9876543210fedcba9876543210")}
+
+// TestSignerSharedValidation verifies that a token issued by one instance is valid on another
+// instance sharing the keys, including the key rotation case.
+func TestSignerSharedValidation(t *testing.T) {
+	first, err := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+	second, err := tokens.NewSigner([]tokens.Key{oldKey, newKey}, "k2", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	assert.NoError(t, err)
+
+	token, _ := first.Issue(&clientFp)
+	assert.NoError(t, second.Validate(&clientFp, token))
+	issued, found := second.Issued(token)
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now(), issued, time.Second)
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonFingerprint}, second.Validate(&otherFp, token))
+
+	// The first instance does not know the new key yet
+	token, _ = second.Issue(&clientFp)
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonSignature}, first.Validate(&clientFp, token))
+}
+
+// TestSignerRejection verifies rejection of tampered, foreign, other site, expired and revoked tokens.
+func TestSignerRejection(t *testing.T) {
+	signer, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	captcha, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "captcha", "", time.Hour, store.NewMemoryStore(nil))
+
+	token, _ := signer.Issue(&clientFp)
+	parts := strings.Split(token, ".")
+	parts[2] = parts[2][:len(parts[2])-2] + "AA"
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonSignature}, signer.Validate(&clientFp, strings.Join(parts, ".")))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonMalformed}, signer.Validate(&clientFp, "random"))
+
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonVerification}, captcha.Validate(&clientFp, token))
+	shop, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "shop", time.Hour, store.NewMemoryStore(nil))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonNamespace}, shop.Validate(&clientFp, token))
+	shopToken, _ := shop.Issue(&clientFp)
+	assert.NoError(t, shop.Validate(&clientFp, shopToken))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonNamespace}, signer.Validate(&clientFp, shopToken))
+
+	c := clock{t: time.Now()}
+	expiring, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	expiring.SetClock(c.now)
+	expired, _ := expiring.Issue(&clientFp)
+	c.advance(time.Hour + time.Second)
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonExpired}, expiring.Validate(&clientFp, expired))
+
+	assert.True(t, signer.Revoke(token))
+	assert.False(t, signer.Revoke(token))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonRevoked}, signer.Validate(&clientFp, token))
+}
+
+// TestSignerKeys verifies that invalid key sets are refused.
+func TestSignerKeys(t *testing.T) {
+	_, err := tokens.NewSigner(nil, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	assert.Error(t, err)
+	_, err = tokens.NewSigner([]tokens.Key{{Id: "short", Secret: []byte("secret")}}, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	assert.Error(t, err)
+	_, err = tokens.NewSigner([]tokens.Key{oldKey, oldKey}, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	assert.Error(t, err)
+	_, err = tokens.NewSigner([]tokens.Key{oldKey}, "k2", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	assert.Error(t, err)
+}
+
+// TestSignerSharedRevocation verifies that a token revoked on one instance is rejected by another
+// instance sharing the Redis-compatible store.
+func TestSignerSharedRevocation(t *testing.T) {
+	server, err := resptest.NewServer("")
+	assert.NoError(t, err)
+	defer server.Close()
+	firstStore, _ := store.NewRedisStore(store.RedisOptions{Address: server.Addr()})
+	secondStore, _ := store.NewRedisStore(store.RedisOptions{Address: server.Addr()})
+	first, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "", time.Hour, firstStore)
+	second, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "", time.Hour, secondStore)
+
+	token, _ := first.Issue(&clientFp)
+	assert.NoError(t, second.Validate(&clientFp, token))
+	assert.True(t, first.Revoke(token))
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonRevoked}, second.Validate(&clientFp, token))
+}
+
+// TestSignerFingerprintRevocation verifies that revocation of a fingerprint rejects its tokens issued before
+// and accepts the token issued within the same second after it.
+func TestSignerFingerprintRevocation(t *testing.T) {
+	c := clock{t: time.Unix(1700000000, 0)}
+	signer, _ := tokens.NewSigner([]tokens.Key{oldKey}, "", "js-challenge", "", time.Hour, store.NewMemoryStore(nil))
+	signer.SetClock(c.now)
+	token, _ := signer.Issue(&clientFp)
+	other, _ := signer.Issue(&otherFp)
+
+	c.advance(time.Second + 300*time.Millisecond)
+	_, err := signer.RevokeFingerprint(clientFp.Value)
+	assert.NoError(t, err)
+	assert.Equal(t, usecase.TokenValidationError{Reason: usecase.TokenReasonRevoked}, signer.Validate(&clientFp, token))
+	assert.NoError(t, signer.Validate(&otherFp, other))
+
+	c.advance(500 * time.Millisecond)
+	token, _ = signer.Issue(&clientFp)
+	assert.NoError(t, signer.Validate(&clientFp, token), "the token solved in the second of the revocation is valid")
+	_, err = signer.Tokens(usecase.TokenQuery{})
+	assert.ErrorIs(t, err, tokens.ErrNotStored)
+}
@@ -0,0 +1,97 @@
+// Package urlnorm normalizes the request URLs before they are matched with the protections, so encoded,
+// doubled and dot segments of the path do not slip past the patterns.
+package urlnorm
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// unhex returns the value of the hex digit or false.
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// unescape decodes the percent-encoded bytes once, invalid escapes are kept as is. Plus is decoded
+// to the space if plus is true.
+func unescape(s string, plus bool) string {
+	if !strings.ContainsRune(s, '%') && (!plus || !strings.ContainsRune(s, '+')) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%' && i+2 < len(s):
+			hi, okHi := unhex(s[i+1])
+			lo, okLo := unhex(s[i+2])
+			if !okHi || !okLo {
+				b.WriteByte(c)
+				continue
+			}
+			b.WriteByte(hi<<4 | lo)
+			i += 2
+		case c == '+' && plus:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Path decodes the percent-encoded bytes of the path once, collapses the repeated slashes and removes
+// the dot segments. The path always starts with the slash, the trailing slash is kept.
+func Path(p string) string {
+	decoded := unescape(p, false)
+	if !strings.HasPrefix(decoded, "/") {
+		decoded = "/" + decoded
+	}
+	cleaned := path.Clean(decoded)
+	if cleaned != "/" && (strings.HasSuffix(decoded, "/") || strings.HasSuffix(decoded, "/.") || strings.HasSuffix(decoded, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Query parses the query parameters. Unlike url.ParseQuery, the parameters with invalid escapes are kept
+// with the escapes as is, so they cannot be hidden from the matching.
+func Query(query string) url.Values {
+	values := url.Values{}
+	for pair := range strings.SplitSeq(query, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name = unescape(name, true)
+		values[name] = append(values[name], unescape(value, true))
+	}
+	return values
+}
+
+// Split splits the request URI into the normalized path and the query parameters. The fragment is dropped.
+func Split(uri string) (string, url.Values) {
+	uri, _, _ = strings.Cut(uri, "#")
+	p, query, _ := strings.Cut(uri, "?")
+	return Path(p), Query(query)
+}
+
+// Host returns the lowercase host without the port and the trailing dot.
+func Host(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") {
+		host = strings.Trim(host, "[]")
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,52 @@
+package urlnorm_test
+
+import (
+	"aegis/internal/urlnorm"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSplit verifies that the evasions of the path patterns are normalized and the query is separated.
+func TestSplit(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"/index.html":                 "/index.html",
+		"/index.html?x":               "/index.html",
+		"//index.html":                "/index.html",
+		"/%69ndex.html":               "/index.html",
+		"/a/../index.html":            "/index.html",
+		"/a/%2e%2e/index.html":        "/index.html",
+		"/./a//b/./c/":                "/a/b/c/",
+		"/a/b/..":                     "/a/",
+		"/../../etc/passwd":           "/etc/passwd",
+		"index.html":                  "/index.html",
+		"":                            "/",
+		"/100%":                       "/100%",
+		"/%zz/%2":                     "/%zz/%2",
+		"/%252e%252e/":                "/%2e%2e/",
+		"/search#fragment":            "/search",
+		"/a%2F..%2Fadmin?user=x#frag": "/admin",
+	} {
+		path, _ := urlnorm.Split(uri)
+		assert.Equal(t, expected, path, uri)
+	}
+
+	path, query := urlnorm.Split("/search?q=a+b&q=%63&debug=1%zz&flag&=empty")
+	assert.Equal(t, "/search", path)
+	assert.Equal(t, url.Values{"q": {"a b", "c"}, "debug": {"1%zz"}, "flag": {""}, "": {"empty"}}, query)
+}
+
+// TestHost verifies that the port, the case and the trailing dot of the host are normalized.
+func TestHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"Shop.Example.com":      "shop.example.com",
+		"shop.example.com:8443": "shop.example.com",
+		"shop.example.com.":     "shop.example.com",
+		"[2001:db8::1]:443":     "2001:db8::1",
+		"[2001:db8::1]":         "2001:db8::1",
+		"":                      "",
+	} {
+		assert.Equal(t, expected, urlnorm.Host(host), host)
+	}
+}
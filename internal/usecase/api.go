@@ -1,6 +1,12 @@
 package usecase
 
-import "net/http"
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
 
 type Meta struct {
 	Fingerprint Fingerprint
@@ -27,10 +33,111 @@ type Endpoint struct {
 	Method string `json:"method"`
 }
 
+// Modes of the protections
+const (
+	ModeEnforce = "enforce" // Requests are refused and the actions are applied
+	ModeMonitor = "monitor" // Refusals and actions are only logged and counted
+)
+
+// ActionAllow is the action of the exclusion rule: matching requests are not checked by the protections
+// evaluated after it.
+const ActionAllow = "allow"
+
+// Match modes of the protections
+const (
+	MatchAll   = "all"   // Every matching protection applies
+	MatchFirst = "first" // Only the first matching protection applies
+)
+
 type Protection struct {
-	Path   string `json:"path"`
-	Method string `json:"method"`
-	Limit  uint32 `json:"rps"`
+	Path      string             `json:"path"`
+	Method    string             `json:"method"`
+	Limit     uint32             `json:"rps"`
+	Key       string             `json:"key"`
+	Algorithm string             `json:"algorithm"`
+	Burst     uint32             `json:"burst"`
+	Limits    []Limit            `json:"limits"`
+	Mode      string             `json:"mode"`
+	Cost      uint32             `json:"cost"`
+	Budget    string             `json:"budget"`
+	Priority  int                `json:"priority"`
+	Action    string             `json:"action"`
+	Final     bool               `json:"final"`
+	Query     map[string]Pattern `json:"query,omitempty"`
+	Host      *Pattern           `json:"host,omitempty"`
+	Headers   map[string]Pattern `json:"headers,omitempty"`
+	Cookies   map[string]Pattern `json:"cookies,omitempty"`
+	Networks  []string           `json:"networks,omitempty"`
+}
+
+// Monitored returns true if the protection is not enforced.
+func (p *Protection) Monitored() bool {
+	return p.Mode == ModeMonitor
+}
+
+// Allows returns true if the protection is the exclusion rule.
+func (p *Protection) Allows() bool {
+	return p.Action == ActionAllow
+}
+
+// Applied filters in place the matching protections in the evaluation order and returns the applied ones.
+// The evaluation stops at the first final protection or the exclusion rule, the exclusion rule itself
+// is not applied. The enforced and the monitored protections are evaluated separately, so the shadow rules
+// do not change the live verdicts. Returns true if an enforced exclusion rule matched.
+func Applied[T any](matches []T, protection func(T) *Protection) ([]T, bool) {
+	var stopped [2]bool // Enforced and monitored evaluations
+	var allowed bool
+	applied := matches[:0]
+	for _, match := range matches {
+		p := protection(match)
+		evaluation := 0
+		if p.Monitored() {
+			evaluation = 1
+		}
+		if stopped[evaluation] {
+			continue
+		}
+		stopped[evaluation] = p.Final || p.Allows()
+		if p.Allows() {
+			allowed = allowed || !p.Monitored()
+			continue
+		}
+		applied = append(applied, match)
+	}
+	return applied, allowed
+}
+
+// SortProtections sorts the protections in the evaluation order: by priority descending, the protections
+// of the same priority keep their order.
+func SortProtections(protections []Protection) {
+	slices.SortStableFunc(protections, func(a, b Protection) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+}
+
+// RateLimits returns the RPS limit with the protection burst followed by the other limits.
+// Unlimited RPS is omitted.
+func (p *Protection) RateLimits() []Limit {
+	limits := make([]Limit, 0, len(p.Limits)+1)
+	if p.Limit != 0 && p.Limit != math.MaxUint32 {
+		limits = append(limits, Limit{Rate: Rate{Limit: p.Limit, Period: time.Second}, Burst: p.Burst})
+	}
+	return append(limits, p.Limits...)
+}
+
+// Budget is a set of limits shared by the protections charging it. Every request is charged with the cost
+// of the protection, so endpoints of different weight are limited by a single budget.
+type Budget struct {
+	Name      string  `json:"name"`
+	Key       string  `json:"key"`
+	Algorithm string  `json:"algorithm"`
+	Limits    []Limit `json:"limits"`
+	Mode      string  `json:"mode"`
+}
+
+// Monitored returns true if the budget is not enforced.
+func (b *Budget) Monitored() bool {
+	return b.Mode == ModeMonitor
 }
 
 var ResponseChallenge = Response{
@@ -42,3 +149,31 @@ var ResponseChallenge = Response{
 var ResponseContinue = Response{
 	Code: http.StatusNoContent,
 }
+
+// TokenInfo describes a stored token for the administration API.
+type TokenInfo struct {
+	Token       string    `json:"token"`
+	Fingerprint string    `json:"fingerprint"`
+	Issued      time.Time `json:"issued"`
+	LastSeen    time.Time `json:"last_seen"`
+	Namespace   string    `json:"namespace,omitempty"` // Site of the token, empty for the default site
+}
+
+// TokenQuery filters stored tokens.
+type TokenQuery struct {
+	Fingerprint []byte // Prefix of the fingerprint value, all tokens match an empty prefix
+	Limit       int    // Maximum number of returned tokens, 0 means unlimited
+}
+
+// EndpointCounters describes request counters of a limit of the rate limited endpoint for the administration API.
+type EndpointCounters struct {
+	Method    string            `json:"method"`
+	Path      string            `json:"path"`
+	Key       string            `json:"key"`
+	Algorithm string            `json:"algorithm"`
+	Rate      Rate              `json:"rate"`
+	Action    string            `json:"action"`
+	Budget    string            `json:"budget,omitempty"` // Name of the budget, the method is "*" and the path is the name
+	Site      string            `json:"site,omitempty"`   // Site of the limit
+	Clients   map[string]uint32 `json:"clients"`          // Requests counted by the algorithm by client key
+}
@@ -0,0 +1,54 @@
+package usecase_test
+
+import (
+	"aegis/internal/usecase"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestApplied verifies the evaluation order, the final protections and the allow rules.
+func TestApplied(t *testing.T) {
+	protections := []usecase.Protection{
+		{Path: "^/api/"},
+		{Path: "^/api/health$", Action: usecase.ActionAllow, Priority: 10},
+		{Path: "^/api/v1/", Priority: 5, Final: true},
+		{Path: "^/api/v1/items$", Priority: 5},
+		{Path: "^/api/", Mode: usecase.ModeMonitor},
+	}
+	usecase.SortProtections(protections)
+	var order []string
+	for _, p := range protections {
+		order = append(order, p.Path)
+	}
+	assert.Equal(t, []string{"^/api/health$", "^/api/v1/", "^/api/v1/items$", "^/api/", "^/api/"}, order)
+
+	// applied evaluates the protections of the paths and returns the paths of the applied ones
+	applied := func(matching ...string) ([]string, bool) {
+		var matches []*usecase.Protection
+		for i := range protections {
+			if slices.Contains(matching, protections[i].Path) {
+				matches = append(matches, &protections[i])
+			}
+		}
+		result, allowed := usecase.Applied(matches, func(p *usecase.Protection) *usecase.Protection { return p })
+		var paths []string
+		for _, p := range result {
+			paths = append(paths, p.Path)
+		}
+		return paths, allowed
+	}
+	paths, allowed := applied("^/api/")
+	assert.Equal(t, []string{"^/api/", "^/api/"}, paths)
+	assert.False(t, allowed)
+
+	// The allow rule excludes the request from the enforced protections, the monitored ones are evaluated separately
+	paths, allowed = applied("^/api/health$", "^/api/")
+	assert.Equal(t, []string{"^/api/"}, paths)
+	assert.True(t, allowed)
+
+	// The final protection stops the evaluation
+	paths, _ = applied("^/api/v1/", "^/api/v1/items$", "^/api/")
+	assert.Equal(t, []string{"^/api/v1/", "^/api/"}, paths)
+}
@@ -0,0 +1,41 @@
+package usecase
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// MethodAny is the method of the protections matching requests of every method.
+const MethodAny = "*"
+
+// Pattern matches a request attribute exactly, by the prefix, by the glob with * and ? or by the regular
+// expression. It is represented in JSON either as a regular expression string or as an object with one
+// of the fields. The empty pattern matches any present value, absent matches the requests without the attribute.
+type Pattern struct {
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Glob   string `json:"glob,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Absent bool   `json:"absent,omitempty"`
+}
+
+// UnmarshalJSON parses the regular expression string or the pattern object. Unknown fields of the object are rejected.
+func (p *Pattern) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*p = Pattern{}
+		return json.Unmarshal(data, &p.Regex)
+	}
+	type pattern Pattern
+	return unmarshalStrict(data, (*pattern)(p))
+}
+
+// Methods returns the methods of the protection listed with commas, e.g. "GET,HEAD", or MethodAny.
+func (p *Protection) Methods() []string {
+	var methods []string
+	for method := range strings.SplitSeq(p.Method, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
@@ -0,0 +1,110 @@
+package usecase
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateUnits are the named periods of the rates.
+var rateUnits = []struct {
+	names  []string
+	period time.Duration
+}{
+	{[]string{"s", "sec", "second"}, time.Second},
+	{[]string{"min", "minute"}, time.Minute},
+	{[]string{"h", "hour"}, time.Hour},
+	{[]string{"day"}, 24 * time.Hour},
+}
+
+// Rate is a number of requests per period. It is represented in JSON as a string like "5/s", "200/min",
+// "10/h" or "5000/day". The period may also be a duration, e.g. "100/10m".
+type Rate struct {
+	Limit  uint32
+	Period time.Duration
+}
+
+// ParseRate parses the rate string.
+func ParseRate(s string) (Rate, error) {
+	count, unit, found := strings.Cut(strings.TrimSpace(s), "/")
+	if !found {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected <requests>/<period>", s)
+	}
+	limit, err := strconv.ParseUint(strings.TrimSpace(count), 10, 32)
+	if err != nil || limit == 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, the number of requests must be positive", s)
+	}
+	rate := Rate{Limit: uint32(limit)}
+	unit = strings.ToLower(strings.TrimSpace(unit))
+	for _, u := range rateUnits {
+		for _, name := range u.names {
+			if unit == name || unit == name+"s" {
+				rate.Period = u.period
+				return rate, nil
+			}
+		}
+	}
+	if rate.Period, err = time.ParseDuration(unit); err != nil || rate.Period <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, unknown period %q", s, unit)
+	}
+	return rate, nil
+}
+
+// String formats the rate with the shortest unit name.
+func (r Rate) String() string {
+	for _, u := range rateUnits {
+		if r.Period == u.period {
+			return fmt.Sprintf("%d/%s", r.Limit, u.names[0])
+		}
+	}
+	return fmt.Sprintf("%d/%s", r.Limit, r.Period)
+}
+
+// UnmarshalJSON parses the rate string.
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid rate %s", string(data))
+	}
+	parsed, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// MarshalJSON encodes the rate as a string.
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// Limit is a rate limit of the protection with the action applied to the clients exceeding it.
+// It is represented in JSON either as a rate string or as an object.
+type Limit struct {
+	Rate        Rate     `json:"rate"`
+	Action      string   `json:"action,omitempty"`       // Action on exceeding, depends on the key if empty
+	Burst       uint32   `json:"burst,omitempty"`        // Capacity of the token bucket, the rate limit if not set
+	Duration    Duration `json:"duration,omitempty"`     // Throttling, the first ban or the harder challenge duration
+	MaxDuration Duration `json:"max_duration,omitempty"` // Longest ban of the repeat offenders
+}
+
+// UnmarshalJSON parses the rate string or the limit object. Unknown fields of the object are rejected.
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*l = Limit{}
+		return l.Rate.UnmarshalJSON(data)
+	}
+	type limit Limit
+	return unmarshalStrict(data, (*limit)(l))
+}
+
+// unmarshalStrict parses the JSON object rejecting the unknown fields.
+func unmarshalStrict(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,46 @@
+package usecase_test
+
+import (
+	"aegis/internal/usecase"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseRate verifies the units and the formatting of the rates.
+func TestParseRate(t *testing.T) {
+	for s, expected := range map[string]usecase.Rate{
+		"5/s":        {Limit: 5, Period: time.Second},
+		"200/min":    {Limit: 200, Period: time.Minute},
+		"10 / hours": {Limit: 10, Period: time.Hour},
+		"5000/day":   {Limit: 5000, Period: 24 * time.Hour},
+		"100/10m":    {Limit: 100, Period: 10 * time.Minute},
+	} {
+		rate, err := usecase.ParseRate(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, rate, s)
+	}
+	for _, s := range []string{"5", "0/s", "-1/s", "5/week", "5/-1s"} {
+		_, err := usecase.ParseRate(s)
+		assert.Error(t, err, s)
+	}
+	assert.Equal(t, "200/min", usecase.Rate{Limit: 200, Period: time.Minute}.String())
+	assert.Equal(t, "100/10m0s", usecase.Rate{Limit: 100, Period: 10 * time.Minute}.String())
+}
+
+// TestLimitJSON verifies that the limit is decoded from the rate string and from the object.
+func TestLimitJSON(t *testing.T) {
+	var limits []usecase.Limit
+	err := json.Unmarshal([]byte(`["5/s", {"rate": "5000/day", "action": "deny", "burst": 100}]`), &limits)
+	assert.NoError(t, err)
+	assert.Equal(t, []usecase.Limit{
+		{Rate: usecase.Rate{Limit: 5, Period: time.Second}},
+		{Rate: usecase.Rate{Limit: 5000, Period: 24 * time.Hour}, Action: "deny", Burst: 100},
+	}, limits)
+	encoded, _ := json.Marshal(limits)
+	assert.JSONEq(t, `[{"rate":"5/s"},{"rate":"5000/day","action":"deny","burst":100}]`, string(encoded))
+
+	assert.Error(t, json.Unmarshal([]byte(`["5/week"]`), &limits))
+}
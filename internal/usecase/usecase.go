@@ -1,19 +1,74 @@
 package usecase
 
+import (
+	"net/url"
+	"time"
+)
+
+// Verdicts of the middleware chain on the request
+const (
+	VerdictContinue = iota // Request is passed to the next check
+	VerdictBan             // Client is banned, the block page is shown instead of the challenge
+	VerdictAllow           // Request is allowed
+)
+
+// Reasons of the token rejection
 const (
-	VerdictContinue = iota
-	VerdictBan
-	VerdictAllow
+	TokenReasonUnknown      = "unknown"
+	TokenReasonExpired      = "expired"
+	TokenReasonIdle         = "idle"
+	TokenReasonFingerprint  = "fingerprint mismatch"
+	TokenReasonMalformed    = "malformed"
+	TokenReasonSignature    = "invalid signature"
+	TokenReasonVerification = "verification mismatch"
+	TokenReasonNamespace    = "site mismatch"
+	TokenReasonRevoked      = "revoked"
+	TokenReasonUnavailable  = "storage unavailable"
 )
 
+// TokenValidationError describes why the token was rejected.
+type TokenValidationError struct {
+	Reason string
+}
+
+func (e TokenValidationError) Error() string {
+	return "token is rejected: " + e.Reason
+}
+
 type TokenManager interface {
 	ExtractToken(*Request) (string, bool)
 	GetChallenge(fp *Fingerprint) ([]byte, error)
 	GetToken(fp *Fingerprint, solution []byte) (string, error)
-	Validate(*Fingerprint, string) bool
+	// Validate returns nil if the token is valid for the fingerprint or TokenValidationError otherwise.
+	Validate(*Fingerprint, string) error
 	Revoke(string) bool
 }
 
+// ChallengeEscalator makes the challenges of a fingerprint harder for a while.
+type ChallengeEscalator interface {
+	// Escalate raises the challenge complexity of the fingerprint for the ttl.
+	Escalate(fingerprint []byte, ttl time.Duration) error
+}
+
+// ChallengeRouter chooses the verification of the client, e.g. the captcha for the repeat offenders.
+type ChallengeRouter interface {
+	// Route returns the token manager issuing the challenge of the client.
+	Route(fp *Fingerprint, address string) TokenManager
+}
+
+// TokenRegistry gives the administration access to the issued tokens.
+type TokenRegistry interface {
+	// Tokens returns stored tokens matching the query.
+	Tokens(query TokenQuery) ([]TokenInfo, error)
+	// Revoke invalidates the token. Returns true if the token was valid before.
+	Revoke(token string) bool
+	// RevokeFingerprint invalidates all tokens issued for the fingerprint and returns
+	// the number of revoked tokens if it is known.
+	RevokeFingerprint(fingerprint []byte) (int, error)
+	// Count returns the number of stored tokens without reading them.
+	Count() (int, error)
+}
+
 type ResponseSender interface {
 	Send(*Response) error
 }
@@ -42,7 +97,9 @@ type HttpFactors struct {
 	Cookies       map[string]string
 	Headers       map[string]string
 	Method        string
-	Path          string
+	Host          string     // Lowercase host without the port
+	Path          string     // Normalized path without the query
+	Query         url.Values // Query parameters
 	ClientAddress string
 	Token         string
 	Body          []byte
@@ -0,0 +1,135 @@
+package validator
+
+import (
+	"regexp/syntax"
+	"slices"
+	"strings"
+)
+
+const (
+	// maxSamples limits the number of sample paths generated for a pattern
+	maxSamples = 64
+	// sampleContext is prepended and appended to samples of unanchored patterns
+	sampleContext = "/aegis-check"
+)
+
+// samples generates paths matched by the pattern. The paths cover the alternatives and the repetitions
+// of the pattern, so they are used to detect rules matching the same paths.
+func samples(pattern string) ([]string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	generated := generate(re.Simplify())
+	result := make([]string, 0, len(generated)*3)
+	for _, s := range generated {
+		result = append(result, s)
+		// Unanchored patterns match paths with anything around
+		if !anchoredBegin(pattern) {
+			result = append(result, sampleContext+s)
+		}
+		if !anchoredEnd(pattern) {
+			result = append(result, s+sampleContext)
+		}
+	}
+	return result, nil
+}
+
+// anchoredBegin returns true if the pattern matches only at the beginning of the path.
+func anchoredBegin(pattern string) bool {
+	return strings.HasPrefix(pattern, "^") || strings.HasPrefix(pattern, `\A`)
+}
+
+// anchoredEnd returns true if the pattern matches only at the end of the path.
+func anchoredEnd(pattern string) bool {
+	return strings.HasSuffix(pattern, "$") || strings.HasSuffix(pattern, `\z`)
+}
+
+// generate returns strings matched by the expression, at most maxSamples.
+func generate(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		return classSamples(re.Rune)
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return []string{"a", "/"}
+	case syntax.OpCapture:
+		return generate(re.Sub[0])
+	case syntax.OpStar:
+		return union([]string{""}, generate(re.Sub[0]))
+	case syntax.OpQuest:
+		return union([]string{""}, generate(re.Sub[0]))
+	case syntax.OpPlus:
+		sub := generate(re.Sub[0])
+		return union(sub, product(sub, sub))
+	case syntax.OpRepeat:
+		sub := generate(re.Sub[0])
+		result := []string{""}
+		for range re.Min {
+			result = product(result, sub)
+		}
+		if re.Max == -1 || re.Max > re.Min {
+			result = union(result, product(result, sub))
+		}
+		return result
+	case syntax.OpConcat:
+		result := []string{""}
+		for _, sub := range re.Sub {
+			result = product(result, generate(sub))
+		}
+		return result
+	case syntax.OpAlternate:
+		var result []string
+		for _, sub := range re.Sub {
+			result = union(result, generate(sub))
+		}
+		return result
+	case syntax.OpNoMatch:
+		return nil
+	default:
+		// Empty matches and assertions
+		return []string{""}
+	}
+}
+
+// classSamples returns the lowest and the highest printable characters of the class ranges.
+func classSamples(ranges []rune) []string {
+	var result []string
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := max(ranges[i], '!'), min(ranges[i+1], '~')
+		if lo > hi {
+			lo, hi = ranges[i], ranges[i+1]
+		}
+		result = union(result, []string{string(lo), string(hi)})
+	}
+	return result
+}
+
+// product returns concatenations of every pair of strings.
+func product(a, b []string) []string {
+	result := make([]string, 0, min(len(a)*len(b), maxSamples))
+	for _, x := range a {
+		for _, y := range b {
+			if len(result) == maxSamples {
+				return result
+			}
+			result = append(result, x+y)
+		}
+	}
+	return result
+}
+
+// union returns distinct strings of both sets.
+func union(a, b []string) []string {
+	result := make([]string, 0, len(a)+len(b))
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, s := range slices.Concat(a, b) {
+		if _, exists := seen[s]; exists || len(result) == maxSamples {
+			continue
+		}
+		seen[s] = struct{}{}
+		result = append(result, s)
+	}
+	return result
+}
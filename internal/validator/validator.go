@@ -0,0 +1,522 @@
+// Package validator checks the configuration before it is applied.
+package validator
+
+import (
+	"aegis/internal/captcha"
+	"aegis/internal/config"
+	"aegis/internal/limiter"
+	"aegis/internal/matcher"
+	"aegis/internal/remap"
+	"aegis/internal/sha_challenge"
+	"aegis/internal/store"
+	"aegis/internal/tokens"
+	"aegis/internal/usecase"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	verificationTypes = []string{"js-challenge", "captcha"}
+	complexities      = []string{"easy", "medium", "hard"}
+	loggerLevels      = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+	tokenFormats      = []string{tokens.FormatRandom, tokens.FormatHmac}
+	storageTypes      = []string{store.TypeMemory, store.TypeFile, store.TypeRedis}
+	methods           = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+	modes             = []string{usecase.ModeEnforce, usecase.ModeMonitor}
+	matchModes        = []string{usecase.MatchAll, usecase.MatchFirst}
+	siteName          = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// Report contains problems found in the configuration. Errors prevent the configuration from being applied,
+// warnings point to rules which probably do not work as intended.
+type Report struct {
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func (r *Report) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) warnf(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Valid returns true if there are no errors.
+func (r *Report) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+// Err returns the errors joined into a single error or nil if the configuration is valid.
+func (r *Report) Err() error {
+	errs := make([]error, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		errs = append(errs, errors.New(e))
+	}
+	return errors.Join(errs...)
+}
+
+// Print writes errors and warnings, one per line.
+func (r *Report) Print(w io.Writer) {
+	for _, e := range r.Errors {
+		fmt.Fprintln(w, "error: "+e)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintln(w, "warning: "+warning)
+	}
+}
+
+// rule is a compiled protection with the paths it matches.
+type rule struct {
+	name       string
+	protection config.ProtectionConfig
+	re         *regexp.Regexp
+	samples    []string
+}
+
+// matchesAll returns true if the rule matches every path.
+func (r *rule) matchesAll(paths []string) bool {
+	for _, path := range paths {
+		if !r.re.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasConditions returns true if the rule has conditions besides the method and the path.
+func (r *rule) hasConditions() bool {
+	p := &r.protection
+	return p.Host != nil || len(p.Headers) > 0 || len(p.Cookies) > 0 || len(p.Query) > 0 || len(p.Networks) > 0
+}
+
+// sameConditions returns true if the rules have the same conditions besides the method and the path.
+func (r *rule) sameConditions(other *rule) bool {
+	a, b := &r.protection, &other.protection
+	return (a.Host == nil) == (b.Host == nil) && (a.Host == nil || *a.Host == *b.Host) &&
+		maps.Equal(a.Headers, b.Headers) && maps.Equal(a.Cookies, b.Cookies) && maps.Equal(a.Query, b.Query) &&
+		slices.Equal(a.Networks, b.Networks)
+}
+
+// covers returns true if the rule matches every request of the other rule with the matching path: it matches
+// all methods of the other rule and has no other conditions or the same ones.
+func (r *rule) covers(other *rule) bool {
+	methods := r.methods()
+	if !slices.Contains(methods, remap.AnyMethod) &&
+		(slices.Contains(other.methods(), remap.AnyMethod) || slices.ContainsFunc(other.methods(), func(m string) bool {
+			return !slices.Contains(methods, m)
+		})) {
+		return false
+	}
+	return !r.hasConditions() || r.sameConditions(other)
+}
+
+// methods returns the methods of the rule.
+func (r *rule) methods() []string {
+	return (*usecase.Protection)(&r.protection).Methods()
+}
+
+// sharesMethod returns true if the rules match requests of a common method.
+func (r *rule) sharesMethod(other *rule) bool {
+	a, b := r.methods(), other.methods()
+	return slices.Contains(a, remap.AnyMethod) || slices.Contains(b, remap.AnyMethod) ||
+		slices.ContainsFunc(a, func(m string) bool { return slices.Contains(b, m) })
+}
+
+// matchesAny returns true if the rule matches at least one path.
+func (r *rule) matchesAny(paths []string) bool {
+	return slices.ContainsFunc(paths, r.re.MatchString)
+}
+
+// limit formats the RPS limit of the rule.
+func (r *rule) limit() string {
+	if r.protection.Limit == math.MaxUint32 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("rps %d", r.protection.Limit)
+}
+
+// Validate checks the loaded configuration.
+//
+// Parameters:
+//   - cfg: Configuration after config.Load, so defaults are already set.
+//
+// Returns:
+//   - *Report: Errors on invalid values, unknown names, regex errors, missing asset files and hosts of several sites;
+//     warnings on unanchored patterns, overlapping or shadowed protections, misplaced allow rules and cookie domains
+//     not covering the hosts.
+func Validate(cfg *config.Config) *Report {
+	report := Report{Errors: []string{}, Warnings: []string{}}
+	validateSettings(cfg, &report)
+	validateStrikes(&cfg.Strikes, cfg.Verification.Type, &report)
+	validateUnderAttack(&cfg.UnderAttack, &report)
+	validateSites(cfg.Sites, &report)
+	var verifications []config.VerificationConfig
+	for i, site := range cfg.AllSites() {
+		prefix := ""
+		if i > 0 {
+			prefix = fmt.Sprintf("sites[%d].", i-1)
+		}
+		if i == 0 || site.Verification != cfg.Verification {
+			validateVerification(prefix, &site.Verification, &report)
+		}
+		if !slices.Contains(verifications, site.Verification) {
+			validateAssets(prefix, &site.Verification, &cfg.Strikes, &report)
+			verifications = append(verifications, site.Verification)
+		}
+		validateRules(prefix, &site, &report)
+	}
+	return &report
+}
+
+// validateRules checks the match mode, the budgets and the protections of the site.
+func validateRules(prefix string, site *config.SiteConfig, report *Report) {
+	if site.Match != "" && !slices.Contains(matchModes, site.Match) {
+		report.errorf("%smatch: unknown match mode %q", prefix, site.Match)
+	}
+	verification := site.Verification.Type
+	budgets := validateBudgets(prefix+"budgets", site.Budgets, verification, report)
+	first := site.Match == usecase.MatchFirst
+	analyzeRules(validateProtections(prefix+"protections", site.Protections, budgets, verification, report), first, report)
+	analyzeRules(validateProtections(prefix+"shadow", site.Shadow, budgets, verification, report), first, report)
+}
+
+// validateSites checks the names, the hosts and the cookie domains of the sites.
+func validateSites(sites []config.SiteConfig, report *Report) {
+	names := map[string]struct{}{config.DefaultSite: {}}
+	hosts := map[string]string{}
+	for i, site := range sites {
+		name := fmt.Sprintf("sites[%d] %s", i, site.Name)
+		switch _, found := names[site.Name]; {
+		case site.Name == "":
+			report.errorf("%s: name is required", name)
+		case found:
+			report.errorf("%s: duplicate name", name)
+		case !siteName.MatchString(site.Name):
+			report.errorf("%s: name may contain only letters, digits, '_', '-' and '.'", name)
+		}
+		names[site.Name] = struct{}{}
+		if len(site.Hosts) == 0 {
+			report.errorf("%s: at least one host is required", name)
+		}
+		for _, host := range site.Hosts {
+			switch other, found := hosts[host]; {
+			case host == "":
+				report.errorf("%s: host is empty", name)
+			case strings.Count(host, ":") == 1:
+				report.errorf("%s: host %s: host must not contain the port", name, host)
+			case found:
+				report.errorf("%s: host %s already belongs to the site %s", name, host, other)
+			}
+			hosts[host] = site.Name
+			if _, err := path.Match(host, ""); err != nil {
+				report.errorf("%s: host %s: %s", name, host, err)
+			}
+			domain := strings.TrimPrefix(strings.ToLower(site.CookieDomain), ".")
+			if domain != "" && host != domain && !strings.HasSuffix(host, "."+domain) {
+				report.warnf("%s: cookie domain %s does not cover the host %s, browsers reject the token cookie",
+					name, site.CookieDomain, host)
+			}
+		}
+	}
+}
+
+// validateVerification checks the verification type and the complexity.
+func validateVerification(prefix string, verification *config.VerificationConfig, report *Report) {
+	if !slices.Contains(verificationTypes, verification.Type) {
+		report.errorf("%sverification.type: unknown type %q", prefix, verification.Type)
+	}
+	switch {
+	case verification.Complexity == "" && verification.Type == "captcha":
+		report.errorf("%sverification.complexity: complexity is required for captcha", prefix)
+	case verification.Complexity != "" && !slices.Contains(complexities, verification.Complexity):
+		report.errorf("%sverification.complexity: unknown complexity %q", prefix, verification.Complexity)
+	}
+}
+
+// validateSettings checks the enumerated settings.
+func validateSettings(cfg *config.Config, report *Report) {
+	if !slices.Contains(loggerLevels, cfg.Logger.Level) {
+		report.errorf("logger.level: unknown level %q", cfg.Logger.Level)
+	}
+	if !slices.Contains(tokenFormats, cfg.Tokens.Format) {
+		report.errorf("tokens.format: unknown format %q", cfg.Tokens.Format)
+	}
+	if cfg.Tokens.Format == tokens.FormatHmac && len(cfg.Tokens.Keys) == 0 {
+		report.errorf("tokens.keys: keys are required for the %s format", tokens.FormatHmac)
+	}
+	if cfg.Tokens.Format == tokens.FormatHmac && cfg.Tokens.TTL == 0 {
+		report.errorf("tokens.ttl: expiration can not be disabled for the %s format", tokens.FormatHmac)
+	}
+	if !slices.Contains(storageTypes, cfg.Storage.Type) {
+		report.errorf("storage.type: unknown type %q", cfg.Storage.Type)
+	}
+}
+
+// validateAssets checks that the files of the verification page exist.
+func validateAssets(prefix string, verification *config.VerificationConfig, strikes *config.StrikesConfig, report *Report) {
+	var assets []string
+	switch verification.Type {
+	case "js-challenge":
+		assets = sha_challenge.Assets()
+	case "captcha":
+		if verification.Complexity == "" {
+			return
+		}
+		var err error
+		if assets, err = captcha.Assets(verification.Complexity); err != nil && !errors.Is(err, os.ErrNotExist) {
+			report.errorf("%sverification: %s", prefix, err)
+		}
+	}
+	if strikes.Captcha > 0 && verification.Type == "js-challenge" {
+		captchaAssets, err := captcha.Assets(cmp.Or(verification.Complexity, "medium"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			report.errorf("strikes.captcha: %s", err)
+		}
+		assets = append(assets, captchaAssets...)
+	}
+	for _, asset := range assets {
+		if _, err := os.Stat(asset); err != nil {
+			report.errorf("%sverification: asset is not available: %s", prefix, err)
+		}
+	}
+}
+
+// validateStrikes checks the thresholds of the repeat offenders.
+func validateStrikes(strikes *config.StrikesConfig, verification string, report *Report) {
+	if strikes.Escalate < 0 || strikes.Captcha < 0 || strikes.Ban < 0 {
+		report.errorf("strikes: thresholds must not be negative")
+	}
+	if strikes.TTL < 0 || strikes.BanDuration < 0 {
+		report.errorf("strikes: durations must not be negative")
+	}
+	if strikes.Captcha > 0 && verification != "js-challenge" {
+		report.warnf("strikes.captcha: the captcha is already the verification, the threshold is ignored")
+	}
+	if strikes.Escalate > 0 && verification != "js-challenge" {
+		report.warnf("strikes.escalate: only the js-challenge is escalated, the threshold is ignored")
+	}
+	if strikes.Ban > 0 && strikes.Ban <= max(strikes.Escalate, strikes.Captcha) {
+		report.warnf("strikes.ban: clients are banned before the other punishments")
+	}
+}
+
+// validateUnderAttack checks the thresholds and the paths of the under attack mode.
+func validateUnderAttack(underAttack *config.UnderAttackConfig, report *Report) {
+	if underAttack.Release > underAttack.Threshold {
+		report.errorf("under_attack.release: release must not exceed the threshold")
+	}
+	if underAttack.LimitFactor <= 0 || underAttack.LimitFactor > 1 {
+		report.errorf("under_attack.limit_factor: factor must be in (0, 1]")
+	}
+	if underAttack.Cooldown < 0 || underAttack.TokenMaxAge < 0 {
+		report.errorf("under_attack: durations must not be negative")
+	}
+	for i, path := range underAttack.Paths {
+		if _, err := regexp.Compile(path); err != nil {
+			report.errorf("under_attack.paths[%d] %s: %s", i, path, err)
+		}
+	}
+}
+
+// validateBudgets checks the budgets of the section and returns their names.
+func validateBudgets(section string, budgets []config.BudgetConfig, verification string, report *Report) map[string]struct{} {
+	names := map[string]struct{}{}
+	for i, budget := range budgets {
+		name := fmt.Sprintf("%s[%d] %s", section, i, budget.Name)
+		if budget.Name == "" {
+			report.errorf("%s: name is required", name)
+		} else if _, found := names[budget.Name]; found {
+			report.errorf("%s: duplicate name", name)
+		}
+		names[budget.Name] = struct{}{}
+		if budget.Mode != "" && !slices.Contains(modes, budget.Mode) {
+			report.errorf("%s: unknown mode %q", name, budget.Mode)
+		}
+		if len(budget.Limits) == 0 {
+			report.errorf("%s: at least one limit is required", name)
+		}
+		if key, err := limiter.ParseKey(budget.Key); err != nil {
+			report.errorf("%s: %s", name, err)
+		} else {
+			validateLimits(name, budget.Limits, budget.Algorithm, key, verification, report)
+		}
+		if _, err := limiter.ParseAlgorithm(budget.Algorithm); err != nil {
+			report.errorf("%s: %s", name, err)
+		}
+	}
+	return names
+}
+
+// validateProtections compiles the protections of the section and warns about unanchored patterns.
+func validateProtections(
+	section string,
+	protections []config.ProtectionConfig,
+	budgets map[string]struct{},
+	verification string,
+	report *Report,
+) []*rule {
+	var rules []*rule
+	for i, protection := range protections {
+		name := fmt.Sprintf("%s[%d] %s %s", section, i, protection.Method, protection.Path)
+		ruleMethods := (*usecase.Protection)(&protection).Methods()
+		if len(ruleMethods) == 0 {
+			report.errorf("%s: method is required", name)
+		}
+		for _, method := range ruleMethods {
+			if method != remap.AnyMethod && !slices.Contains(methods, method) {
+				report.errorf("%s: unknown method %q", name, method)
+			}
+		}
+		if protection.Mode != "" && !slices.Contains(modes, protection.Mode) {
+			report.errorf("%s: unknown mode %q", name, protection.Mode)
+		}
+		if _, found := budgets[protection.Budget]; protection.Budget != "" && !found {
+			report.errorf("%s: unknown budget %q", name, protection.Budget)
+		}
+		switch {
+		case protection.Action != "" && protection.Action != usecase.ActionAllow:
+			report.errorf("%s: unknown action %q, expected %s", name, protection.Action, usecase.ActionAllow)
+		case protection.Action == usecase.ActionAllow &&
+			(protection.Limit != math.MaxUint32 || len(protection.Limits) > 0 || protection.Budget != ""):
+			report.warnf("%s: limits and budget of the allow rule are ignored", name)
+		}
+		if protection.Cost > 1 && protection.Limit != math.MaxUint32 && protection.Cost > protection.Limit {
+			report.warnf("%s: cost %d exceeds rps %d, every request exceeds the limit", name, protection.Cost, protection.Limit)
+		}
+		if _, err := matcher.Compile((*usecase.Protection)(&protection)); err != nil {
+			report.errorf("%s: %s", name, err)
+		}
+		if key, err := limiter.ParseKey(protection.Key); err != nil {
+			report.errorf("%s: %s", name, err)
+		} else {
+			validateLimits(name, protection.Limits, protection.Algorithm, key, verification, report)
+		}
+		if _, err := limiter.ParseAlgorithm(protection.Algorithm); err != nil {
+			report.errorf("%s: %s", name, err)
+		} else if protection.Burst != 0 && protection.Algorithm != limiter.AlgorithmTokenBucket {
+			report.warnf("%s: burst is applied only by the %s algorithm", name, limiter.AlgorithmTokenBucket)
+		}
+		re, err := regexp.Compile(protection.Path)
+		if err != nil {
+			report.errorf("%s: %s", name, err)
+			continue
+		}
+		paths, err := samples(protection.Path)
+		if err != nil {
+			report.errorf("%s: %s", name, err)
+			continue
+		}
+		if len(paths) == 0 {
+			report.warnf("%s: pattern never matches", name)
+			continue
+		}
+		if !anchoredBegin(protection.Path) {
+			report.warnf("%s: pattern is not anchored with ^ and matches the path anywhere, e.g. %s",
+				name, paths[min(1, len(paths)-1)])
+		} else if end := protection.Path[len(protection.Path)-1]; !anchoredEnd(protection.Path) && isWordChar(end) {
+			report.warnf("%s: pattern is not anchored with $ and matches longer paths, e.g. %s",
+				name, paths[0]+"name")
+		}
+		rules = append(rules, &rule{name: name, protection: protection, re: re, samples: paths})
+	}
+	return rules
+}
+
+// validateLimits checks the actions, the durations and the periods of the limits.
+func validateLimits(name string, limits []usecase.Limit, algorithm string, key limiter.Key, verification string, report *Report) {
+	for _, limit := range limits {
+		action, err := limiter.ParseAction(limit.Action, key)
+		if err != nil {
+			report.errorf("%s: limit %s: %s", name, limit.Rate, err)
+		}
+		switch {
+		case limit.Duration < 0 || limit.MaxDuration < 0:
+			report.errorf("%s: limit %s: duration must not be negative", name, limit.Rate)
+		case limit.MaxDuration != 0 && limit.MaxDuration < limit.Duration:
+			report.warnf("%s: limit %s: max_duration is shorter than duration, duration is used", name, limit.Rate)
+		case action == limiter.ActionChallenge && verification != "js-challenge":
+			report.warnf("%s: limit %s: challenge action makes only the js-challenge harder, %s is not changed",
+				name, limit.Rate, verification)
+		}
+		if limit.Rate.Period < time.Second {
+			report.errorf("%s: limit %s: period is shorter than a second", name, limit.Rate)
+		}
+		if limit.Burst != 0 && algorithm != limiter.AlgorithmTokenBucket {
+			report.warnf("%s: limit %s: burst is applied only by the %s algorithm", name, limit.Rate, limiter.AlgorithmTokenBucket)
+		}
+	}
+}
+
+// analyzeRules warns about the rules which never apply or do not work as intended in the evaluation order.
+// Rules of the same method, key and mode matching the same paths all count the request unless the first one
+// is final, so the lowest limit applies to the paths matched by several rules. The allow rule evaluated after
+// a rule matching its paths does not exclude them from that rule.
+func analyzeRules(rules []*rule, first bool, report *Report) {
+	slices.SortStableFunc(rules, func(a, b *rule) int {
+		return cmp.Compare(b.protection.Priority, a.protection.Priority)
+	})
+	final := func(r *rule) bool {
+		return first || r.protection.Final || r.protection.Action == usecase.ActionAllow
+	}
+	unreachable := map[*rule]bool{}
+	for i, a := range rules {
+		for _, b := range rules[i+1:] {
+			if !a.sharesMethod(b) || a.protection.Mode != b.protection.Mode ||
+				unreachable[a] || unreachable[b] {
+				continue
+			}
+			allow := a.protection.Action == usecase.ActionAllow || b.protection.Action == usecase.ActionAllow
+			switch {
+			case final(a) && a.covers(b) && a.matchesAll(b.samples):
+				unreachable[b] = true
+				report.warnf("%s: never applies, every matching path is matched by %s first", b.name, a.name)
+			case b.protection.Action == usecase.ActionAllow && !final(a) && a.matchesAny(b.samples):
+				report.warnf("%s: %s is evaluated first and still applies to the excluded paths, "+
+					"give the allow rule a higher priority", b.name, a.name)
+			case allow || final(a) || a.protection.Key != b.protection.Key || a.protection.Method != b.protection.Method ||
+				!a.sameConditions(b):
+				continue
+			case a.protection.Path == b.protection.Path:
+				report.warnf("%s: duplicates %s, the lowest limit applies", b.name, a.name)
+			case a.matchesAll(b.samples) && a.protection.Limit <= b.protection.Limit:
+				report.warnf("%s: %s", b.name, shadowed(a))
+			case b.matchesAll(a.samples) && b.protection.Limit <= a.protection.Limit:
+				report.warnf("%s: %s", a.name, shadowed(b))
+			case a.protection.Limit != b.protection.Limit && (a.matchesAny(b.samples) || b.matchesAny(a.samples)):
+				report.warnf("%s: overlaps %s with a different limit, paths matching both are limited by %s",
+					b.name, a.name, lowest(a, b).limit())
+			}
+		}
+	}
+}
+
+// shadowed describes the rule shadowed by the broader rule.
+func shadowed(by *rule) string {
+	if by.protection.Limit == math.MaxUint32 {
+		return "redundant, every matching path is already protected by " + by.name
+	}
+	return fmt.Sprintf("shadowed by %s, every matching path is limited by %s first", by.name, by.limit())
+}
+
+// lowest returns the rule with the lowest limit.
+func lowest(a, b *rule) *rule {
+	if b.protection.Limit < a.protection.Limit {
+		return b
+	}
+	return a
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
@@ -0,0 +1,255 @@
+package validator
+
+import (
+	"aegis/internal/config"
+	"aegis/internal/usecase"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// matching returns the messages containing the substring.
+func matching(messages []string, substring string) []string {
+	var found []string
+	for _, m := range messages {
+		if strings.Contains(m, substring) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// TestSamples verifies that the generated samples are matched by the pattern.
+func TestSamples(t *testing.T) {
+	for _, pattern := range []string{`^/api/articles/\d+/comments$`, `/user`, `^/(index.html)?$`, `^/(a|b){2,3}/[x-z]*$`} {
+		paths, err := samples(pattern)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, paths)
+		r := rule{re: regexp.MustCompile(pattern)}
+		assert.True(t, r.matchesAll(paths), pattern)
+	}
+	paths, _ := samples(`^/(index.html)?$`)
+	assert.Contains(t, paths, "/")
+	assert.Contains(t, paths, "/indexahtml")
+}
+
+// TestValidateProtections verifies errors and warnings of the protection rules.
+func TestValidateProtections(t *testing.T) {
+	cfg := config.Config{
+		Protections: []config.ProtectionConfig{
+			{Path: "^/api/", Method: "GET", Limit: 100},
+			{Path: `^/api/articles/\d+/comments$`, Method: "GET", Limit: 10},
+			{Path: `^/api/articles/\d+/comments$`, Method: "POST", Limit: 2},
+			{Path: "^/api/v1/users$", Method: "GET", Limit: 200},
+			{Path: "/user", Method: "GET", Limit: math.MaxUint32},
+			{Path: "^/(broken", Method: "GET", Limit: 1},
+			{Path: "^/index.html$", Method: "FETCH", Limit: 1},
+			{Path: "^/search$", Method: "GET", Limit: 5, Key: "cookie", Algorithm: "leaky_bucket"},
+			{Path: "^/feed$", Method: "GET", Limit: 5, Algorithm: "sliding_window", Burst: 10},
+			{Path: "^/export$", Method: "GET", Key: "ip", Limits: []usecase.Limit{
+				{Rate: usecase.Rate{Limit: 100, Period: time.Hour}, Action: "revoke"},
+				{Rate: usecase.Rate{Limit: 5, Period: time.Millisecond}},
+				{Rate: usecase.Rate{Limit: 10, Period: time.Minute}, Action: "ban",
+					Duration: usecase.Duration(time.Hour), MaxDuration: usecase.Duration(time.Minute)},
+			}},
+		},
+	}
+	report := Validate(&cfg)
+	assert.False(t, report.Valid())
+
+	assert.Len(t, matching(report.Errors, "protections[5]"), 1)
+	assert.Len(t, matching(report.Errors, `unknown method "FETCH"`), 1)
+	assert.Len(t, matching(report.Warnings, "protections[4] GET /user: pattern is not anchored with ^"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[1] GET ^/api/articles/\\d+/comments$: overlaps protections[0]"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[3] GET ^/api/v1/users$: shadowed by protections[0]"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[2]"), 0)
+	assert.Len(t, matching(report.Errors, `protections[7] GET ^/search$: unknown key part "cookie"`), 1)
+	assert.Len(t, matching(report.Errors, `protections[7] GET ^/search$: unknown algorithm "leaky_bucket"`), 1)
+	assert.Len(t, matching(report.Warnings, "protections[8] GET ^/feed$: burst is applied only by the token_bucket"), 1)
+	assert.Len(t, matching(report.Errors, "protections[9] GET ^/export$: limit 100/h: action revoke requires the key including token"), 1)
+	assert.Len(t, matching(report.Errors, "protections[9] GET ^/export$: limit 5/1ms: period is shorter than a second"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[9] GET ^/export$: limit 10/min: max_duration is shorter"), 1)
+}
+
+// TestValidateNeverMatches verifies that the patterns matching no path are reported without the anchoring warnings.
+func TestValidateNeverMatches(t *testing.T) {
+	cfg := config.Config{
+		Protections: []config.ProtectionConfig{
+			{Path: `[^\x00-\x{10FFFF}]`, Method: "GET", Limit: 1},
+			{Path: `^[^\x00-\x{10FFFF}]a`, Method: "GET", Limit: 1},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Warnings, "pattern never matches"), 2)
+	assert.Empty(t, matching(report.Warnings, "not anchored"))
+}
+
+// TestValidateStrikes verifies the checks of the repeat offender thresholds.
+func TestValidateStrikes(t *testing.T) {
+	report := Report{}
+	validateStrikes(&config.StrikesConfig{Escalate: -1}, "js-challenge", &report)
+	assert.Len(t, matching(report.Errors, "strikes: thresholds must not be negative"), 1)
+
+	report = Report{}
+	validateStrikes(&config.StrikesConfig{Escalate: 3, Captcha: 5, Ban: 5}, "captcha", &report)
+	assert.Empty(t, report.Errors)
+	assert.Len(t, matching(report.Warnings, "strikes.captcha: the captcha is already the verification"), 1)
+	assert.Len(t, matching(report.Warnings, "strikes.escalate: only the js-challenge is escalated"), 1)
+	assert.Len(t, matching(report.Warnings, "strikes.ban: clients are banned before"), 1)
+}
+
+// TestValidateShadow verifies that the shadow rules are validated and analyzed apart from the live ones.
+func TestValidateShadow(t *testing.T) {
+	cfg := config.Config{
+		Protections: []config.ProtectionConfig{
+			{Path: "^/api/", Method: "GET", Limit: 100},
+			{Path: "^/login$", Method: "POST", Limit: 5, Mode: "dry"},
+		},
+		Shadow: []config.ProtectionConfig{
+			{Path: "^/api/", Method: "GET", Limit: 50, Mode: usecase.ModeMonitor},
+			{Path: "^/api/v1/", Method: "GET", Limit: 50, Mode: usecase.ModeMonitor},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Errors, `protections[1] POST ^/login$: unknown mode "dry"`), 1)
+	assert.Len(t, matching(report.Warnings, "shadow[1] GET ^/api/v1/: shadowed by shadow[0]"), 1)
+	assert.Len(t, matching(report.Warnings, "shadow[0]"), 1)
+}
+
+// TestValidateBudgets verifies the budgets and the references of the protections.
+func TestValidateBudgets(t *testing.T) {
+	cfg := config.Config{
+		Budgets: []config.BudgetConfig{
+			{Name: "api", Key: "ip", Limits: []usecase.Limit{{Rate: usecase.Rate{Limit: 1000, Period: time.Minute}}}},
+			{Name: "api", Key: "ip"},
+			{Name: "", Key: "ip", Limits: []usecase.Limit{{Rate: usecase.Rate{Limit: 1000, Period: time.Minute}, Action: "revoke"}}},
+		},
+		Protections: []config.ProtectionConfig{
+			{Path: "^/search$", Method: "GET", Limit: 10, Cost: 50, Budget: "api"},
+			{Path: "^/export$", Method: "GET", Limit: math.MaxUint32, Cost: 50, Budget: "exports"},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Errors, "budgets[0]"), 0)
+	assert.Len(t, matching(report.Errors, "budgets[1] api: duplicate name"), 1)
+	assert.Len(t, matching(report.Errors, "budgets[1] api: at least one limit is required"), 1)
+	assert.Len(t, matching(report.Errors, "budgets[2] : name is required"), 1)
+	assert.Len(t, matching(report.Errors, "budgets[2] : limit 1000/min: action revoke requires the key including token"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[0] GET ^/search$: cost 50 exceeds rps 10"), 1)
+	assert.Len(t, matching(report.Errors, `protections[1] GET ^/export$: unknown budget "exports"`), 1)
+}
+
+// TestValidateUnderAttack verifies the checks of the under attack mode.
+func TestValidateUnderAttack(t *testing.T) {
+	report := Report{}
+	validateUnderAttack(&config.UnderAttackConfig{Threshold: 10, Release: 20, LimitFactor: 2, Paths: []string{"^/(login"}}, &report)
+	assert.Len(t, matching(report.Errors, "under_attack.release: release must not exceed the threshold"), 1)
+	assert.Len(t, matching(report.Errors, "under_attack.limit_factor"), 1)
+	assert.Len(t, matching(report.Errors, "under_attack.paths[0] ^/(login"), 1)
+}
+
+// TestValidateRuleOrder verifies the checks of the priorities, the allow rules and the first match mode.
+func TestValidateRuleOrder(t *testing.T) {
+	cfg := config.Config{
+		Protections: []config.ProtectionConfig{
+			{Path: "^/api/", Method: "GET", Limit: 100, Key: "token"},
+			{Path: "^/api/health$", Method: "GET", Limit: math.MaxUint32, Action: usecase.ActionAllow},
+			{Path: "^/static/", Method: "GET", Limit: math.MaxUint32, Action: usecase.ActionAllow, Priority: 10},
+			{Path: "^/static/app\\.js$", Method: "GET", Limit: 10, Key: "token"},
+			{Path: "^/admin/", Method: "GET", Limit: 5, Action: "skip"},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Warnings, "protections[1] GET ^/api/health$: protections[0] GET ^/api/ is evaluated first"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[3] GET ^/static/app\\.js$: never applies"), 1)
+	assert.Len(t, matching(report.Errors, `protections[4] GET ^/admin/: unknown action "skip"`), 1)
+
+	cfg.Protections[1].Priority = 1
+	cfg.Protections[1].Limit = 5
+	report = Validate(&cfg)
+	assert.Len(t, matching(report.Warnings, "protections[1]"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[1] GET ^/api/health$: limits and budget of the allow rule are ignored"), 1)
+
+	cfg = config.Config{
+		Match: usecase.MatchFirst,
+		Protections: []config.ProtectionConfig{
+			{Path: "^/api/", Method: "GET", Limit: 100, Key: "token"},
+			{Path: "^/api/v1/", Method: "GET", Limit: 10, Key: "token", Priority: 1},
+			{Path: "^/api/v1/items$", Method: "GET", Limit: 1, Key: "token"},
+		},
+	}
+	report = Validate(&cfg)
+	assert.Len(t, matching(report.Warnings, "protections[0]"), 0)
+	assert.Len(t, matching(report.Warnings, "protections[2] GET ^/api/v1/items$: never applies, every matching path is matched by protections[1]"), 1)
+	cfg.Match = "any"
+	assert.Len(t, matching(Validate(&cfg).Errors, `match: unknown match mode "any"`), 1)
+}
+
+// TestValidateQuery verifies the query conditions and that the rules with other conditions do not shadow each other.
+func TestValidateQuery(t *testing.T) {
+	cfg := config.Config{
+		Match: usecase.MatchFirst,
+		Protections: []config.ProtectionConfig{
+			{Path: "^/search$", Method: "GET", Limit: 1, Key: "token", Query: map[string]usecase.Pattern{"q": {Regex: "^.{100,}$"}}},
+			{Path: "^/search$", Method: "GET", Limit: 10, Key: "token"},
+			{Path: "^/export$", Method: "GET", Limit: 1, Key: "token", Query: map[string]usecase.Pattern{"format": {Regex: "(csv"}}},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Warnings, "protections[1]"), 0)
+	assert.Len(t, matching(report.Errors, "protections[2] GET ^/export$: query parameter format"), 1)
+}
+
+// TestValidateMatchers verifies the methods and the conditions of the protections.
+func TestValidateMatchers(t *testing.T) {
+	cfg := config.Config{
+		Match: usecase.MatchFirst,
+		Protections: []config.ProtectionConfig{
+			{Path: "^/api/", Method: "*", Limit: 100, Key: "token", Networks: []string{"10.0.0.0/8"}},
+			{Path: "^/api/", Method: "GET,HEAD", Limit: 10, Key: "token", Host: &usecase.Pattern{Glob: "*.example.com"}},
+			{Path: "^/api/v1/", Method: "GET", Limit: 10, Key: "token", Networks: []string{"10.0.0.0/8"}},
+			{Path: "^/api/v1/", Method: "GET, HEAD", Limit: 5, Key: "token", Host: &usecase.Pattern{Glob: "*.example.com"}},
+			{Path: "^/admin/", Method: "GET,FETCH", Limit: 1, Networks: []string{"10.0.0.0/33"}},
+			{Path: "^/login$", Method: "", Limit: 1, Headers: map[string]usecase.Pattern{"X-Token": {Exact: "a", Absent: true}}},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Warnings, "protections[1] GET,HEAD ^/api/: "), 0)
+	assert.Len(t, matching(report.Warnings, "protections[2] GET ^/api/v1/: never applies, every matching path is matched by protections[0]"), 1)
+	assert.Len(t, matching(report.Warnings, "protections[3] GET, HEAD ^/api/v1/: never applies, every matching path is matched by protections[1]"), 1)
+	assert.Len(t, matching(report.Errors, `protections[4] GET,FETCH ^/admin/: unknown method "FETCH"`), 1)
+	assert.Len(t, matching(report.Errors, "protections[4] GET,FETCH ^/admin/: network 10.0.0.0/33"), 1)
+	assert.Len(t, matching(report.Errors, "protections[5]  ^/login$: method is required"), 1)
+	assert.Len(t, matching(report.Errors, "protections[5]  ^/login$: header X-Token: only one of"), 1)
+}
+
+// TestValidateSites verifies the names, the hosts and the rules of the sites.
+func TestValidateSites(t *testing.T) {
+	cfg := config.Config{
+		Match:        usecase.MatchAll,
+		Verification: config.VerificationConfig{Type: "js-challenge"},
+		Sites: []config.SiteConfig{
+			{Name: "shop", Hosts: []string{"shop.example.com", "*.shop.example.com"}, CookieDomain: "example.com",
+				Verification: config.VerificationConfig{Type: "captcha"}, Match: "any",
+				Protections: []config.ProtectionConfig{{Path: "^/cart$", Method: "POST", Limit: 2, Budget: "api"}}},
+			{Name: "default", Hosts: []string{"shop.example.com", "blog.example.com:8080", "[a-"}, CookieDomain: "example.org"},
+			{Name: "blog/2"},
+		},
+	}
+	report := Validate(&cfg)
+	assert.Len(t, matching(report.Errors, "sites[0].verification.complexity: complexity is required for captcha"), 1)
+	assert.Len(t, matching(report.Errors, `sites[0].match: unknown match mode "any"`), 1)
+	assert.Len(t, matching(report.Errors, `sites[0].protections[0] POST ^/cart$: unknown budget "api"`), 1)
+	assert.Len(t, matching(report.Errors, "sites[1] default: duplicate name"), 1)
+	assert.Len(t, matching(report.Errors, "sites[1] default: host shop.example.com already belongs to the site shop"), 1)
+	assert.Len(t, matching(report.Errors, "sites[1] default: host blog.example.com:8080: host must not contain the port"), 1)
+	assert.Len(t, matching(report.Errors, "sites[1] default: host [a-: syntax error in pattern"), 1)
+	assert.Len(t, matching(report.Warnings, "sites[1] default: cookie domain example.org does not cover the host shop.example.com"), 1)
+	assert.Len(t, matching(report.Warnings, "sites[0] shop: cookie domain"), 0)
+	assert.Len(t, matching(report.Errors, "sites[2] blog/2: name may contain only"), 1)
+	assert.Len(t, matching(report.Errors, "sites[2] blog/2: at least one host is required"), 1)
+}